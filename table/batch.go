@@ -0,0 +1,74 @@
+package table
+
+// WriteBatch holds a list of writes which are applied to the DB atomically by DB.Write. Either all of them are
+// applied, or none of them is, even if the server crashes.
+//
+// Writes in a batch are applied in the order they are added. If a key is written multiple times in a batch,
+// the last write wins.
+//
+// The zero value is an empty batch ready to use. A WriteBatch is not thread-safe.
+type WriteBatch struct {
+	kvs []kv
+}
+
+// Put adds a write setting key to value.
+func (b *WriteBatch) Put(key string, value []byte) {
+	b.kvs = append(b.kvs, kv{key: newKey(key), value: newValue(value)})
+}
+
+// Delete adds a write deleting key.
+func (b *WriteBatch) Delete(key string) {
+	b.kvs = append(b.kvs, kv{key: newKey(key), value: newDeletedValue()})
+}
+
+// Clear removes all writes in the batch, so that it can be reused.
+func (b *WriteBatch) Clear() {
+	b.kvs = b.kvs[:0]
+}
+
+// Len returns the number of writes in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.kvs)
+}
+
+// append adds all writes in other to the batch.
+func (b *WriteBatch) append(other *WriteBatch) {
+	b.kvs = append(b.kvs, other.kvs...)
+}
+
+// size returns the size of the writes in the batch on disk.
+func (b *WriteBatch) size() int {
+	n := 0
+	for _, kv := range b.kvs {
+		n += sizeOnDisk(kv.key.data, kv.value.data)
+	}
+	return n
+}
+
+// withSeq returns the kvs in the batch with seqs assigned. The i-th write gets seq+i.
+func (b *WriteBatch) withSeq(seq Seq) []kv {
+	kvs := make([]kv, len(b.kvs))
+	for i, kv := range b.kvs {
+		kvs[i] = kv
+		kvs[i].key.seq = seq + Seq(i)
+	}
+	return kvs
+}
+
+// WriteOptions controls the behavior of writes.
+type WriteOptions struct {
+	// Sync makes the write synced to the WAL before it's acknowledged, so it survives a crash of the machine.
+	//
+	// If it's false, the write is appended to the WAL without a sync. It survives a crash of the process, but
+	// may be lost if the machine crashes before the WAL is synced by the OS, a later synced write, or the
+	// background syncer (see WithWALSyncInterval and WithWALSyncBytes).
+	Sync bool
+
+	// DisableWAL makes the write skip the WAL. It's useful for data which can be rebuilt, since it saves the
+	// cost of the WAL.
+	//
+	// The write can't be recovered from the WAL. It's lost if the DB crashes before the MemTable holding it is
+	// persisted to an SSTable, i.e. before it's flushed by DB.Flush, DB.Close, or the MemTable becoming full.
+	// It can't be used together with Sync.
+	DisableWAL bool
+}
@@ -0,0 +1,39 @@
+package table
+
+import (
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	b := &WriteBatch{}
+	if b.Len() != 0 {
+		t.Errorf("Got len %d, want 0", b.Len())
+	}
+
+	b.Put("Key1", []byte("Value1"))
+	b.Delete("Key2")
+	b.Put("Key1", []byte("Value2"))
+	if b.Len() != 3 {
+		t.Errorf("Got len %d, want 3", b.Len())
+	}
+
+	want := []kv{
+		{key: newInternalKey("Key1", 10), value: newValue([]byte("Value1"))},
+		{key: newInternalKey("Key2", 11), value: newDeletedValue()},
+		{key: newInternalKey("Key1", 12), value: newValue([]byte("Value2"))},
+	}
+	got := b.withSeq(10)
+	if len(got) != len(want) {
+		t.Fatalf("Got %d kvs, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if !kvEqual(&got[i], &want[i]) {
+			t.Errorf("Got %s, want %s", &got[i], &want[i])
+		}
+	}
+
+	b.Clear()
+	if b.Len() != 0 {
+		t.Errorf("Got len %d after clear, want 0", b.Len())
+	}
+}
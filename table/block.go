@@ -0,0 +1,389 @@
+package table
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// blockTrailerSize is the size of the trailer following each block in an SSTable file.
+//
+// | compression ID (1 byte, see Compressor) |
+// | checksum       (4 bytes big endian uint, CRC32C of the stored block and the compression ID) |
+const blockTrailerSize = 5
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// blockHandle points to a block in an SSTable file. The length is the length of the stored (maybe compressed)
+// block, without the trailer.
+type blockHandle struct {
+	offset uint64
+	length uint64
+}
+
+// blockHandleSize returns the size of an encoded blockHandle in SSTables of version v.
+func blockHandleSize(v formatVersion) int {
+	if v == formatVersion0 {
+		return 8
+	}
+	return 16
+}
+
+// encode encodes the handle as bytes in SSTables of version v.
+//
+// - formatVersion0
+// | offset (4 bytes big endian uint) | length (4 bytes big endian uint) |
+//
+// - formatVersion1
+// | offset (8 bytes big endian uint) | length (8 bytes big endian uint) |
+func (h blockHandle) encode(v formatVersion) []byte {
+	if v == formatVersion0 {
+		bs := binary.BigEndian.AppendUint32(nil, uint32(h.offset))
+		return binary.BigEndian.AppendUint32(bs, uint32(h.length))
+	}
+	bs := binary.BigEndian.AppendUint64(nil, h.offset)
+	return binary.BigEndian.AppendUint64(bs, h.length)
+}
+
+func decodeBlockHandle(bs []byte, v formatVersion) (blockHandle, error) {
+	if len(bs) != blockHandleSize(v) {
+		return blockHandle{}, fmt.Errorf("block handle: got %d bytes, want %d", len(bs), blockHandleSize(v))
+	}
+	if v == formatVersion0 {
+		return blockHandle{
+			offset: uint64(binary.BigEndian.Uint32(bs)),
+			length: uint64(binary.BigEndian.Uint32(bs[4:])),
+		}, nil
+	}
+	return blockHandle{
+		offset: binary.BigEndian.Uint64(bs),
+		length: binary.BigEndian.Uint64(bs[8:]),
+	}, nil
+}
+
+// blockBuilder builds a block from kvs added in internal key order.
+//
+// Keys in a block are prefix compressed. Each key only stores the part not shared with the previous key. Every
+// restartInterval keys, there is a restart point whose key is stored in full, so that a reader can start decoding
+// from it without the keys before it.
+//
+// # A block looks like this
+//
+// - entries
+// | shared key length   (uvarint) |
+// | unshared key length (uvarint) |
+// | value length        (uvarint, 0 if the kv is deleted, otherwise the value length + 1) |
+// | unshared key        |
+// | seq                 (8 bytes big endian uint) |
+// | value               |
+//
+// - restarts
+// | restart offset      (4 bytes big endian uint) |
+// | ...                 |
+// | number of restarts  (4 bytes big endian uint) |
+type blockBuilder struct {
+	restartInterval int
+	buf             bytes.Buffer
+	restarts        []uint32
+	// counter is the number of kvs added since the last restart point.
+	counter int
+	// last is the last added key.
+	last key
+	n    int
+}
+
+func newBlockBuilder(restartInterval int) *blockBuilder {
+	return &blockBuilder{restartInterval: max(restartInterval, 1), restarts: []uint32{0}}
+}
+
+func (b *blockBuilder) add(kv *kv) {
+	shared := 0
+	if b.counter < b.restartInterval {
+		for shared < min(len(b.last.data), len(kv.key.data)) && b.last.data[shared] == kv.key.data[shared] {
+			shared++
+		}
+	} else {
+		b.restarts = append(b.restarts, uint32(b.buf.Len()))
+		b.counter = 0
+	}
+	valueLen := uint64(0)
+	if !kv.value.deleted {
+		valueLen = uint64(len(kv.value.data)) + 1
+	}
+
+	var header [3 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(header[:], uint64(shared))
+	n += binary.PutUvarint(header[n:], uint64(len(kv.key.data)-shared))
+	n += binary.PutUvarint(header[n:], valueLen)
+	b.buf.Write(header[:n])
+	b.buf.WriteString(kv.key.data[shared:])
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], uint64(kv.key.seq))
+	b.buf.Write(seq[:])
+	if !kv.value.deleted {
+		b.buf.Write(kv.value.data)
+	}
+
+	b.last = kv.key
+	b.counter++
+	b.n++
+}
+
+// size returns the estimated size of the block.
+func (b *blockBuilder) size() int {
+	return b.buf.Len() + 4*len(b.restarts) + 4
+}
+
+func (b *blockBuilder) empty() bool {
+	return b.n == 0
+}
+
+// finish returns the content of the block. The builder can't be used until it's reset.
+func (b *blockBuilder) finish() []byte {
+	var bs [4]byte
+	for _, r := range b.restarts {
+		binary.BigEndian.PutUint32(bs[:], r)
+		b.buf.Write(bs[:])
+	}
+	binary.BigEndian.PutUint32(bs[:], uint32(len(b.restarts)))
+	b.buf.Write(bs[:])
+	return b.buf.Bytes()
+}
+
+func (b *blockBuilder) reset() {
+	b.buf.Reset()
+	b.restarts = b.restarts[:1]
+	b.counter = 0
+	b.last = key{}
+	b.n = 0
+}
+
+// block is a block read from an SSTable. It's kept encoded, kvs are decoded while iterating.
+type block struct {
+	// data is the entries of the block.
+	data     []byte
+	restarts []uint32
+
+	// gen and offset tell where the block is, so that corruptions found while decoding kvs can be reported.
+	gen    Gen
+	offset uint64
+}
+
+func decodeBlock(data []byte) (*block, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("block: got %d bytes, too short", len(data))
+	}
+	n := binary.BigEndian.Uint32(data[len(data)-4:])
+	if n == 0 || uint64(n) > uint64(len(data)-4)/4 {
+		return nil, fmt.Errorf("block: invalid number of restarts %d", n)
+	}
+	end := len(data) - 4 - 4*int(n)
+	restarts := make([]uint32, n)
+	for i := range restarts {
+		restarts[i] = binary.BigEndian.Uint32(data[end+4*i:])
+		if restarts[i] > uint32(end) {
+			return nil, fmt.Errorf("block: invalid restart offset %d", restarts[i])
+		}
+	}
+	return &block{data: data[:end], restarts: restarts}, nil
+}
+
+// iter returns an iterator over the kvs of the block.
+func (b *block) iter() *blockIter {
+	return &blockIter{b: b}
+}
+
+// kvs decodes all kvs in the block.
+func (b *block) kvs() ([]kv, error) {
+	var ret []kv
+	it := b.iter()
+	for it.next() {
+		ret = append(ret, it.kv)
+	}
+	return ret, it.err
+}
+
+// seek returns the first kv whose key is greater than or equal to k in internal key order. If there is no such
+// kv, nil is returned.
+func (b *block) seek(k key) (*kv, error) {
+	it := b.iter()
+	if !it.seek(k) {
+		return nil, it.err
+	}
+	return &it.kv, nil
+}
+
+// blockIter iterates over the kvs of a block forward.
+type blockIter struct {
+	b *block
+	// offset is the offset of the next entry to decode.
+	offset int
+	// kv is the kv decoded by the last call to next. The key of the next entry shares a prefix with it.
+	kv  kv
+	err error
+}
+
+// seekToRestart moves the iterator to the i-th restart point. The following next call decodes the kv at it.
+func (it *blockIter) seekToRestart(i int) {
+	it.offset = int(it.b.restarts[i])
+	it.kv = kv{}
+}
+
+// next decodes the next kv. It returns false if there are no more kvs or an error happens.
+func (it *blockIter) next() bool {
+	if it.err != nil || it.offset >= len(it.b.data) {
+		return false
+	}
+	data := it.b.data[it.offset:]
+	var header [3]uint64
+	n := 0
+	for i := range header {
+		v, l := binary.Uvarint(data[n:])
+		if l <= 0 {
+			it.err = it.b.corruption("fail to decode entry header at %d", it.offset)
+			return false
+		}
+		header[i] = v
+		n += l
+	}
+	shared, unshared, valueLen := header[0], header[1], header[2]
+	prev := it.kv.key.data
+	if shared > uint64(len(prev)) {
+		it.err = it.b.corruption("invalid shared key length %d at %d", shared, it.offset)
+		return false
+	}
+	size := unshared + 8
+	if valueLen > 0 {
+		size += valueLen - 1
+	}
+	if unshared > uint64(len(data)) || valueLen > uint64(len(data))+1 || size > uint64(len(data)-n) {
+		it.err = it.b.corruption("entry at %d exceeds the block", it.offset)
+		return false
+	}
+
+	keyEnd := n + int(unshared)
+	it.kv.key = key{
+		data: prev[:shared] + string(data[n:keyEnd]),
+		seq:  Seq(binary.BigEndian.Uint64(data[keyEnd:])),
+	}
+	if valueLen == 0 {
+		it.kv.value = newDeletedValue()
+	} else {
+		// Copy the value, so that the block is not modified through the values returned to callers.
+		it.kv.value = newValue(bytes.Clone(data[keyEnd+8 : keyEnd+8+int(valueLen-1)]))
+	}
+	it.offset += n + int(size)
+	return true
+}
+
+// seek moves the iterator to the first kv whose key is greater than or equal to k in internal key order. It
+// returns false if there is no such kv or an error happens.
+func (it *blockIter) seek(k key) bool {
+	// Find the last restart point whose key is less than k. Keys at restart points are stored in full, so they
+	// can be decoded alone.
+	i := sort.Search(len(it.b.restarts), func(i int) bool {
+		it.seekToRestart(i)
+		if !it.next() {
+			return true
+		}
+		return compareKeys(it.kv.key, k) >= 0
+	})
+	if it.err != nil {
+		return false
+	}
+	it.seekToRestart(max(i-1, 0))
+	for it.next() {
+		if compareKeys(it.kv.key, k) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *block) corruption(format string, args ...any) error {
+	return &CorruptionError{Gen: b.gen, Offset: int64(b.offset), Err: fmt.Errorf("block: "+format, args...)}
+}
+
+// writeBlock compresses the block with c, and writes it and its trailer to w at offset. It returns the handle of
+// the written block.
+//
+// If the compression saves less than 1/8 of the block, the block is stored uncompressed, since decompressing it
+// costs more than reading the extra bytes.
+func writeBlock(w io.Writer, offset uint64, data []byte, c Compressor) (blockHandle, error) {
+	id := noCompressionID
+	if c.ID() != noCompressionID {
+		compressed, err := c.Compress(nil, data)
+		if err != nil {
+			return blockHandle{}, fmt.Errorf("fail to compress block: %w", err)
+		}
+		if len(compressed) < len(data)-len(data)/8 {
+			data, id = compressed, c.ID()
+		}
+	}
+	if _, err := w.Write(data); err != nil {
+		return blockHandle{}, err
+	}
+	var trailer [blockTrailerSize]byte
+	trailer[0] = id
+	binary.BigEndian.PutUint32(trailer[1:], crc32.Update(crc32.Checksum(data, crcTable), crcTable, trailer[:1]))
+	if _, err := w.Write(trailer[:]); err != nil {
+		return blockHandle{}, err
+	}
+	return blockHandle{offset: offset, length: uint64(len(data))}, nil
+}
+
+// end returns the offset right after the block and its trailer.
+func (h blockHandle) end() uint64 {
+	return h.offset + h.length + blockTrailerSize
+}
+
+// readBlockData reads the content of the block pointed by h from the SSTable file with gen, and decompresses it
+// with the compressor recorded in its trailer. If verify is true, the checksum of the block is verified.
+func readBlockData(r io.ReaderAt, cs compressors, gen Gen, h blockHandle, verify bool) ([]byte, error) {
+	data := make([]byte, h.length+blockTrailerSize)
+	if n, err := r.ReadAt(data, int64(h.offset)); err != nil && !(n == len(data) && errors.Is(err, io.EOF)) {
+		if errors.Is(err, io.EOF) {
+			// The handle points beyond the end of the file.
+			return nil, &CorruptionError{Gen: gen, Offset: int64(h.offset), Err: fmt.Errorf("block is truncated: %w", err)}
+		}
+		return nil, fmt.Errorf("sstable[%d]: fail to read block at %d: %w", gen, h.offset, err)
+	}
+	if verify {
+		if got, want := crc32.Checksum(data[:h.length+1], crcTable), binary.BigEndian.Uint32(data[h.length+1:]); got != want {
+			return nil, &CorruptionError{Gen: gen, Offset: int64(h.offset), Err: fmt.Errorf("checksum mismatch: got %08x, want %08x", got, want)}
+		}
+	}
+	id := data[h.length]
+	data = data[:h.length]
+	if id == noCompressionID {
+		return data, nil
+	}
+	c, ok := cs[id]
+	if !ok {
+		return nil, &CorruptionError{Gen: gen, Offset: int64(h.offset), Err: fmt.Errorf("unknown compressor %d", id)}
+	}
+	data, err := c.Decompress(data)
+	if err != nil {
+		return nil, &CorruptionError{Gen: gen, Offset: int64(h.offset), Err: fmt.Errorf("fail to decompress block: %w", err)}
+	}
+	return data, nil
+}
+
+// readBlock reads the block pointed by h from the SSTable file with gen. If verify is true, the checksum of the
+// block is verified.
+func readBlock(r io.ReaderAt, cs compressors, gen Gen, h blockHandle, verify bool) (*block, error) {
+	data, err := readBlockData(r, cs, gen, h, verify)
+	if err != nil {
+		return nil, err
+	}
+	b, err := decodeBlock(data)
+	if err != nil {
+		return nil, &CorruptionError{Gen: gen, Offset: int64(h.offset), Err: err}
+	}
+	b.gen, b.offset = gen, h.offset
+	return b, nil
+}
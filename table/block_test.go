@@ -0,0 +1,147 @@
+package table
+
+import (
+	"fmt"
+	"testing"
+)
+
+// buildBlock builds a block with the kvs.
+func buildBlock(t *testing.T, kvs []kv, restartInterval int) *block {
+	t.Helper()
+	bb := newBlockBuilder(restartInterval)
+	for i := range kvs {
+		bb.add(&kvs[i])
+	}
+	b, err := decodeBlock(bb.finish())
+	if err != nil {
+		t.Fatalf("Fail to decode block: %v", err)
+	}
+	return b
+}
+
+func TestBlock_Kvs(t *testing.T) {
+	kvs := []kv{
+		{key: newInternalKey("tenant1/table1/row1", 5), value: newValue([]byte("Value1"))},
+		{key: newInternalKey("tenant1/table1/row1", 3), value: newDeletedValue()},
+		{key: newInternalKey("tenant1/table1/row2", 4), value: newValue([]byte{})},
+		{key: newInternalKey("tenant1/table2", 6), value: newValue([]byte("Value2"))},
+		{key: newInternalKey("tenant2", 2), value: newValue([]byte("Value3"))},
+		{key: newInternalKey("z", 1), value: newValue([]byte("Value4"))},
+	}
+	for _, restartInterval := range []int{1, 2, 16} {
+		t.Run(fmt.Sprintf("Restart%d", restartInterval), func(t *testing.T) {
+			b := buildBlock(t, kvs, restartInterval)
+			if want := (len(kvs) + restartInterval - 1) / restartInterval; len(b.restarts) != want {
+				t.Errorf("Got %d restarts, want %d", len(b.restarts), want)
+			}
+			got, err := b.kvs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(kvs) {
+				t.Fatalf("Got %d kvs, want %d", len(got), len(kvs))
+			}
+			for i := range got {
+				if !kvEqual(&got[i], &kvs[i]) {
+					t.Errorf("%d: got %s, want %s", i, &got[i], &kvs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBlock_Seek(t *testing.T) {
+	var kvs []kv
+	for i := 0; i < 100; i++ {
+		kvs = append(kvs, kv{key: newInternalKey(fmt.Sprintf("Key%03d", i*2), Seq(i+10)), value: newValue([]byte(fmt.Sprintf("Value%d", i)))})
+	}
+	tcs := []struct {
+		name string
+		key  key
+		// want is the index of the wanted kv. -1 means no kv is found.
+		want int
+	}{
+		{name: "First", key: newInternalKey("Key000", 1000), want: 0},
+		{name: "BeforeFirst", key: newInternalKey("A", 1), want: 0},
+		{name: "Exact", key: newInternalKey("Key050", 1000), want: 25},
+		{name: "RestartPoint", key: newInternalKey("Key032", 1000), want: 16},
+		{name: "Between", key: newInternalKey("Key051", 1000), want: 26},
+		{name: "SameSeq", key: newInternalKey("Key050", 35), want: 25},
+		{name: "NewerThanSeq", key: newInternalKey("Key050", 34), want: 26},
+		{name: "Last", key: newInternalKey("Key198", 1000), want: 99},
+		{name: "AfterLast", key: newInternalKey("Key199", 1000), want: -1},
+	}
+	for _, restartInterval := range []int{1, 16} {
+		b := buildBlock(t, kvs, restartInterval)
+		for _, tc := range tcs {
+			t.Run(fmt.Sprintf("Restart%d/%s", restartInterval, tc.name), func(t *testing.T) {
+				got, err := b.seek(tc.key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tc.want < 0 {
+					if got != nil {
+						t.Errorf("Got %s, want nil", got)
+					}
+					return
+				}
+				if got == nil || !kvEqual(got, &kvs[tc.want]) {
+					t.Errorf("Got %s, want %s", got, &kvs[tc.want])
+				}
+			})
+		}
+	}
+}
+
+func TestBlock_PrefixCompression(t *testing.T) {
+	var kvs []kv
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprintf("tenant%02d/table%02d/row%06d", i/500, i/100, i)
+		kvs = append(kvs, kv{key: newInternalKey(k, Seq(i)), value: newValue([]byte("v"))})
+	}
+	size := func(restartInterval int) int {
+		bb := newBlockBuilder(restartInterval)
+		for i := range kvs {
+			bb.add(&kvs[i])
+		}
+		return len(bb.finish())
+	}
+	full, compressed := size(1), size(16)
+	// Keys are 29 bytes, and consecutive keys share at least 24 bytes.
+	if compressed*2 > full {
+		t.Errorf("Got %d bytes with restart interval 16, want at most half of %d bytes", compressed, full)
+	}
+}
+
+func TestBlock_Corrupted(t *testing.T) {
+	kvs := []kv{
+		{key: newInternalKey("Key1", 2), value: newValue([]byte("Value1"))},
+		{key: newInternalKey("Key2", 1), value: newValue([]byte("Value2"))},
+	}
+	bb := newBlockBuilder(16)
+	for i := range kvs {
+		bb.add(&kvs[i])
+	}
+	data := bb.finish()
+
+	tcs := []struct {
+		name string
+		data []byte
+	}{
+		{name: "TooShort", data: data[:3]},
+		{name: "NoRestarts", data: []byte{0, 0, 0, 0}},
+		{name: "TooManyRestarts", data: append(append([]byte{}, data[:len(data)-4]...), 0, 0, 1, 0)},
+		{name: "TruncatedEntries", data: append(append([]byte{}, data[:10]...), data[len(data)-8:]...)},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := decodeBlock(tc.data)
+			if err != nil {
+				return
+			}
+			if _, err := b.kvs(); err == nil {
+				t.Errorf("Got no error for corrupted block")
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package table
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// blockCacheShards is the number of shards of a blockCache. Each shard has its own lock, so that concurrent
+// reads of different blocks don't contend on a single lock.
+const blockCacheShards = 16
+
+// blockCacheKey identifies a block in the SSTables of a DB.
+type blockCacheKey struct {
+	gen    Gen
+	offset uint64
+}
+
+// blockCache is an LRU cache of decoded data blocks, shared by all SSTables of a DB. Its capacity is in bytes, and
+// split evenly among the shards.
+type blockCache struct {
+	shards [blockCacheShards]cacheShard
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+type cacheShard struct {
+	mu       sync.Mutex
+	capacity int
+	size     int
+	entries  map[blockCacheKey]*list.Element
+	// lru holds *cacheEntry, from the most recently used to the least recently used.
+	lru *list.List
+}
+
+type cacheEntry struct {
+	key    blockCacheKey
+	block  *block
+	charge int
+}
+
+func newBlockCache(capacity int) *blockCache {
+	c := &blockCache{}
+	for i := range c.shards {
+		c.shards[i] = cacheShard{
+			capacity: capacity / blockCacheShards,
+			entries:  make(map[blockCacheKey]*list.Element),
+			lru:      list.New(),
+		}
+	}
+	return c
+}
+
+func (c *blockCache) shard(k blockCacheKey) *cacheShard {
+	h := uint64(k.gen)*31 + k.offset
+	return &c.shards[h%blockCacheShards]
+}
+
+// get returns the cached block.
+func (c *blockCache) get(k blockCacheKey) (*block, bool) {
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[k]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	s.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).block, true
+}
+
+// put adds the block to the cache. The least recently used blocks are evicted if the shard is full. A block
+// larger than the capacity of a shard is not cached.
+func (c *blockCache) put(k blockCacheKey, b *block) {
+	charge := len(b.data) + 4*len(b.restarts)
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if charge > s.capacity {
+		return
+	}
+	if e, ok := s.entries[k]; ok {
+		s.remove(e)
+	}
+	for s.size+charge > s.capacity {
+		s.remove(s.lru.Back())
+		c.evictions.Add(1)
+	}
+	s.entries[k] = s.lru.PushFront(&cacheEntry{key: k, block: b, charge: charge})
+	s.size += charge
+}
+
+// evictTable removes all blocks of the SSTable with gen. It's called once the SSTable is deleted.
+func (c *blockCache) evictTable(gen Gen) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for k, e := range s.entries {
+			if k.gen == gen {
+				s.remove(e)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// size returns the total size of the cached blocks.
+func (c *blockCache) size() int {
+	ret := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		ret += s.size
+		s.mu.Unlock()
+	}
+	return ret
+}
+
+func (s *cacheShard) remove(e *list.Element) {
+	entry := s.lru.Remove(e).(*cacheEntry)
+	delete(s.entries, entry.key)
+	s.size -= entry.charge
+}
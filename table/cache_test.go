@@ -0,0 +1,148 @@
+package table
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/liznear/leveldb-from-scratch/vfs"
+)
+
+// newTestBlock returns a block whose charge in the cache is size bytes.
+func newTestBlock(size int) *block {
+	return &block{data: make([]byte, size-4), restarts: []uint32{0}}
+}
+
+func TestBlockCache(t *testing.T) {
+	// Each shard holds 2 blocks of 10 bytes.
+	c := newBlockCache(20 * blockCacheShards)
+	// Keys in the same shard.
+	k1 := blockCacheKey{gen: 1, offset: 0}
+	k2 := blockCacheKey{gen: 1, offset: blockCacheShards}
+	k3 := blockCacheKey{gen: 1, offset: 2 * blockCacheShards}
+	if c.shard(k1) != c.shard(k2) || c.shard(k1) != c.shard(k3) {
+		t.Fatalf("Got keys in different shards")
+	}
+
+	b1, b2, b3 := newTestBlock(10), newTestBlock(10), newTestBlock(10)
+	c.put(k1, b1)
+	c.put(k2, b2)
+	// k1 becomes the most recently used one, so k2 is evicted.
+	if got, ok := c.get(k1); !ok || got != b1 {
+		t.Errorf("Got %v, %v for k1, want b1", got, ok)
+	}
+	c.put(k3, b3)
+	if _, ok := c.get(k2); ok {
+		t.Errorf("Got k2, want it evicted")
+	}
+	if got, ok := c.get(k3); !ok || got != b3 {
+		t.Errorf("Got %v, %v for k3, want b3", got, ok)
+	}
+	// A block larger than a shard is not cached.
+	c.put(blockCacheKey{gen: 2}, newTestBlock(30))
+	if _, ok := c.get(blockCacheKey{gen: 2}); ok {
+		t.Errorf("Got block larger than the shard capacity")
+	}
+
+	if c.hits.Load() != 2 || c.misses.Load() != 2 || c.evictions.Load() != 1 {
+		t.Errorf("Got hits %d, misses %d, evictions %d, want 2, 2, 1", c.hits.Load(), c.misses.Load(), c.evictions.Load())
+	}
+	if c.size() != 20 {
+		t.Errorf("Got size %d, want 20", c.size())
+	}
+}
+
+func TestBlockCache_EvictTable(t *testing.T) {
+	fs := vfs.NewMem()
+	opts := newTestTableOptions(fs)
+	opts.blockSize = 1
+	opts.cache = newBlockCache(1 << 20)
+
+	var sts []*sstable
+	for gen := Gen(1); gen <= 2; gen++ {
+		var kvs []kv
+		for i := 0; i < 10; i++ {
+			kvs = append(kvs, newKV(fmt.Sprintf("Key%d", i), []byte(fmt.Sprintf("Value%d", i))))
+		}
+		st, err := newSSTable(opts, gen, 0, kvs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sts = append(sts, st)
+		for i := 0; i < 10; i++ {
+			if _, _, err := st.get(fmt.Sprintf("Key%d", i), math.MaxInt64, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	sizeOfOne := opts.cache.size() / 2
+
+	// Scanning doesn't fill the cache.
+	if _, err := sts[0].kvs(); err != nil {
+		t.Fatal(err)
+	}
+	if got := opts.cache.hits.Load(); got != 10 {
+		t.Errorf("Got %d hits, want 10", got)
+	}
+
+	// Deleting an SSTable evicts its blocks.
+	sts[0].unref()
+	if got := opts.cache.size(); got != sizeOfOne {
+		t.Errorf("Got cache size %d, want %d", got, sizeOfOne)
+	}
+	for i := range opts.cache.shards {
+		for k := range opts.cache.shards[i].entries {
+			if k.gen == 1 {
+				t.Errorf("Got block of deleted SSTable %v", k)
+			}
+		}
+	}
+	if got := opts.cache.evictions.Load(); got != 0 {
+		t.Errorf("Got %d evictions, want 0", got)
+	}
+}
+
+func TestDB_BlockCacheStats(t *testing.T) {
+	tcs := []struct {
+		name      string
+		capacity  int
+		wantHits  int64
+		wantCache bool
+	}{
+		{name: "Enabled", capacity: 1 << 20, wantHits: 1, wantCache: true},
+		{name: "Disabled", capacity: 0, wantHits: 0, wantCache: false},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			db, err := NewDB(WithFS(vfs.NewMem()), WithBlockCache(tc.capacity))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			if err := db.Put("Key1", []byte("Value1")); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				got, ok, err := db.Get("Key1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ok || string(got) != "Value1" {
+					t.Errorf("Got %q, %v, want Value1", got, ok)
+				}
+			}
+
+			stats := db.Stats()
+			if stats.BlockCacheHits != tc.wantHits {
+				t.Errorf("Got %d hits, want %d", stats.BlockCacheHits, tc.wantHits)
+			}
+			if got := stats.BlockCacheSize > 0; got != tc.wantCache {
+				t.Errorf("Got cache size %d, want cached %v", stats.BlockCacheSize, tc.wantCache)
+			}
+		})
+	}
+}
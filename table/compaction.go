@@ -3,25 +3,26 @@ package table
 import (
 	"fmt"
 	"math"
-	"os"
-	"sort"
 
-	"github.com/emirpasic/gods/v2/maps/treemap"
 	"github.com/emirpasic/gods/v2/sets/treeset"
 )
 
+// maxCompactionTables is the max number of L0 SSTables merged by a single round of compaction.
+const maxCompactionTables = 16
+
 // compaction compacts all sstables in the given scope.
 //
 // It starts from level 0. For each level, it finds
 // - all sstables on the current level that have overlaps with the given scope.
 // - all sstables on the next level that have overlaps with the given scope.
 //
-// Then it extracts kvs from all these sstables, sort them, and split them into
-// multiple batches if the size is too big, and write each batch as an sstable
-// on the next level.
+// Then it merges kvs from all these sstables in order, splits them into multiple
+// batches if the size is too big, and writes each batch as an sstable on the next
+// level once it's full. At most maxCompactionTables sstables on level 0 are merged
+// at once, the rest are compacted in the following rounds.
 //
-// It is possible that the same key appears multiple times in multiple sstables,
-// only the value in the sstable with the highest Gen would be kept.
+// It is possible that the same key appears multiple times in multiple sstables. Older
+// versions are dropped unless a live snapshot can still see them.
 func (db *DB) compaction(scope *scope) error {
 	for level := 0; level+1 < maxLevels; level++ {
 		if float64(db.version.levels[level].Size()) <= float64(db.cfg.LevelSizeThreshold)*math.Pow(db.cfg.LevelSizeRatio, float64(level)) {
@@ -43,6 +44,15 @@ func (db *DB) compaction(scope *scope) error {
 		if scopeAtLevel == nil {
 			return nil
 		}
+		// Merging all overlapping L0 SSTables at once takes memory proportional to their number, which is unbounded
+		// after recovering a large WAL backlog. Only the oldest ones are merged, the newer ones are left to the
+		// following rounds. Since newer versions are read first from L0, it doesn't change what readers see.
+		batched := level == 0 && len(tablesAtLevel) > maxCompactionTables
+		if batched {
+			// tablesAtLevel is ordered by gen descendingly.
+			tablesAtLevel = tablesAtLevel[len(tablesAtLevel)-maxCompactionTables:]
+			scopeAtLevel = tablesScope(tablesAtLevel)
+		}
 		tablesAtNextLevel, scopeAtNextLevel := sstablesInScope(db.version.levels[nextLevel], scopeAtLevel, false)
 		if db.cfg.Debug {
 			fmt.Printf("Level %d: scope: %s => %s\n", nextLevel, scopeAtLevel, scopeAtNextLevel)
@@ -51,29 +61,41 @@ func (db *DB) compaction(scope *scope) error {
 		var allTables []*sstable
 		allTables = append(allTables, tablesAtLevel...)
 		allTables = append(allTables, tablesAtNextLevel...)
-		kvs, err := mergeKVs(allTables)
-		if err != nil {
-			return fmt.Errorf("compaction: fail to merge kvs: %w", err)
-		}
-
-		// For the max level, we don't need to store the deletion anymore.
-		if nextLevel == maxLevels-1 {
-			var tmp []*kv
-			for _, kv := range kvs {
-				if !kv.value.deleted {
-					tmp = append(tmp, kv)
-				}
+		// SSTables on level 0 may overlap, each of them is read by its own iterator. SSTables on other levels don't,
+		// so they are read one after another. Newer versions come first.
+		var children []internalIterator
+		if level == 0 {
+			for _, t := range tablesAtLevel {
+				children = append(children, newTableIterator(t, true))
 			}
-			kvs = tmp
+		} else {
+			children = append(children, newLevelIterator(append([]*sstable(nil), tablesAtLevel...), true))
+		}
+		children = append(children, newLevelIterator(append([]*sstable(nil), tablesAtNextLevel...), true))
+		if w := int64(len(children)); w > db.maxCompactionWidth.Load() {
+			db.maxCompactionWidth.Store(w)
 		}
 
 		var newSSTables []*sstable
-		for _, kvs := range split(kvs, db.cfg.MaxSSTableSize) {
-			st, err := newSSTable(db.genIter.NextGen(), Level(nextLevel), kvs)
+		sp := &splitter{limit: db.cfg.MaxSSTableSize, flush: func(kvs []kv) error {
+			st, err := newSSTable(db.tableOpts, db.genIter.NextGen(), Level(nextLevel), kvs)
 			if err != nil {
 				return fmt.Errorf("compaction: fail to write new sstable: %w", err)
 			}
 			newSSTables = append(newSSTables, st)
+			return nil
+		}}
+		// For the max level, we don't need to store the deletion anymore.
+		err := mergeKVs(newMergingIterator(children...), db.smallestSnapshot(), nextLevel == maxLevels-1, sp.add)
+		if err == nil {
+			err = sp.finish()
+		}
+		if err != nil {
+			// The written SSTables are not in any version, remove them.
+			for _, st := range newSSTables {
+				st.unref()
+			}
+			return err
 		}
 
 		newVer, err := db.version.Apply(newSSTables, allTables, db.version.seq)
@@ -90,12 +112,17 @@ func (db *DB) compaction(scope *scope) error {
 			db.version = newVer
 		}()
 
-		go func(toDelete []*sstable) {
-			for _, st := range toDelete {
-				_ = os.Remove(sstableFilename(st.gen))
-			}
-		}(allTables)
+		// The compacted SSTables are no longer in the version. Their files are removed once no iterator is
+		// reading them.
+		for _, st := range allTables {
+			st.unref()
+		}
 
+		if batched {
+			// Compact the remaining L0 SSTables in the scope before moving on to the next level.
+			level--
+			continue
+		}
 		if scopeAtNextLevel != nil {
 			scope = scopeAtNextLevel
 		} else {
@@ -105,26 +132,36 @@ func (db *DB) compaction(scope *scope) error {
 	return nil
 }
 
-// split splits the kvs into multiple batches. Each batch has a size less than limit.
-func split(kvs []*kv, limit int) [][]kv {
-	var (
-		ret  [][]kv
-		size int
-		buf  []kv
-	)
-	for _, kv := range kvs {
-		buf = append(buf, *kv)
-		size += sizeOnDisk(kv.key.data, kv.value.data)
-		if size >= limit {
-			ret = append(ret, buf)
-			size = 0
-			buf = nil
+// splitter groups the merged kvs into batches, and flushes each batch once it's full. Each batch has a size
+// less than limit.
+//
+// All versions of a key are kept in the same batch, otherwise the scopes of the batches would overlap.
+type splitter struct {
+	limit int
+	flush func(kvs []kv) error
+	size  int
+	buf   []kv
+}
+
+func (s *splitter) add(kv *kv) error {
+	if s.size >= s.limit && s.buf[len(s.buf)-1].key.data != kv.key.data {
+		if err := s.finish(); err != nil {
+			return err
 		}
 	}
-	if size > 0 {
-		ret = append(ret, buf)
+	s.buf = append(s.buf, *kv)
+	s.size += sizeOnDisk(kv.key.data, kv.value.data)
+	return nil
+}
+
+// finish flushes the kvs not flushed yet.
+func (s *splitter) finish() error {
+	if len(s.buf) == 0 {
+		return nil
 	}
-	return ret
+	buf := s.buf
+	s.buf, s.size = nil, 0
+	return s.flush(buf)
 }
 
 // sstablesInScope returns the sstables that are in the given scope. Also, the combined scope of all returned
@@ -157,30 +194,56 @@ func sstablesInScope(tables *treeset.Set[*sstable], s *scope, recursive bool) ([
 	return sstablesInScope(tables, fscope, true)
 }
 
-// mergeKVs extracts all kvs from sstables, and merge them into a single list. The list is sorted by keys.
+// tablesScope returns the combined scope of the sstables.
+func tablesScope(tables []*sstable) *scope {
+	scopes := make([]*scope, 0, len(tables))
+	for _, t := range tables {
+		scopes = append(scopes, t.scope)
+	}
+	return fusion(scopes)
+}
+
+// mergeKVs merges the kvs from iter, and calls fn with each kv kept, sorted by internal keys. Only the blocks
+// being visited are loaded, so the memory used doesn't depend on the sizes of the merged SSTables. If the same
+// internal key appears multiple times, only the first one is kept.
 //
-// If the same key appears in multiple sstables, only the value in the sstable with the highest Gen would be kept.
-func mergeKVs(sts []*sstable) ([]*kv, error) {
-	sort.Slice(sts, func(i, j int) bool {
-		return sts[i].gen < sts[j].gen
-	})
-
-	m := treemap.New[string, *kv]()
-	for _, st := range sts {
-		kvs, err := st.kvs()
-		if err != nil {
-			return nil, fmt.Errorf("compaction: fail to get kvs of sstable %q: %w", sstableFilename(st.gen), err)
+// If the same key has multiple versions, a version is dropped if a newer version is already visible to the
+// oldest snapshot (smallest), since no reader can see it anymore. If dropDeleted is true, deletions visible to
+// the oldest snapshot are also dropped, together with all older versions of the key.
+//
+// iter is closed when mergeKVs returns.
+func mergeKVs(iter internalIterator, smallest Seq, dropDeleted bool, fn func(kv *kv) error) error {
+	defer iter.Close()
+
+	var (
+		// last is the previous (newer) kv. lastSeq is the seq of the previous version of the same key.
+		last    key
+		lastSeq Seq
+		first   = true
+	)
+	for iter.First(); iter.Valid(); iter.Next() {
+		kv := iter.kv()
+		if !first && kv.key == last {
+			continue
 		}
-		for _, kv := range kvs {
-			kv := kv
-			m.Put(kv.key.data, &kv)
+		if first || kv.key.data != last.data {
+			first = false
+			lastSeq = math.MaxInt64
+		}
+		last = kv.key
+		drop := lastSeq <= smallest
+		if dropDeleted && kv.value.deleted && kv.key.seq <= smallest {
+			drop = true
+		}
+		lastSeq = kv.key.seq
+		if !drop {
+			if err := fn(kv); err != nil {
+				return err
+			}
 		}
 	}
-
-	var ret []*kv
-	iter := m.Iterator()
-	for iter.Next() {
-		ret = append(ret, iter.Value())
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("compaction: fail to merge kvs: %w", err)
 	}
-	return ret, nil
+	return nil
 }
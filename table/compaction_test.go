@@ -2,21 +2,18 @@ package table
 
 import (
 	"fmt"
-	"os"
 	"testing"
+
+	"github.com/liznear/leveldb-from-scratch/vfs"
 )
 
 func TestCompaction(t *testing.T) {
-	defer EnterTempDir(t)()
-
-	cwd, err := os.Getwd()
-	if err != nil {
-		t.Fatalf("Fail to get current working dir: %v", err)
-	}
+	fs := vfs.NewMem()
 
 	db, err := NewDB(
-		WithMaxMemTableSize(20),
-		WithMaxSSTableSize(20),
+		WithFS(fs),
+		WithMaxMemTableSize(30),
+		WithMaxSSTableSize(30),
 		WithCompactionConfig(1, 1))
 	if err != nil {
 		t.Fatal(err)
@@ -57,8 +54,125 @@ func TestCompaction(t *testing.T) {
 	for i, want := range seq {
 		_ = db.Put("Key", []byte(fmt.Sprintf("Value%d", i%2)))
 		db.waitPersist()
-		verifyFiles(t, cwd, sstableExtension, want)
+		verifyFiles(t, fs, ".", sstableExtension, want)
 	}
 
 	db.Close()
 }
+
+func TestMergeKVs(t *testing.T) {
+	put := func(k string, seq Seq, v string) kv {
+		return kv{key: newInternalKey(k, seq), value: newValue([]byte(v))}
+	}
+	del := func(k string, seq Seq) kv {
+		return kv{key: newInternalKey(k, seq), value: newDeletedValue()}
+	}
+	// Versions of the same key are spread across tables.
+	tables := [][]kv{
+		{put("Key1", 5, "V5"), put("Key2", 6, "V6")},
+		{put("Key1", 3, "V3"), del("Key2", 4)},
+		{put("Key1", 1, "V1"), put("Key2", 2, "V2")},
+	}
+
+	tcs := []struct {
+		name        string
+		smallest    Seq
+		dropDeleted bool
+		want        []kv
+	}{
+		{
+			name:     "NoSnapshot",
+			smallest: 10,
+			want:     []kv{put("Key1", 5, "V5"), put("Key2", 6, "V6")},
+		},
+		{
+			name:     "KeepVersionsVisibleToSnapshot",
+			smallest: 4,
+			want:     []kv{put("Key1", 5, "V5"), put("Key1", 3, "V3"), put("Key2", 6, "V6"), del("Key2", 4)},
+		},
+		{
+			name:     "KeepAllVersions",
+			smallest: 0,
+			want: []kv{
+				put("Key1", 5, "V5"), put("Key1", 3, "V3"), put("Key1", 1, "V1"),
+				put("Key2", 6, "V6"), del("Key2", 4), put("Key2", 2, "V2"),
+			},
+		},
+		{
+			name:        "DropDeleted",
+			smallest:    4,
+			dropDeleted: true,
+			want:        []kv{put("Key1", 5, "V5"), put("Key1", 3, "V3"), put("Key2", 6, "V6")},
+		},
+		{
+			name:        "KeepDeletedNotVisibleToSnapshot",
+			smallest:    3,
+			dropDeleted: true,
+			want:        []kv{put("Key1", 5, "V5"), put("Key1", 3, "V3"), put("Key2", 6, "V6"), del("Key2", 4), put("Key2", 2, "V2")},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := vfs.NewMem()
+			var sts []*sstable
+			for i, kvs := range tables {
+				st, err := newSSTable(newTestTableOptions(fs), Gen(i+1), 1, kvs)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sts = append(sts, st)
+			}
+
+			var children []internalIterator
+			for _, st := range sts {
+				children = append(children, newTableIterator(st, true))
+			}
+			var got []*kv
+			err := mergeKVs(newMergingIterator(children...), tc.smallest, tc.dropDeleted, func(kv *kv) error {
+				kv2 := *kv
+				got = append(got, &kv2)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("Got %d kvs, want %d", len(got), len(tc.want))
+			}
+			for i := range got {
+				if !kvEqual(got[i], &tc.want[i]) {
+					t.Errorf("%d: got %s, want %s", i, got[i], &tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSplitter(t *testing.T) {
+	kvs := []*kv{
+		{key: newInternalKey("Key1", 3), value: newValue([]byte("Value"))},
+		{key: newInternalKey("Key1", 2), value: newValue([]byte("Value"))},
+		{key: newInternalKey("Key1", 1), value: newValue([]byte("Value"))},
+		{key: newInternalKey("Key2", 4), value: newValue([]byte("Value"))},
+	}
+	// Each kv is 25 bytes. The versions of Key1 must stay in the same batch even if they exceed the limit.
+	var got [][]kv
+	sp := &splitter{limit: 30, flush: func(kvs []kv) error {
+		got = append(got, kvs)
+		return nil
+	}}
+	for _, kv := range kvs {
+		if err := sp.add(kv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sp.finish(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("Got %d batches, want 2", len(got))
+	}
+	if len(got[0]) != 3 || len(got[1]) != 1 {
+		t.Errorf("Got batches of %d and %d kvs, want 3 and 1", len(got[0]), len(got[1]))
+	}
+}
@@ -0,0 +1,127 @@
+package table
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// Compressor compresses blocks of SSTables.
+//
+// The ID of the compressor is recorded with each block it compresses, so that the block can be decompressed by
+// the compressor with the same ID, even if the DB is configured with another compressor later. IDs below 16 are
+// reserved for built-in compressors. NewDB fails if a custom compressor uses one of them, or the ID of another
+// custom compressor.
+type Compressor interface {
+	// ID identifies the format of compressed blocks.
+	ID() byte
+
+	// Compress appends the compressed src to dst and returns the result.
+	Compress(dst, src []byte) ([]byte, error)
+
+	// Decompress returns the decompressed src.
+	Decompress(src []byte) ([]byte, error)
+}
+
+// IDs of built-in compressors. IDs below minCustomCompressionID are reserved for them.
+const (
+	noCompressionID    byte = 0
+	flateCompressionID byte = 1
+
+	minCustomCompressionID byte = 16
+)
+
+// NoCompression stores blocks as they are.
+var NoCompression Compressor = noCompressor{}
+
+type noCompressor struct{}
+
+func (noCompressor) ID() byte {
+	return noCompressionID
+}
+
+func (noCompressor) Compress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (noCompressor) Decompress(src []byte) ([]byte, error) {
+	return src, nil
+}
+
+// NewFlateCompressor returns a compressor using DEFLATE with the given level, from flate.BestSpeed to
+// flate.BestCompression. Blocks compressed with any level can be decompressed by it.
+func NewFlateCompressor(level int) (Compressor, error) {
+	// Make sure the level is valid, so that Compress doesn't fail for it.
+	if _, err := flate.NewWriter(io.Discard, level); err != nil {
+		return nil, fmt.Errorf("compression: invalid flate level %d: %w", level, err)
+	}
+	c := &flateCompressor{}
+	c.writers.New = func() any {
+		w, _ := flate.NewWriter(nil, level)
+		return w
+	}
+	return c, nil
+}
+
+type flateCompressor struct {
+	// writers caches flate writers, since creating them is expensive.
+	writers sync.Pool
+}
+
+func (c *flateCompressor) ID() byte {
+	return flateCompressionID
+}
+
+func (c *flateCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w := c.writers.Get().(*flate.Writer)
+	defer c.writers.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *flateCompressor) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// defaultFlateCompressor decompresses blocks compressed by flate compressors with any level.
+var defaultFlateCompressor, _ = NewFlateCompressor(flate.DefaultCompression)
+
+// compressors are compressors which can decompress blocks, indexed by their IDs.
+type compressors map[byte]Compressor
+
+// newCompressors returns the built-in compressors together with the given ones.
+//
+// Compressors with the same ID must be of the same type, e.g. flate compressors with different levels, since they
+// decompress the blocks of each other. So a custom compressor can't take the ID of a built-in one, or of another
+// custom one. IDs reserved for built-in compressors can't be used by custom ones either.
+func newCompressors(cs ...Compressor) (compressors, error) {
+	ret := compressors{
+		noCompressionID:    NoCompression,
+		flateCompressionID: defaultFlateCompressor,
+	}
+	for _, c := range cs {
+		if c == nil {
+			continue
+		}
+		id := c.ID()
+		if other, ok := ret[id]; ok && reflect.TypeOf(other) != reflect.TypeOf(c) {
+			return nil, fmt.Errorf("compression: compressor %T has the same ID %d as %T", c, id, other)
+		} else if !ok && id < minCustomCompressionID {
+			return nil, fmt.Errorf("compression: compressor %T has ID %d reserved for built-in compressors", c, id)
+		}
+		ret[id] = c
+	}
+	return ret, nil
+}
@@ -0,0 +1,247 @@
+package table
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/liznear/leveldb-from-scratch/vfs"
+)
+
+func TestCompressor(t *testing.T) {
+	bestSpeed, err := NewFlateCompressor(flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	best, err := NewFlateCompressor(flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcs := []struct {
+		name string
+		c    Compressor
+	}{
+		{name: "None", c: NoCompression},
+		{name: "FlateBestSpeed", c: bestSpeed},
+		{name: "FlateBestCompression", c: best},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, src := range [][]byte{nil, []byte("Value1"), []byte(strings.Repeat("tenant/table/row", 100))} {
+				compressed, err := tc.c.Compress([]byte("prefix"), src)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.HasPrefix(compressed, []byte("prefix")) {
+					t.Fatalf("Got %q, want it appended to prefix", compressed)
+				}
+				got, err := tc.c.Decompress(compressed[len("prefix"):])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, src) {
+					t.Errorf("Got %q, want %q", got, src)
+				}
+			}
+		})
+	}
+
+	if _, err := NewFlateCompressor(100); err == nil {
+		t.Errorf("Got no error for invalid flate level")
+	}
+}
+
+func TestSSTable_Compression(t *testing.T) {
+	flateCompressor, err := NewFlateCompressor(flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repeated := func(int) []byte { return bytes.Repeat([]byte("v"), 100) }
+	random := rand.New(rand.NewSource(1))
+	randomValue := func(int) []byte {
+		v := make([]byte, 100)
+		random.Read(v)
+		return v
+	}
+
+	tcs := []struct {
+		name   string
+		c      Compressor
+		value  func(i int) []byte
+		wantID byte
+	}{
+		{name: "None", c: NoCompression, value: repeated, wantID: noCompressionID},
+		{name: "Flate", c: flateCompressor, value: repeated, wantID: flateCompressionID},
+		// Random values can't be compressed, so they are stored as they are.
+		{name: "Incompressible", c: flateCompressor, value: randomValue, wantID: noCompressionID},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			var kvs []kv
+			for i := 0; i < 100; i++ {
+				kvs = append(kvs, newKV(fmt.Sprintf("Key%03d", i), tc.value(i)))
+			}
+			opts := newTestTableOptions(vfs.NewMem())
+			opts.compression[1] = tc.c
+			st, err := newSSTable(opts, 1, 1, kvs)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := st.open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.release()
+			e, err := r.index.seek(newInternalKey("Key000", math.MaxInt64))
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, err := decodeBlockHandle(e.value.data, r.footer.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			trailer := make([]byte, blockTrailerSize)
+			if _, err := r.f.ReadAt(trailer, int64(h.offset+h.length)); err != nil {
+				t.Fatal(err)
+			}
+			if trailer[0] != tc.wantID {
+				t.Errorf("Got compression ID %d, want %d", trailer[0], tc.wantID)
+			}
+
+			got, err := st.kvs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, kvs) {
+				t.Errorf("Got kvs %v, want %v", got, kvs)
+			}
+		})
+	}
+}
+
+func TestDB_LevelCompression(t *testing.T) {
+	if _, err := NewDB(WithFS(vfs.NewMem()), WithLevelCompression(maxLevels, NoCompression)); err == nil {
+		t.Errorf("Got no error for invalid compression level")
+	}
+
+	flateCompressor, err := NewFlateCompressor(flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := vfs.NewMem()
+	opts := []Option{
+		WithFS(fs),
+		WithMaxMemTableSize(200),
+		WithMaxSSTableSize(200),
+		WithCompactionConfig(1, 1),
+		WithCompression(flateCompressor),
+		WithLevelCompression(0, NoCompression),
+	}
+	c := 200
+	func() {
+		db, err := NewDB(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		// Compaction merges uncompressed SSTables on level 0 with compressed ones on other levels.
+		for i := 0; i < c; i++ {
+			if err := db.Put(fmt.Sprintf("Key%03d", i), []byte(strings.Repeat("Value", 5))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}()
+
+	// SSTables with mixed compressions can be read after reopening, even with another compression.
+	db, err := NewDB(WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < c; i++ {
+		got, ok, err := db.GetWithOptions(fmt.Sprintf("Key%03d", i), ReadOptions{VerifyChecksums: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || string(got) != strings.Repeat("Value", 5) {
+			t.Errorf("Got Key%03d=%q, %v, want %q", i, got, ok, strings.Repeat("Value", 5))
+		}
+	}
+	if db.version.levels[0].Size() == 0 || db.version.levels[1].Size() == 0 {
+		t.Errorf("Got %d SSTables on level 0 and %d on level 1, want both", db.version.levels[0].Size(), db.version.levels[1].Size())
+	}
+}
+
+// idCompressor stores blocks as they are, with the given ID.
+type idCompressor struct {
+	noCompressor
+	id byte
+}
+
+func (c idCompressor) ID() byte {
+	return c.id
+}
+
+func TestDB_CompressorIDs(t *testing.T) {
+	flateCompressor, err := NewFlateCompressor(flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcs := []struct {
+		name    string
+		opts    []Option
+		wantErr bool
+	}{
+		{
+			name: "BuiltIn",
+			opts: []Option{WithCompression(flateCompressor), WithLevelCompression(0, NoCompression)},
+		},
+		{
+			name: "Custom",
+			opts: []Option{WithCompression(idCompressor{id: 16}), WithLevelCompression(0, idCompressor{id: 16})},
+		},
+		{
+			name:    "NoCompressionID",
+			opts:    []Option{WithCompression(idCompressor{id: noCompressionID})},
+			wantErr: true,
+		},
+		{
+			name:    "FlateID",
+			opts:    []Option{WithCompression(idCompressor{id: flateCompressionID})},
+			wantErr: true,
+		},
+		{
+			name:    "ReservedID",
+			opts:    []Option{WithCompression(idCompressor{id: minCustomCompressionID - 1})},
+			wantErr: true,
+		},
+		{
+			name:    "DuplicateID",
+			opts:    []Option{WithCompression(idCompressor{id: 16}), WithLevelCompression(0, &idCompressor{id: 16})},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			db, err := NewDB(append([]Option{WithFS(vfs.NewMem())}, tc.opts...)...)
+			if tc.wantErr {
+				if err == nil {
+					_ = db.Close()
+					t.Errorf("Got no error, want one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = db.Close()
+		})
+	}
+}
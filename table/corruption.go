@@ -0,0 +1,52 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCorruption is matched by errors.Is for errors caused by corrupted data, e.g. a checksum mismatch. Use
+// errors.As with a *CorruptionError or a *LogCorruptionError to find where the corruption is.
+var ErrCorruption = errors.New("corruption")
+
+// CorruptionError is returned when the data in an SSTable file is corrupted.
+type CorruptionError struct {
+	// Gen is the gen of the SSTable file.
+	Gen Gen
+	// Offset is the offset of the corrupted block or footer in the file.
+	Offset int64
+	Err    error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("sstable[%d]: corruption at offset %d: %v", e.Gen, e.Offset, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorruption
+}
+
+// LogCorruptionError is returned when a record in a log file, i.e. a WAL or the version log, is corrupted.
+type LogCorruptionError struct {
+	// File is the name of the log file.
+	File string
+	// Offset is the offset of the corrupted record in the file.
+	Offset int64
+	Err    error
+}
+
+func (e *LogCorruptionError) Error() string {
+	return fmt.Sprintf("log %s: corruption at offset %d: %v", e.File, e.Offset, e.Err)
+}
+
+func (e *LogCorruptionError) Unwrap() error {
+	return e.Err
+}
+
+func (e *LogCorruptionError) Is(target error) bool {
+	return target == ErrCorruption
+}
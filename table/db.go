@@ -3,102 +3,218 @@ package table
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"path"
-	"path/filepath"
-	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/liznear/leveldb-from-scratch/vfs"
 )
 
 const maxLevels = 4
 
-type DB struct {
-	cfg     *Config
-	seqIter *SeqIter
-	genIter *GenIter
+// ErrClosed is returned by writes to a DB after it's closed, and by closing it again.
+var ErrClosed = errors.New("db is closed")
 
-	// Protects mem & version
-	// This is only needed for now. Once we support MVCC, we can remove this lock.
+type DB struct {
+	cfg       *Config
+	tableOpts *tableOptions
+	seqIter   *SeqIter
+	genIter   *GenIter
+
+	// Protects mem & version.
+	// Readers hold the read lock while reading, so that the SSTables they read are not compacted away
+	// under them. Swapping mem or version needs the write lock.
 	rwlock  sync.RWMutex
 	mem     *MemTable
 	version version
 
+	// writeMu protects writers, the queue of pending writes. The writer at the front is the leader. It commits
+	// the writes of a group of writers at the front together, and then wakes them up. Since only the leader
+	// writes, sequence numbers are assigned and become visible in order.
+	writeMu   sync.Mutex
+	writeCond *sync.Cond
+	writers   []*writer
+	// closed is set by Close. New writes are rejected with ErrClosed after that. It's protected by writeMu.
+	closed bool
+	// lastSeq is the seq of the latest write visible to readers.
+	lastSeq atomic.Int64
+
+	snapshotsMu sync.Mutex
+	snapshots   map[*Snapshot]struct{}
+
 	prevMem   atomic.Pointer[MemTable]
 	wg        sync.WaitGroup
 	toPersist chan struct{}
 	persisted chan struct{}
+	// closing is closed when the DB is being closed, to stop background goroutines.
+	closing chan struct{}
+
+	// lock is held on the LOCK file in the DB directory until the DB is closed.
+	lock io.Closer
+
+	// recovery is the report of the recovery from WAL files when the DB is opened.
+	recovery RecoveryReport
+
+	// maxCompactionWidth is the max number of iterators merged at once by a compaction since the DB is opened.
+	// Each of them holds one data block in memory.
+	maxCompactionWidth atomic.Int64
 }
 
 // NewDB creates a DB instance with the given options.
 //
 // It is possible that there are already data in the folder. In this case, we need to recover the data.
-func NewDB(opts ...Option) (*DB, error) {
+//
+// Only one DB instance can use a directory at the same time. If the directory is already opened by another
+// DB instance, ErrLocked is returned.
+func NewDB(opts ...Option) (_ *DB, err error) {
 	config := defaultConfig()
 	for _, opt := range opts {
 		opt(config)
 	}
 
-	// load the latest version from the version WAL file if there is any.
-	version, err := loadLatestVersion()
+	if err := config.FS.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("fail to create dir %q: %w", config.Dir, err)
+	}
+
+	// Lock the directory before touching any data files, so that no one else can modify them concurrently.
+	lock, err := config.FS.Lock(lockFile(config.Dir))
+	if err != nil {
+		return nil, fmt.Errorf("fail to lock dir %q: %w", config.Dir, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = lock.Close()
+		}
+	}()
+
+	// load the latest version from the manifest file if there is any.
+	tableOpts, err := newTableOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil && tableOpts.tables != nil {
+			tableOpts.tables.close()
+		}
+	}()
+	version, err := loadLatestVersion(tableOpts, int64(config.MaxManifestSize))
 	if err != nil {
 		return nil, fmt.Errorf("fail to recovery from latest version: %w", err)
 	}
+	defer func() {
+		if err != nil {
+			_ = version.manifest.Close()
+		}
+	}()
 	if config.Debug {
 		fmt.Println(version.debug())
 	}
-	maxGen := version.MaxGen()
-	genIter := NewGenIter(maxGen + 1)
+	// Gens of deleted SSTables are not in the version, but they are covered by the recorded next Gen.
+	genIter := NewGenIter(max(version.MaxGen()+1, version.nextGen))
 
-	// load all un-persisted KVs from last crash.
-	kvs, seqs, err := loadKVsFromWAL(version.seq)
-	seqIter := NewSeqIter()
-	mem, err := NewMemTable(seqIter.NextSeq(), config.MaxMemTableSize)
+	// Replay all un-persisted KVs from last crash into level 0 SSTables.
+	replay, err := replayWAL(tableOpts, version.seq, config.WALRecoveryMode, config.MaxMemTableSize, genIter)
+	if err != nil {
+		return nil, fmt.Errorf("fail to recover from WAL: %w", err)
+	}
+	report := replay.report
+	for _, d := range report.Dropped {
+		log.Printf("WAL recovery in mode %s dropped %s\n", report.Mode, d)
+	}
+	// The version log records the last seq used when it's written, and later seqs are either the seqs of WAL files
+	// or of the KVs in them. So all new seqs are greater than the existing ones, even if a WAL file is lost.
+	seqIter := NewSeqIter(max(replay.maxSeq, version.seq, version.lastSeq))
+	version.manifest.seqIter, version.manifest.genIter = seqIter, genIter
+	if len(replay.tables) > 0 {
+		// All replayed KVs are added to the version at once, so that if the server crashes during recovery, the
+		// WAL files are replayed again from the start. All WAL files have seqs no greater than replay.maxSeq.
+		if version, err = version.Apply(replay.tables, nil, replay.maxSeq); err != nil {
+			return nil, fmt.Errorf("fail to recover from WAL: %w", err)
+		}
+	}
+	// All loaded KVs are persisted. It is safe to remove old WAL files now.
+	for _, seq := range replay.seqs {
+		_ = config.FS.Remove(kvLogFile(config.Dir, seq))
+	}
+	mem, err := NewMemTable(config.FS, config.Dir, seqIter.NextSeq(), config.MaxMemTableSize)
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			_ = mem.wal.Close()
+		}
+	}()
 
 	db := &DB{
 		cfg:       config,
+		tableOpts: tableOpts,
 		seqIter:   seqIter,
 		genIter:   genIter,
 		mem:       mem,
 		version:   version,
+		snapshots: make(map[*Snapshot]struct{}),
 		toPersist: make(chan struct{}, 1),
 		persisted: make(chan struct{}, 1),
+		closing:   make(chan struct{}),
+		lock:      lock,
+		recovery:  report,
 	}
-	db.wg.Add(1)
-	go db.loop()
-
-	// Reprocess all un-persisted KVs.
-	for k, v := range kvs {
-		var err error
-		if v.deleted {
-			err = db.mem.remove(k)
-		} else {
-			err = db.mem.put(k, v.data)
-		}
-		if err != nil {
-			return nil, fmt.Errorf("fail to recover from WAL: %w", err)
-		}
+	db.writeCond = sync.NewCond(&db.writeMu)
+	db.lastSeq.Store(int64(mem.seq))
+	// The recovered SSTables are compacted in the background, so that opening a DB with a large WAL backlog
+	// doesn't wait for them.
+	var recovered *scope
+	if len(replay.tables) > 0 {
+		recovered = tablesScope(replay.tables)
 	}
-	// All loaded KVs are re-processed. It is safe to remove old WAL files now.
-	// If server crashes again, data can still be recovered from the new WAL files.
-	for _, seq := range seqs {
-		_ = os.Remove(kvLogFile(seq))
+	db.wg.Add(1)
+	go db.loop(recovered)
+	if config.WALSyncInterval > 0 {
+		db.wg.Add(1)
+		go db.syncLoop()
 	}
+
 	return db, nil
 }
 
-// Close stops the DB and wait for any in-process work to complete before returning.
+// Close stops the DB and wait for any in-process work to complete before returning. The lock on the
+// directory is released after that.
+//
+// Writes queued before Close are committed. Writes after it fail with ErrClosed.
 func (db *DB) Close() error {
-	err := db.mem.wal.Close()
-	if err != nil {
-		return err
+	// Reject new writes, and wait until the queued ones are done. No one else changes db.mem after that.
+	db.writeMu.Lock()
+	if db.closed {
+		db.writeMu.Unlock()
+		return ErrClosed
+	}
+	db.closed = true
+	for len(db.writers) > 0 {
+		db.writeCond.Wait()
+	}
+	db.writeMu.Unlock()
+
+	// Resources are released even if something fails, so that the directory can be opened again.
+	var errs []error
+	// Writes with WAL disabled can't be recovered from the WAL. Persist them before closing. Close is the only
+	// writer now, so it flushes like a leader.
+	if db.mem.hasUnloggedWrites() {
+		if err := db.flush(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	close(db.closing)
+	// Unsynced writes are synced, so that they are not lost if the machine crashes after the DB is closed.
+	if err := db.mem.wal.Sync(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := db.mem.wal.Close(); err != nil {
+		errs = append(errs, err)
 	}
 	// Close the toPersist channel so that the loop know it can stop after handling the current
 	// in progress one if there is any.
@@ -106,80 +222,68 @@ func (db *DB) Close() error {
 
 	// Wait until the loop finish.
 	db.wg.Wait()
-	return nil
-}
 
-// loadKVsFromWAL would load all KVs from the KV WAL files that have a sequence number higher than the given seq.
-//
-// This function is called after we rebuild the latest version from the version WAL file. All KV WAL files with sequence
-// numbers higher than the version's sequence number are inserted, but not included in the version. We need to re-insert
-// these KVs into the DB.
-func loadKVsFromWAL(since Seq) (map[string]value, []Seq, error) {
-	wals, err := filepath.Glob("./*" + walExtension)
-	if err != nil {
-		return nil, nil, err
+	// SSTables still used by unclosed iterators are closed once the iterators are closed.
+	if db.tableOpts.tables != nil {
+		db.tableOpts.tables.close()
 	}
-
-	var seqs []Seq
-	for _, wal := range wals {
-		base := path.Base(wal)
-		if base == versionLogFile() {
-			continue
-		}
-		seq, err := strconv.ParseInt(strings.TrimSuffix(base, walExtension), 10, 64)
-		if err != nil {
-			log.Printf("fail to parse wal %q: %v\n", wal, err)
-		}
-
-		// Here, we include all KV WALs no matter if its seq is higher than since. We would skip those with lower
-		// seqs below. Here, we collect all seqs because we need to remove all these WAL files after we re-insert
-		// the KVs.
-		seqs = append(seqs, Seq(seq))
-
+	if err := db.version.manifest.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := db.lock.Close(); err != nil {
+		errs = append(errs, err)
 	}
-	sort.Slice(seqs, func(i, j int) bool {
-		return seqs[i] < seqs[j]
-	})
+	return errors.Join(errs...)
+}
 
-	// The same key may appear multiple times in the WAL files. We only need to re-insert the latest value for each
-	// key. So we use a map here.
-	kvs := make(map[string]value)
-loadKVs:
-	for _, seq := range seqs {
-		if seq <= since {
-			continue
-		}
-		logIter, err := newKVLogIter(seq)
-		if err != nil {
-			if errors.Is(err, os.ErrNotExist) {
-				break loadKVs
-			}
-			return nil, nil, err
-		}
-		for logIter.Next() {
-			kvLog := &kvLog{}
-			if err := logIter.Read(kvLog); err != nil {
-				// If a log WAL is incomplete, we just stop.
-				// We don't need to truncate the WAL file since the file would be deleted.
-				// These KVs would be re-processed in the current recovery, and thus written to new WAL files.
-				ierr := &incompleteLogError{}
-				if errors.As(err, &ierr) {
-					break loadKVs
-				}
-				return nil, nil, err
-			}
-			kvs[kvLog.kv.key.data] = kvLog.kv.value
+// newTableOptions returns the options of SSTables of the DB with config.
+func newTableOptions(config *Config) (*tableOptions, error) {
+	opts := &tableOptions{
+		fs:               config.FS,
+		dir:              config.Dir,
+		blockSize:        config.BlockSize,
+		restartInterval:  config.BlockRestartInterval,
+		filterBitsPerKey: config.FilterBitsPerKey,
+		stats:            &tableStats{},
+	}
+	if config.BlockCacheSize > 0 {
+		opts.cache = newBlockCache(config.BlockCacheSize)
+	}
+	if config.MaxOpenFiles > 0 {
+		opts.tables = newTableCache(config.MaxOpenFiles)
+	}
+	cs := []Compressor{config.Compression}
+	for lvl := range opts.compression {
+		opts.compression[lvl] = config.Compression
+	}
+	for lvl, c := range config.LevelCompression {
+		if lvl < 0 || lvl >= maxLevels {
+			return nil, fmt.Errorf("invalid compression level %d, want [0, %d)", lvl, maxLevels)
 		}
+		opts.compression[lvl] = c
+		cs = append(cs, c)
+	}
+	compressors, err := newCompressors(cs...)
+	if err != nil {
+		return nil, err
 	}
-	// We can't delete the WAL files yet. If we delete them and the server crash again, the data is lost.
-	return kvs, seqs, err
+	opts.compressors = compressors
+	return opts, nil
 }
 
 // loop would keep reading from the toPersist channel. Once receiving an item from the channel, it should persist
 // the current full MemTable stored in prevMem. After that, it also starts compaction if needed.
-func (db *DB) loop() {
+//
+// If recovered is not nil, the SSTables recovered from WAL files in it are compacted first.
+func (db *DB) loop(recovered *scope) {
 	defer db.wg.Done()
 
+	if recovered != nil {
+		if err := db.compaction(recovered); err != nil {
+			log.Panicf("Fail to compact recovered SSTables: %v", err)
+		}
+	}
+
 	// Send a signal to the channel persisted to indicate that we are ready to persist the next MemTable.
 	db.persisted <- struct{}{}
 	for {
@@ -190,7 +294,7 @@ func (db *DB) loop() {
 			}
 
 			prevMem := db.prevMem.Load()
-			st, err := prevMem.persist(db.genIter.NextGen())
+			st, err := prevMem.persist(db.tableOpts, db.genIter.NextGen())
 			if err != nil {
 				log.Panicf("Fail to persist immutable memtable: %v", err)
 			}
@@ -203,7 +307,7 @@ func (db *DB) loop() {
 			//
 			// If we fail to remove an old KV WAL file, its data won't be re-processed during recovering since
 			// in the version WAL, we store a seq. Only KV WAL files with higher seq value would be re-processed.
-			_ = os.Remove(kvLogFile(prevMem.seq))
+			_ = db.cfg.FS.Remove(kvLogFile(db.cfg.Dir, prevMem.seq))
 			func() {
 				db.rwlock.Lock()
 				defer db.rwlock.Unlock()
@@ -214,67 +318,149 @@ func (db *DB) loop() {
 			if err != nil {
 				log.Panicf("Fail to compact: %v", err)
 			}
-			db.persisted <- struct{}{}
+			// Clear prevMem before signaling, otherwise we may clear the next full MemTable stored by postWrite.
 			db.prevMem.Store(nil)
+			db.persisted <- struct{}{}
 		}
 	}
 }
 
-func (db *DB) Put(key string, value []byte) error {
-	if err := func() error {
-		// Acquire read lock while putting data into db.mem.
-		// Since db.mem is thread-safe itself, callers can concurrently call Put/Remove.
-		db.rwlock.RLock()
-		defer db.rwlock.RUnlock()
-
-		return db.mem.put(key, value)
-	}(); err != nil {
-		return err
+// syncLoop syncs the WAL of the MemTable every WALSyncInterval, until the DB is closed.
+func (db *DB) syncLoop() {
+	defer db.wg.Done()
+
+	ticker := time.NewTicker(db.cfg.WALSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closing:
+			return
+		case <-ticker.C:
+			db.rwlock.RLock()
+			mem := db.mem
+			db.rwlock.RUnlock()
+
+			// The MemTable may be persisted in the meantime. Its WAL is closed and no longer needed then.
+			if err := mem.wal.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+				log.Printf("Fail to sync WAL: %v", err)
+			}
+		}
 	}
-	return db.postWrite()
 }
 
+// Put sets the value of the key. The write is synced (see WriteOptions.Sync).
+func (db *DB) Put(key string, value []byte) error {
+	b := &WriteBatch{}
+	b.Put(key, value)
+	return db.Write(b, WriteOptions{Sync: true})
+}
+
+// Remove deletes the key. The write is synced (see WriteOptions.Sync).
 func (db *DB) Remove(key string) error {
-	if err := func() error {
-		// Acquire read lock while removing data from db.mem.
-		// Since db.mem is thread-safe itself, callers can concurrently call Put/Remove.
-		db.rwlock.RLock()
-		defer db.rwlock.RUnlock()
-
-		return db.mem.remove(key)
-	}(); err != nil {
+	b := &WriteBatch{}
+	b.Delete(key)
+	return db.Write(b, WriteOptions{Sync: true})
+}
+
+// Write applies all writes in the batch atomically. Each write gets its own seq, and all of them become visible
+// to readers at the same time once the batch is applied.
+//
+// Concurrent writes are committed in groups (see writers), so that a group of writes only pays for one WAL
+// write and fsync.
+func (db *DB) Write(b *WriteBatch, opts WriteOptions) error {
+	if opts.Sync && opts.DisableWAL {
+		return errors.New("fail to write: can't sync a write with WAL disabled")
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	return db.enqueue(&writer{batch: b, opts: opts})
+}
+
+// Flush persists the MemTable to an SSTable, and waits until it's done. It's a no-op if the MemTable is empty.
+//
+// After Flush returns, all writes before it survive a crash, including those with WriteOptions.DisableWAL.
+func (db *DB) Flush() error {
+	return db.enqueue(&writer{flush: true})
+}
+
+// commit applies the batch to db.mem with new seqs, and makes it visible to readers once it's applied. The WAL is
+// synced if opts.Sync is true, or there are more than WALSyncBytes unsynced bytes.
+//
+// Only the leader of writers calls it. Since only the leader changes db.mem, it doesn't need rwlock to access it.
+func (db *DB) commit(b *WriteBatch, opts WriteOptions) error {
+	if !opts.DisableWAL && db.cfg.WALSyncBytes > 0 && db.mem.wal.Unsynced()+b.size() >= db.cfg.WALSyncBytes {
+		opts.Sync = true
+	}
+	seq := db.seqIter.NextSeqs(b.Len())
+	if err := db.mem.apply(seq, b, opts); err != nil {
 		return err
 	}
+	db.lastSeq.Store(int64(seq) + int64(b.Len()) - 1)
 	return db.postWrite()
 }
 
-// postWrite checks if the MemTable is full. If it is full, it would send a signal to the toPersist channel to
-// indicate that we need to persist the full MemTable stored in db.prevMem.
+// postWrite checks if the MemTable is full. If it is full, it would be switched to a new one.
 func (db *DB) postWrite() error {
 	if db.mem.isFull() {
-		<-db.persisted
-		db.prevMem.Store(db.mem)
-		db.toPersist <- struct{}{}
-
-		// Acquire write lock while doing the swap.
-		// We need to make sure that when we swap, no one can call Put/Remove
-		db.rwlock.Lock()
-		defer db.rwlock.Unlock()
-		mem, err := NewMemTable(db.seqIter.NextSeq(), db.cfg.MaxMemTableSize)
-		if err != nil {
-			return err
-		}
-		db.mem = mem
+		return db.switchMemTable()
 	}
 	return nil
 }
 
-// Get reads the value of the key.
+// switchMemTable sends a signal to the toPersist channel to indicate that we need to persist the current MemTable,
+// which is stored in db.prevMem. Then, a new MemTable is created for new writes.
+//
+// Only the leader of writers calls it.
+func (db *DB) switchMemTable() error {
+	// Sync the unsynced writes in the MemTable. Otherwise, if the machine crashes before it's persisted,
+	// they may be lost while later synced writes in the new MemTable are not.
+	if err := db.mem.wal.Sync(); err != nil {
+		return fmt.Errorf("fail to sync WAL: %w", err)
+	}
+	<-db.persisted
+	db.prevMem.Store(db.mem)
+	db.toPersist <- struct{}{}
+
+	// Acquire write lock while doing the swap.
+	// We need to make sure that when we swap, no one is reading db.mem.
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	mem, err := NewMemTable(db.cfg.FS, db.cfg.Dir, db.seqIter.NextSeq(), db.cfg.MaxMemTableSize)
+	if err != nil {
+		return err
+	}
+	db.mem = mem
+	return nil
+}
+
+// flush switches the MemTable if it's not empty, and waits until it's persisted.
+//
+// Only the leader of writers calls it.
+func (db *DB) flush() error {
+	if db.mem.isEmpty() {
+		return nil
+	}
+	if err := db.switchMemTable(); err != nil {
+		return err
+	}
+	// The loop sends a signal to persisted once it's done. Put it back, so that the next switch doesn't block.
+	<-db.persisted
+	db.persisted <- struct{}{}
+	return nil
+}
+
+// Get reads the latest value of the key.
+func (db *DB) Get(key string) ([]byte, bool, error) {
+	return db.GetWithOptions(key, ReadOptions{})
+}
+
+// GetWithOptions reads the value of the key with the given ReadOptions.
 //
 // It scans the MemTable first. If no value is found, we then check if prevMem is nil or not. If it is not
 // nil, we also need to scan it. If neither of them contains the key, we need to scan the SSTables from level-0
-// to the highest level in order.
-func (db *DB) Get(key string) ([]byte, bool, error) {
+// to the highest level in order. Versions newer than the read's seq are skipped.
+func (db *DB) GetWithOptions(key string, opts ReadOptions) ([]byte, bool, error) {
 	postFound := func(v value) ([]byte, bool, error) {
 		if v.deleted {
 			return nil, false, nil
@@ -286,14 +472,15 @@ func (db *DB) Get(key string) ([]byte, bool, error) {
 	db.rwlock.RLock()
 	defer db.rwlock.RUnlock()
 
-	if v, ok := db.mem.get(key); ok {
+	seq := db.readSeq(opts)
+	if v, ok := db.mem.get(key, seq); ok {
 		return postFound(v)
 	}
 
 	// If nothing is found in db.mem, we still need to lookup in db.prevMem, which
 	// is not persisted as an SSTable yet.
 	if prevMem := db.prevMem.Load(); prevMem != nil {
-		if v, ok := prevMem.get(key); ok {
+		if v, ok := prevMem.get(key, seq); ok {
 			return postFound(v)
 		}
 	}
@@ -301,7 +488,7 @@ func (db *DB) Get(key string) ([]byte, bool, error) {
 	for _, sts := range db.version.levels {
 		iter := sts.Iterator()
 		for iter.Next() {
-			v, ok, err := iter.Value().get(key)
+			v, ok, err := iter.Value().get(key, seq, opts.VerifyChecksums)
 			if err != nil {
 				return nil, false, err
 			}
@@ -314,41 +501,183 @@ func (db *DB) Get(key string) ([]byte, bool, error) {
 }
 
 type Config struct {
-	MaxMemTableSize    int
-	MaxSSTableSize     int
-	LevelSizeThreshold int
-	LevelSizeRatio     float64
-	Debug              bool
+	FS                   vfs.FS
+	Dir                  string
+	MaxMemTableSize      int
+	MaxSSTableSize       int
+	MaxManifestSize      int
+	BlockSize            int
+	BlockRestartInterval int
+	FilterBitsPerKey     int
+	Compression          Compressor
+	LevelCompression     map[int]Compressor
+	BlockCacheSize       int
+	MaxOpenFiles         int
+	LevelSizeThreshold   int
+	LevelSizeRatio       float64
+	WALSyncInterval      time.Duration
+	WALSyncBytes         int
+	WALRecoveryMode      WALRecoveryMode
+	Debug                bool
 }
 
 func defaultConfig() *Config {
 	const defaultMaxMemTableSize = 1 << 20 // 1MB
 	const defaultSSTableSize = 1 << 20     // 1MB
+	const defaultManifestSize = 4 << 20    // 4MB
+	const defaultBlockSize = 4 << 10       // 4KB
+	const defaultBlockRestartInterval = 16
+	const defaultFilterBitsPerKey = 10    // ~1% false positive rate
+	const defaultBlockCacheSize = 8 << 20 // 8MB
+	const defaultMaxOpenFiles = 1000
 	const defaultLevelSizeThreshold = 100
 	const defaultLevelSizeRatio = 1.4
 
 	return &Config{
-		MaxMemTableSize:    defaultMaxMemTableSize,
-		MaxSSTableSize:     defaultSSTableSize,
-		LevelSizeThreshold: defaultLevelSizeThreshold,
-		LevelSizeRatio:     defaultLevelSizeRatio,
+		FS:                   vfs.Default,
+		Dir:                  ".",
+		MaxMemTableSize:      defaultMaxMemTableSize,
+		MaxSSTableSize:       defaultSSTableSize,
+		MaxManifestSize:      defaultManifestSize,
+		BlockSize:            defaultBlockSize,
+		BlockRestartInterval: defaultBlockRestartInterval,
+		Compression:          NoCompression,
+		BlockCacheSize:       defaultBlockCacheSize,
+		MaxOpenFiles:         defaultMaxOpenFiles,
+		FilterBitsPerKey:     defaultFilterBitsPerKey,
+		LevelSizeThreshold:   defaultLevelSizeThreshold,
+		LevelSizeRatio:       defaultLevelSizeRatio,
 	}
 }
 
 type Option func(*Config)
 
+// WithFS sets the file system used by the DB. By default, the DB uses the file system of the operating system.
+func WithFS(fs vfs.FS) Option {
+	return func(c *Config) {
+		c.FS = fs
+	}
+}
+
+// WithDir sets the directory where all files of the DB are stored. The directory is created if it doesn't exist.
+//
+// By default, the DB uses the current working directory.
+func WithDir(dir string) Option {
+	return func(c *Config) {
+		c.Dir = dir
+	}
+}
+
 func WithMaxMemTableSize(size int) Option {
 	return func(c *Config) {
 		c.MaxMemTableSize = size
 	}
 }
 
+// WithWALSyncInterval makes a background goroutine sync the WAL every interval, so that writes without
+// WriteOptions.Sync are lost only if the machine crashes within the interval. It's disabled by default.
+func WithWALSyncInterval(interval time.Duration) Option {
+	return func(c *Config) {
+		c.WALSyncInterval = interval
+	}
+}
+
+// WithWALSyncBytes makes a write sync the WAL once there are at least n unsynced bytes in the WAL, including
+// the write itself. It bounds the data lost by a crash of the machine for writes without WriteOptions.Sync.
+// It's disabled by default.
+func WithWALSyncBytes(n int) Option {
+	return func(c *Config) {
+		c.WALSyncBytes = n
+	}
+}
+
+// WithWALRecoveryMode sets how damaged records in the WAL files are handled when the DB is opened. By default,
+// it's TolerateCorruptedTail. See DB.RecoveryReport for what's dropped.
+func WithWALRecoveryMode(mode WALRecoveryMode) Option {
+	return func(c *Config) {
+		c.WALRecoveryMode = mode
+	}
+}
+
 func WithMaxSSTableSize(size int) Option {
 	return func(c *Config) {
 		c.MaxSSTableSize = size
 	}
 }
 
+// WithMaxManifestSize sets the size of the manifest file, which logs the changes of SSTables, beyond which a new
+// manifest file is started with a snapshot of the SSTables. Smaller manifest files are faster to replay when the DB
+// is opened, but they are replaced more often.
+func WithMaxManifestSize(size int) Option {
+	return func(c *Config) {
+		c.MaxManifestSize = size
+	}
+}
+
+// WithBlockSize sets the size of data blocks in SSTables. A point lookup reads a single data block from an
+// SSTable, so smaller blocks mean less I/O per lookup, but larger index blocks.
+func WithBlockSize(size int) Option {
+	return func(c *Config) {
+		c.BlockSize = size
+	}
+}
+
+// WithBlockRestartInterval sets the number of keys between restart points in data blocks. Keys are prefix
+// compressed against the previous key except at restart points, and a seek in a block binary searches the restart
+// points before scanning forward. A larger interval makes blocks smaller, but seeks slower.
+func WithBlockRestartInterval(n int) Option {
+	return func(c *Config) {
+		c.BlockRestartInterval = n
+	}
+}
+
+// WithFilterBitsPerKey sets the number of bits for each key in the bloom filters of SSTables. More bits mean
+// fewer false positives, so fewer lookups of missing keys read data blocks. Filters are disabled if it's 0.
+func WithFilterBitsPerKey(bits int) Option {
+	return func(c *Config) {
+		c.FilterBitsPerKey = bits
+	}
+}
+
+// WithBlockCache sets the capacity in bytes of the cache of SSTable data blocks read by point lookups. The cache
+// is disabled if it's 0.
+func WithBlockCache(capacity int) Option {
+	return func(c *Config) {
+		c.BlockCacheSize = capacity
+	}
+}
+
+// WithMaxOpenFiles sets the maximum number of SSTables kept open, with their index blocks and filters loaded, so
+// that reads don't open and parse the files again. The least recently used SSTables are closed first. SSTables are
+// opened for every read if it's 0.
+func WithMaxOpenFiles(n int) Option {
+	return func(c *Config) {
+		c.MaxOpenFiles = n
+	}
+}
+
+// WithCompression sets the compressor of SSTable blocks. By default, blocks are not compressed.
+//
+// Blocks record the compressor writing them, so SSTables written with other built-in compressors, or with the
+// compressors set by WithCompression and WithLevelCompression, can always be read.
+func WithCompression(compressor Compressor) Option {
+	return func(c *Config) {
+		c.Compression = compressor
+	}
+}
+
+// WithLevelCompression sets the compressor of SSTable blocks on the level, overriding WithCompression. For
+// example, SSTables on level 0 are short-lived, and may be better not compressed, while the last level holds most
+// of the data, and may be compressed strongly.
+func WithLevelCompression(level int, compressor Compressor) Option {
+	return func(c *Config) {
+		if c.LevelCompression == nil {
+			c.LevelCompression = make(map[int]Compressor)
+		}
+		c.LevelCompression[level] = compressor
+	}
+}
+
 func WithCompactionConfig(levelSizeThreshold int, levelSizeRatio float64) Option {
 	return func(c *Config) {
 		c.LevelSizeThreshold = levelSizeThreshold
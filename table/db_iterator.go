@@ -0,0 +1,274 @@
+package table
+
+// Iterator iterates over the KVs in a DB in key order, forward or backward. Deleted keys are skipped.
+//
+// An Iterator sees the DB as it was when the iterator was created, or as of the snapshot in ReadOptions. Writes
+// after that are not visible. It must be closed after use, so that the SSTables it reads can be removed once
+// they are compacted.
+//
+// A newly created iterator is not positioned. First, Last, Seek or SeekForPrev must be called before reading
+// KVs.
+type Iterator struct {
+	iter   *mergingIterator
+	tables []*sstable
+
+	// The iterator only visits keys in the range [lower, upper). An empty upper means there is no upper bound.
+	lower string
+	upper string
+	// Only versions with seq <= seq are visible.
+	seq Seq
+
+	// When moving forward, iter is positioned at the newest kv of the current key.
+	// When moving backward, iter is positioned at the last kv before the current key. Since iter has already
+	// moved past it, the current kv is saved in cur.
+	dir   direction
+	cur   kv
+	valid bool
+}
+
+// NewIterator creates an iterator over the DB.
+//
+// It merges the MemTable, the full MemTable being persisted (if there is one) and the SSTables on all levels.
+// Sources are ordered from the newest to the oldest, so that the newest value of a key shadows the older ones:
+//   - MemTable
+//   - prevMem
+//   - level-0 SSTables, from the highest Gen to the lowest
+//   - level-1 SSTables, level-2 SSTables ...
+func (db *DB) NewIterator() *Iterator {
+	return db.NewIteratorWithOptions(ReadOptions{})
+}
+
+// NewIteratorWithOptions creates an iterator over the DB with the given ReadOptions.
+func (db *DB) NewIteratorWithOptions(opts ReadOptions) *Iterator {
+	return db.newIterator("", "", opts)
+}
+
+// newIterator creates an iterator visiting keys in the range [lower, upper) only. An empty upper means there
+// is no upper bound. SSTables not overlapping the range are skipped.
+func (db *DB) newIterator(lower, upper string, opts ReadOptions) *Iterator {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	// The MemTables are iterated in place. Writes after the iterator is created are skipped by seq.
+	children := []internalIterator{newMemTableIterator(db.mem)}
+	if prevMem := db.prevMem.Load(); prevMem != nil {
+		children = append(children, newMemTableIterator(prevMem))
+	}
+
+	var tables []*sstable
+	for level, sts := range db.version.levels {
+		// The tables on level 0 are ordered by Gen, from the highest to the lowest.
+		var values []*sstable
+		iter := sts.Iterator()
+		for iter.Next() {
+			if st := iter.Value(); st.scope.overlapsRange(lower, upper) {
+				st.ref()
+				values = append(values, st)
+			}
+		}
+		tables = append(tables, values...)
+
+		if level == 0 {
+			// Tables on level 0 have overlaps. Each of them is a separate source.
+			for _, st := range values {
+				children = append(children, newTableIterator(st, opts.VerifyChecksums))
+			}
+		} else if len(values) > 0 {
+			children = append(children, newLevelIterator(values, opts.VerifyChecksums))
+		}
+	}
+	return &Iterator{
+		iter:   newMergingIterator(children...),
+		tables: tables,
+		lower:  lower,
+		upper:  upper,
+		seq:    db.readSeq(opts),
+	}
+}
+
+// Scan calls fn for every key in the range [start, end) in key order, until fn returns false. An empty end
+// means the range has no upper bound.
+func (db *DB) Scan(start, end string, fn func(key string, value []byte) bool) error {
+	iter := db.newIterator(start, end, ReadOptions{})
+	for iter.First(); iter.Valid(); iter.Next() {
+		if !fn(iter.Key(), iter.Value()) {
+			break
+		}
+	}
+	return iter.Close()
+}
+
+// ScanPrefix calls fn for every key with the given prefix in key order, until fn returns false.
+func (db *DB) ScanPrefix(prefix string, fn func(key string, value []byte) bool) error {
+	return db.Scan(prefix, prefixEnd(prefix), fn)
+}
+
+// prefixEnd returns the smallest key greater than all keys with the given prefix. If there is no such key
+// (e.g. the prefix is empty or only has 0xff bytes), an empty string is returned, meaning no upper bound.
+func prefixEnd(prefix string) string {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			return prefix[:i] + string([]byte{prefix[i] + 1})
+		}
+	}
+	return ""
+}
+
+// First moves to the first key in the DB.
+func (it *Iterator) First() {
+	if it.lower != "" {
+		it.iter.Seek(it.lower)
+	} else {
+		it.iter.First()
+	}
+	it.findNext()
+}
+
+// Last moves to the last key in the DB.
+func (it *Iterator) Last() {
+	if it.upper != "" {
+		it.iter.SeekForPrev(it.upper)
+	} else {
+		it.iter.Last()
+	}
+	it.findPrev()
+}
+
+// Seek moves to the first key that is greater than or equal to the given key.
+func (it *Iterator) Seek(key string) {
+	it.iter.Seek(max(key, it.lower))
+	it.findNext()
+}
+
+// SeekForPrev moves to the last key that is less than or equal to the given key.
+func (it *Iterator) SeekForPrev(key string) {
+	if it.upper != "" {
+		key = min(key, it.upper)
+	}
+	it.iter.SeekForPrev(key)
+	it.findPrev()
+}
+
+// Next moves to the next key. It must be called only when the iterator is valid.
+func (it *Iterator) Next() {
+	key := it.cur.key.data
+	if it.dir == backward {
+		// iter is positioned before the current key. Move it to the newest kv of the current key.
+		it.iter.Seek(key)
+	}
+	// Skip older values of the current key from other sources.
+	for it.iter.Valid() && it.iter.kv().key.data == key {
+		it.iter.Next()
+	}
+	it.findNext()
+}
+
+// Prev moves to the previous key. It must be called only when the iterator is valid.
+func (it *Iterator) Prev() {
+	if it.dir == forward {
+		// iter is positioned at the newest kv of the current key. Move it to the last kv before the current key.
+		key := it.cur.key.data
+		it.iter.SeekForPrev(key)
+		for it.iter.Valid() && it.iter.kv().key.data == key {
+			it.iter.Prev()
+		}
+	}
+	it.findPrev()
+}
+
+// Valid returns whether the iterator is positioned at a key.
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Key returns the current key. It must be called only when the iterator is valid.
+func (it *Iterator) Key() string {
+	return it.cur.key.data
+}
+
+// Value returns the value of the current key. It must be called only when the iterator is valid.
+func (it *Iterator) Value() []byte {
+	return it.cur.value.data
+}
+
+// Err returns the error the iterator hit, if any. Once there is an error, the iterator is no longer valid.
+func (it *Iterator) Err() error {
+	return it.iter.Err()
+}
+
+// Close releases the SSTables read by the iterator. The iterator can't be used after it is closed.
+func (it *Iterator) Close() error {
+	_ = it.iter.Close()
+	for _, st := range it.tables {
+		st.unref()
+	}
+	it.tables = nil
+	return it.Err()
+}
+
+// findNext moves forward to the first key that is not deleted, starting from the current position of iter.
+//
+// The merging iterator visits the newest value of a key first when moving forward. Values newer than seq are
+// skipped. If the first visible value is deleted, the key is deleted, and older values of the key must be
+// skipped too.
+func (it *Iterator) findNext() {
+	it.dir = forward
+	it.valid = false
+	for it.iter.Valid() {
+		cur := it.iter.kv()
+		if it.upper != "" && cur.key.data >= it.upper {
+			return
+		}
+		if cur.key.seq > it.seq {
+			it.iter.Next()
+			continue
+		}
+		if !cur.value.deleted {
+			it.cur = *cur
+			it.valid = true
+			return
+		}
+		key := cur.key.data
+		for it.iter.Valid() && it.iter.kv().key.data == key {
+			it.iter.Next()
+		}
+	}
+}
+
+// findPrev moves backward to the last key that is not deleted, starting from the current position of iter.
+//
+// The merging iterator visits the newest value of a key last when moving backward. We need to go through all
+// values of a key to find the newest one visible at seq. After that, iter is positioned before the key.
+func (it *Iterator) findPrev() {
+	it.dir = backward
+	it.valid = false
+	for it.iter.Valid() {
+		key := it.iter.kv().key.data
+		if key < it.lower {
+			return
+		}
+		var (
+			newest  kv
+			visible bool
+		)
+		for it.iter.Valid() && it.iter.kv().key.data == key {
+			if cur := it.iter.kv(); cur.key.seq <= it.seq {
+				newest = *cur
+				visible = true
+			}
+			it.iter.Prev()
+		}
+		if it.iter.Err() != nil {
+			return
+		}
+		// SeekForPrev may stop at the upper bound, which is not in the range.
+		if it.upper != "" && key >= it.upper {
+			continue
+		}
+		if visible && !newest.value.deleted {
+			it.cur = newest
+			it.valid = true
+			return
+		}
+	}
+}
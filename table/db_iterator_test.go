@@ -0,0 +1,438 @@
+package table
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/liznear/leveldb-from-scratch/vfs"
+)
+
+func TestDBIterator(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := NewDB(
+		WithFS(fs),
+		WithMaxMemTableSize(50),
+		WithMaxSSTableSize(50),
+		WithCompactionConfig(2, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Spread KVs among the MemTable and SSTables on different levels. Overwrite even keys, and remove every
+	// third key, so that newer values need to shadow older ones.
+	c := 50
+	want := make(map[string]string)
+	for i := 0; i < c; i++ {
+		k := fmt.Sprintf("Key%02d", i)
+		if err := db.Put(k, []byte(fmt.Sprintf("Value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+		want[k] = fmt.Sprintf("Value%d", i)
+	}
+	for i := 0; i < c; i += 2 {
+		k := fmt.Sprintf("Key%02d", i)
+		if err := db.Put(k, []byte(fmt.Sprintf("NewValue%d", i))); err != nil {
+			t.Fatal(err)
+		}
+		want[k] = fmt.Sprintf("NewValue%d", i)
+	}
+	for i := 0; i < c; i += 3 {
+		k := fmt.Sprintf("Key%02d", i)
+		if err := db.Remove(k); err != nil {
+			t.Fatal(err)
+		}
+		delete(want, k)
+	}
+	db.waitPersist()
+
+	iter := db.NewIterator()
+	defer iter.Close()
+
+	var prev string
+	n := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		k := iter.Key()
+		if n > 0 && k <= prev {
+			t.Errorf("Got key %q after %q", k, prev)
+		}
+		prev = k
+		n++
+
+		v, ok := want[k]
+		if !ok {
+			t.Errorf("Got unexpected key %q", k)
+		} else if string(iter.Value()) != v {
+			t.Errorf("Got %s=%q, want %q", k, iter.Value(), v)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(want) {
+		t.Errorf("Got %d keys, want %d", n, len(want))
+	}
+
+	tcs := []struct {
+		seek string
+		want string
+	}{
+		{seek: "", want: "Key01"},
+		{seek: "Key03", want: "Key04"},
+		{seek: "Key10", want: "Key10"},
+		{seek: "Key485", want: "Key49"},
+		{seek: "Key5", want: ""},
+	}
+	for _, tc := range tcs {
+		iter.Seek(tc.seek)
+		if tc.want == "" {
+			if iter.Valid() {
+				t.Errorf("Got %q after seeking %q, want invalid", iter.Key(), tc.seek)
+			}
+			continue
+		}
+		if !iter.Valid() {
+			t.Errorf("Got invalid iterator after seeking %q, want %q", tc.seek, tc.want)
+		} else if iter.Key() != tc.want {
+			t.Errorf("Got %q after seeking %q, want %q", iter.Key(), tc.seek, tc.want)
+		}
+	}
+}
+
+func TestDBIterator_Reverse(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := NewDB(
+		WithFS(fs),
+		WithMaxMemTableSize(100),
+		WithMaxSSTableSize(100),
+		WithCompactionConfig(2, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Randomly put and remove keys, and keep the expected state in a map.
+	r := rand.New(rand.NewSource(1))
+	want := make(map[string]string)
+	for i := 0; i < 500; i++ {
+		k := fmt.Sprintf("Key%02d", r.Intn(60))
+		if r.Intn(4) == 0 {
+			if err := db.Remove(k); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, k)
+			continue
+		}
+		v := fmt.Sprintf("Value%d", i)
+		if err := db.Put(k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		want[k] = v
+	}
+	db.waitPersist()
+
+	var keys []string
+	for k := range want {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	iter := db.NewIterator()
+	defer iter.Close()
+
+	// Walk backward from the last key.
+	i := len(keys) - 1
+	for iter.Last(); iter.Valid(); iter.Prev() {
+		if i < 0 {
+			t.Fatalf("Got extra key %q", iter.Key())
+		}
+		if iter.Key() != keys[i] || string(iter.Value()) != want[keys[i]] {
+			t.Errorf("Got %s=%q, want %s=%q", iter.Key(), iter.Value(), keys[i], want[keys[i]])
+		}
+		i--
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != -1 {
+		t.Errorf("Missing %d keys", i+1)
+	}
+
+	// Randomly seek and move in both directions.
+	for n := 0; n < 200; n++ {
+		target := fmt.Sprintf("Key%02d", r.Intn(62))
+		var pos int
+		if r.Intn(2) == 0 {
+			iter.Seek(target)
+			pos = sort.SearchStrings(keys, target)
+		} else {
+			iter.SeekForPrev(target)
+			pos = sort.Search(len(keys), func(i int) bool { return keys[i] > target }) - 1
+		}
+		for step := 0; step < 5; step++ {
+			if pos < 0 || pos >= len(keys) {
+				if iter.Valid() {
+					t.Fatalf("Got %q, want invalid iterator", iter.Key())
+				}
+				break
+			}
+			if !iter.Valid() {
+				t.Fatalf("Got invalid iterator, want %q", keys[pos])
+			}
+			if iter.Key() != keys[pos] || string(iter.Value()) != want[keys[pos]] {
+				t.Fatalf("Got %s=%q, want %s=%q", iter.Key(), iter.Value(), keys[pos], want[keys[pos]])
+			}
+			if r.Intn(2) == 0 {
+				iter.Next()
+				pos++
+			} else {
+				iter.Prev()
+				pos--
+			}
+		}
+	}
+}
+
+func TestDBIterator_Snapshot(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := NewDB(
+		WithFS(fs),
+		WithMaxMemTableSize(20),
+		WithMaxSSTableSize(20),
+		WithCompactionConfig(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	c := 20
+	for i := 0; i < c; i++ {
+		if err := db.Put(fmt.Sprintf("Key%02d", i), []byte(fmt.Sprintf("Value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.waitPersist()
+
+	iter := db.NewIterator()
+	defer iter.Close()
+
+	// Writes after creating the iterator trigger compactions, which remove the SSTables the iterator reads.
+	for i := 0; i < c; i++ {
+		if err := db.Put(fmt.Sprintf("Key%02d", i), []byte(fmt.Sprintf("NewValue%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.waitPersist()
+
+	i := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		if want := fmt.Sprintf("Key%02d", i); iter.Key() != want {
+			t.Errorf("Got key %q, want %q", iter.Key(), want)
+		}
+		if want := fmt.Sprintf("Value%d", i); string(iter.Value()) != want {
+			t.Errorf("Got value %q, want %q", iter.Value(), want)
+		}
+		i++
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != c {
+		t.Errorf("Got %d keys, want %d", i, c)
+	}
+}
+
+func TestDB_Scan(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := NewDB(
+		WithFS(fs),
+		WithMaxMemTableSize(100),
+		WithMaxSSTableSize(100),
+		WithCompactionConfig(2, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, tenant := range []string{"a", "b", "c"} {
+		for i := 0; i < 10; i++ {
+			k := fmt.Sprintf("%s/%d", tenant, i)
+			if err := db.Put(k, []byte("Value-"+k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Remove("b/5"); err != nil {
+		t.Fatal(err)
+	}
+	db.waitPersist()
+
+	scan := func(f func(fn func(string, []byte) bool) error, limit int) []string {
+		t.Helper()
+		var got []string
+		if err := f(func(k string, v []byte) bool {
+			if string(v) != "Value-"+k {
+				t.Errorf("Got %s=%q, want %q", k, v, "Value-"+k)
+			}
+			got = append(got, k)
+			return len(got) < limit
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	keys := func(tenant string, from, to int) []string {
+		var ret []string
+		for i := from; i < to; i++ {
+			if k := fmt.Sprintf("%s/%d", tenant, i); k != "b/5" {
+				ret = append(ret, k)
+			}
+		}
+		return ret
+	}
+
+	tcs := []struct {
+		name  string
+		scan  func(fn func(string, []byte) bool) error
+		limit int
+		want  []string
+	}{
+		{
+			name: "Range",
+			scan: func(fn func(string, []byte) bool) error {
+				return db.Scan("a/3", "a/7", fn)
+			},
+			want: keys("a", 3, 7),
+		},
+		{
+			name: "AcrossPrefixes",
+			scan: func(fn func(string, []byte) bool) error {
+				return db.Scan("a/8", "b/2", fn)
+			},
+			want: append(keys("a", 8, 10), keys("b", 0, 2)...),
+		},
+		{
+			name: "NoUpperBound",
+			scan: func(fn func(string, []byte) bool) error {
+				return db.Scan("c/7", "", fn)
+			},
+			want: keys("c", 7, 10),
+		},
+		{
+			name: "Empty",
+			scan: func(fn func(string, []byte) bool) error {
+				return db.Scan("b", "b/", fn)
+			},
+		},
+		{
+			name: "Prefix",
+			scan: func(fn func(string, []byte) bool) error {
+				return db.ScanPrefix("b/", fn)
+			},
+			want: keys("b", 0, 10),
+		},
+		{
+			name: "StopEarly",
+			scan: func(fn func(string, []byte) bool) error {
+				return db.ScanPrefix("c/", fn)
+			},
+			limit: 2,
+			want:  keys("c", 0, 2),
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			limit := tc.limit
+			if limit == 0 {
+				limit = 100
+			}
+			got := scan(tc.scan, limit)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDBIterator_Bounds(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := NewDB(
+		WithFS(fs),
+		WithMaxMemTableSize(40),
+		WithMaxSSTableSize(40),
+		WithCompactionConfig(100, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("Key%d", i), []byte(fmt.Sprintf("Value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.waitPersist()
+
+	iter := db.newIterator("Key3", "Key6", ReadOptions{})
+	defer iter.Close()
+
+	// Only SSTables overlapping the range are read.
+	for _, st := range iter.tables {
+		if !st.scope.overlapsRange("Key3", "Key6") {
+			t.Errorf("Got SSTable %d with scope %s, which doesn't overlap the range", st.gen, st.scope)
+		}
+	}
+	if total := db.version.levels[0].Size(); len(iter.tables) >= total {
+		t.Errorf("Got %d SSTables, want fewer than %d", len(iter.tables), total)
+	}
+
+	verifyKeys := func(name string, want ...string) {
+		t.Helper()
+		if len(want) == 0 {
+			if iter.Valid() {
+				t.Errorf("%s: got %q, want invalid", name, iter.Key())
+			}
+			return
+		}
+		if !iter.Valid() {
+			t.Errorf("%s: got invalid iterator, want %q", name, want[0])
+		} else if iter.Key() != want[0] {
+			t.Errorf("%s: got %q, want %q", name, iter.Key(), want[0])
+		}
+	}
+	iter.First()
+	verifyKeys("First", "Key3")
+	iter.Last()
+	verifyKeys("Last", "Key5")
+	iter.Next()
+	verifyKeys("Next of last")
+	iter.Seek("Key0")
+	verifyKeys("Seek before lower bound", "Key3")
+	iter.Prev()
+	verifyKeys("Prev of first")
+	iter.SeekForPrev("Key9")
+	verifyKeys("SeekForPrev after upper bound", "Key5")
+	iter.SeekForPrev("Key6")
+	verifyKeys("SeekForPrev upper bound", "Key5")
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tcs := []struct {
+		prefix string
+		want   string
+	}{
+		{prefix: "", want: ""},
+		{prefix: "a", want: "b"},
+		{prefix: "a/", want: "a0"},
+		{prefix: "a\xff", want: "b"},
+		{prefix: "\xff\xff", want: ""},
+	}
+	for _, tc := range tcs {
+		if got := prefixEnd(tc.prefix); got != tc.want {
+			t.Errorf("prefixEnd(%q): got %q, want %q", tc.prefix, got, tc.want)
+		}
+	}
+}
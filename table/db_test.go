@@ -1,24 +1,22 @@
 package table
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
-	"strings"
 	"testing"
 	"time"
+
+	"github.com/liznear/leveldb-from-scratch/utils"
+	"github.com/liznear/leveldb-from-scratch/vfs"
 )
 
 func TestDB_Put(t *testing.T) {
-	defer EnterTempDir(t)()
+	fs := vfs.NewMem()
 
-	cwd, err := os.Getwd()
-	if err != nil {
-		t.Fatalf("Fail to get current working dir: %v", err)
-	}
-
-	db, err := NewDB(WithMaxMemTableSize(30))
+	db, err := NewDB(WithFS(fs), WithMaxMemTableSize(30))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -28,25 +26,25 @@ func TestDB_Put(t *testing.T) {
 		t.Fatal(err)
 	}
 	db.waitPersist()
-	verifyFiles(t, cwd, sstableExtension, nil)
+	verifyFiles(t, fs, ".", sstableExtension, nil)
 
 	if err := db.Put("Key2", []byte("Value2")); err != nil {
 		t.Fatal(err)
 	}
 	db.waitPersist()
-	verifyFiles(t, cwd, sstableExtension, []string{"1" + sstableExtension})
+	verifyFiles(t, fs, ".", sstableExtension, []string{"1" + sstableExtension})
 
 	if err := db.Put("Key3", []byte("Value3")); err != nil {
 		t.Fatal(err)
 	}
 	db.waitPersist()
-	verifyFiles(t, cwd, sstableExtension, []string{"1" + sstableExtension})
+	verifyFiles(t, fs, ".", sstableExtension, []string{"1" + sstableExtension})
 }
 
 func TestDB_Get(t *testing.T) {
-	defer EnterTempDir(t)()
+	fs := vfs.NewMem()
 
-	db, err := NewDB(WithMaxMemTableSize(30))
+	db, err := NewDB(WithFS(fs), WithMaxMemTableSize(30))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -70,9 +68,10 @@ func TestDB_Get(t *testing.T) {
 }
 
 func TestDB_Overwrite(t *testing.T) {
-	defer EnterTempDir(t)()
+	fs := vfs.NewMem()
 
 	db, err := NewDB(
+		WithFS(fs),
 		WithMaxMemTableSize(20),
 		WithMaxSSTableSize(20),
 		WithCompactionConfig(1, 1))
@@ -110,9 +109,9 @@ func TestDB_Overwrite(t *testing.T) {
 }
 
 func TestDB_Delete(t *testing.T) {
-	defer EnterTempDir(t)()
+	fs := vfs.NewMem()
 
-	db, err := NewDB(WithMaxMemTableSize(30))
+	db, err := NewDB(WithFS(fs), WithMaxMemTableSize(30))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -145,8 +144,110 @@ func TestDB_Delete(t *testing.T) {
 	}
 }
 
+func TestDB_Write(t *testing.T) {
+	fs := vfs.NewMem()
+
+	db, err := NewDB(WithFS(fs), WithMaxMemTableSize(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := utils.Run(
+		utils.ToRunnable2(db.Put, "Key1", []byte("Value1")),
+		utils.ToRunnable2(db.Put, "Key2", []byte("Value2")),
+	); err != nil {
+		t.Fatal(err)
+	}
+	s := db.GetSnapshot()
+	defer db.ReleaseSnapshot(s)
+
+	b := &WriteBatch{}
+	b.Put("Key1", []byte("NewValue1"))
+	b.Delete("Key2")
+	b.Put("Key3", []byte("Value3"))
+	b.Put("Key3", []byte("NewValue3"))
+	if err := db.Write(b, WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Write(b, WriteOptions{Sync: true, DisableWAL: true}); err == nil {
+		t.Errorf("Got no error for a sync write with WAL disabled")
+	}
+	// Writing an empty batch is a no-op.
+	if err := db.Write(&WriteBatch{}, WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		name string
+		opts ReadOptions
+		want map[string]string
+	}{
+		{
+			name: "Latest",
+			want: map[string]string{"Key1": "NewValue1", "Key3": "NewValue3"},
+		},
+		{
+			name: "BeforeBatch",
+			opts: ReadOptions{Snapshot: s},
+			want: map[string]string{"Key1": "Value1", "Key2": "Value2"},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, k := range []string{"Key1", "Key2", "Key3"} {
+				got, ok, err := db.GetWithOptions(k, tc.opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want, wantOk := tc.want[k]
+				if ok != wantOk {
+					t.Errorf("Got found %v for %s, want %v", ok, k, wantOk)
+				} else if ok && string(got) != want {
+					t.Errorf("Got %s=%q, want %q", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDB_Flush(t *testing.T) {
+	fs := vfs.NewMem()
+
+	db, err := NewDB(WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Flushing an empty MemTable is a no-op.
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	verifyFiles(t, fs, ".", sstableExtension, nil)
+
+	if err := db.Put("Key1", []byte("Value1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	verifyFiles(t, fs, ".", sstableExtension, []string{"1" + sstableExtension})
+	if !db.mem.isEmpty() {
+		t.Errorf("Got non-empty MemTable after flush")
+	}
+
+	got, ok, err := db.Get("Key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || string(got) != "Value1" {
+		t.Errorf("Got %q, %v, want Value1", got, ok)
+	}
+}
+
 func TestDB_Recover(t *testing.T) {
-	defer EnterTempDir(t)()
+	fs := vfs.NewMem()
 
 	c := 100
 
@@ -154,6 +255,7 @@ func TestDB_Recover(t *testing.T) {
 	func() {
 		t.Helper()
 		db, err := NewDB(
+			WithFS(fs),
 			WithMaxMemTableSize(20),
 			WithMaxSSTableSize(20),
 			WithCompactionConfig(1, 1))
@@ -173,6 +275,7 @@ func TestDB_Recover(t *testing.T) {
 	func() {
 		t.Helper()
 		db, err := NewDB(
+			WithFS(fs),
 			WithMaxMemTableSize(20),
 			WithMaxSSTableSize(20),
 			WithCompactionConfig(1, 1))
@@ -201,6 +304,7 @@ func TestDB_Recover(t *testing.T) {
 	func() {
 		t.Helper()
 		db, err := NewDB(
+			WithFS(fs),
 			WithMaxMemTableSize(20),
 			WithMaxSSTableSize(20),
 			WithCompactionConfig(1, 1))
@@ -229,6 +333,7 @@ func TestDB_Recover(t *testing.T) {
 	func() {
 		t.Helper()
 		db, err := NewDB(
+			WithFS(fs),
 			WithMaxMemTableSize(20),
 			WithMaxSSTableSize(20),
 			WithCompactionConfig(1, 1))
@@ -249,25 +354,171 @@ func TestDB_Recover(t *testing.T) {
 	}()
 }
 
-func verifyFiles(t *testing.T, cwd string, ext string, want []string) {
-	t.Helper()
+func TestDB_RecoverSeq(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := NewDB(WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("Key%d", i), []byte(fmt.Sprintf("Value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	lastSeq, nextGen := db.seqIter.Last(), db.genIter.Peek()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
 
-	dir, err := os.Open(cwd)
+	// Without the WAL files, only the version log tells which seqs and gens are used.
+	wals, err := fs.Glob("*" + walExtension)
 	if err != nil {
-		t.Fatalf("Fail to open cwd: %v", err)
+		t.Fatal(err)
+	}
+	for _, f := range wals {
+		if err := fs.Remove(f); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	fs, err := dir.Readdir(0)
+	db, err = NewDB(WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.mem.seq <= lastSeq {
+		t.Errorf("Got MemTable seq %d, want greater than %d", db.mem.seq, lastSeq)
+	}
+	if gen := db.genIter.Peek(); gen < nextGen {
+		t.Errorf("Got next gen %d, want at least %d", gen, nextGen)
+	}
+}
+
+func TestDB_WithDir(t *testing.T) {
+	fs := vfs.NewMem()
+	dirs := []string{
+		"db1",
+		filepath.Join("nested", "db2"),
+	}
+
+	c := 10
+	open := func() []*DB {
+		t.Helper()
+		var dbs []*DB
+		for _, dir := range dirs {
+			db, err := NewDB(WithFS(fs), WithDir(dir), WithMaxMemTableSize(30))
+			if err != nil {
+				t.Fatal(err)
+			}
+			dbs = append(dbs, db)
+		}
+		return dbs
+	}
+
+	// Two DBs live in the same process. Each writes the same keys with different values.
+	dbs := open()
+	for i, db := range dbs {
+		for j := 0; j < c; j++ {
+			if err := db.Put(fmt.Sprintf("Key%d", j), []byte(fmt.Sprintf("DB%d-Value%d", i, j))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.waitPersist()
+	}
+	for _, db := range dbs {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing should be written into the current working directory.
+	for _, ext := range []string{walExtension, sstableExtension} {
+		matches, err := fs.Glob("*" + ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) > 0 {
+			t.Errorf("Got files %v in working dir, want none", matches)
+		}
+	}
+
+	// Reopen both DBs, and make sure they don't see each other's data.
+	dbs = open()
+	for i, db := range dbs {
+		defer db.Close()
+		for j := 0; j < c; j++ {
+			v, ok, err := db.Get(fmt.Sprintf("Key%d", j))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := fmt.Sprintf("DB%d-Value%d", i, j)
+			if !ok {
+				t.Errorf("DB%d: Key%d not found", i, j)
+			} else if string(v) != want {
+				t.Errorf("DB%d: got %q, want %q", i, v, want)
+			}
+		}
+	}
+}
+
+func TestDB_Lock(t *testing.T) {
+	tcs := []struct {
+		name string
+		fs   vfs.FS
+		dir  string
+	}{
+		{
+			name: "OS",
+			fs:   vfs.Default,
+			dir:  t.TempDir(),
+		},
+		{
+			name: "Mem",
+			fs:   vfs.NewMem(),
+			dir:  "db",
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			db, err := NewDB(WithFS(tc.fs), WithDir(tc.dir))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The directory is being used. It can't be opened again.
+			if _, err := NewDB(WithFS(tc.fs), WithDir(tc.dir)); !errors.Is(err, ErrLocked) {
+				t.Fatalf("Got error %v, want %v", err, ErrLocked)
+			}
+
+			// After closing the DB, the lock is released.
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			db, err = NewDB(WithFS(tc.fs), WithDir(tc.dir))
+			if err != nil {
+				t.Fatalf("Fail to reopen DB after closing: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func verifyFiles(t *testing.T, fs vfs.FS, dir string, ext string, want []string) {
+	t.Helper()
+
+	files, err := fs.Glob(filepath.Join(dir, "*"+ext))
 	if err != nil {
 		t.Fatalf("Fail to list dir: %v", err)
 	}
 
 	var got []string
-	for _, f := range fs {
-		if !strings.HasSuffix(f.Name(), ext) {
-			continue
-		}
-		got = append(got, f.Name())
+	for _, f := range files {
+		got = append(got, filepath.Base(f))
 	}
 	if len(got) != len(want) {
 		t.Errorf("Got %d files, want %d", len(got), len(want))
@@ -287,3 +538,97 @@ func (db *DB) waitPersist() {
 		time.Sleep(1 * time.Second)
 	}
 }
+
+func TestDB_FilterStats(t *testing.T) {
+	tcs := []struct {
+		name       string
+		bitsPerKey int
+		wantMisses bool
+	}{
+		{name: "Enabled", bitsPerKey: 10, wantMisses: true},
+		{name: "Disabled", bitsPerKey: 0, wantMisses: false},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			db, err := NewDB(WithFS(vfs.NewMem()), WithFilterBitsPerKey(tc.bitsPerKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			// Even keys exist. Key100 makes all looked up keys in the scope of the SSTable.
+			const c = 100
+			for i := 0; i <= c; i += 2 {
+				if err := db.Put(fmt.Sprintf("Key%03d", i), []byte("Value")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < c; i++ {
+				_, ok, err := db.Get(fmt.Sprintf("Key%03d", i))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := i%2 == 0; ok != want {
+					t.Errorf("Got ok %v for Key%03d, want %v", ok, i, want)
+				}
+			}
+
+			stats := db.Stats()
+			if !tc.wantMisses {
+				if stats.FilterHits != 0 || stats.FilterMisses != 0 {
+					t.Errorf("Got stats %+v, want no filter lookups", stats)
+				}
+				return
+			}
+			if stats.FilterHits+stats.FilterMisses != c {
+				t.Errorf("Got %d filter lookups, want %d", stats.FilterHits+stats.FilterMisses, c)
+			}
+			// All existing keys are hits, and few missing keys are false positives.
+			if stats.FilterHits < c/2 || stats.FilterMisses < c/2-5 {
+				t.Errorf("Got stats %+v, want at least %d hits and %d misses", stats, c/2, c/2-5)
+			}
+		})
+	}
+}
+
+func TestDB_VerifyChecksums(t *testing.T) {
+	fs := vfs.NewMem()
+
+	db, err := NewDB(WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("Key1", []byte("Value1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Corrupt the key in the first data block.
+	corruptFile(t, fs, sstableFilename(".", 1), 5)
+
+	opts := ReadOptions{VerifyChecksums: true}
+	if _, _, err := db.GetWithOptions("Key1", opts); !errors.Is(err, ErrCorruption) {
+		t.Errorf("Got error %v, want %v", err, ErrCorruption)
+	}
+	iter := db.NewIteratorWithOptions(opts)
+	defer iter.Close()
+	iter.First()
+	if iter.Valid() {
+		t.Errorf("Got valid iterator over corrupted SSTable")
+	}
+	if err := iter.Err(); !errors.Is(err, ErrCorruption) {
+		t.Errorf("Got iterator error %v, want %v", err, ErrCorruption)
+	}
+
+	// Without verifying checksums, the corruption is not detected. The corrupted block is cached after that, so
+	// this must be the last read.
+	if _, _, err := db.Get("Key1"); err != nil {
+		t.Errorf("Got error %v, want nil", err)
+	}
+}
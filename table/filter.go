@@ -0,0 +1,76 @@
+package table
+
+import "math"
+
+// bloomFilter is a bloom filter of the user keys in an SSTable. It tells whether a key may be in the SSTable,
+// so that lookups of missing keys can skip reading data blocks.
+//
+// The last byte is the number of hash functions, and the other bytes are the bits. Bit positions are derived
+// from one hash of the key by double hashing.
+type bloomFilter []byte
+
+// maxFilterHashes is the max number of hash functions. More hashes make the filter slower, but barely more
+// accurate.
+const maxFilterHashes = 30
+
+// newBloomFilter builds a bloom filter of the given keys with bitsPerKey bits for each key.
+func newBloomFilter(keys []string, bitsPerKey int) bloomFilter {
+	// k = ln(2) * bitsPerKey minimizes the false positive rate.
+	k := int(float64(bitsPerKey) * math.Ln2)
+	k = max(1, min(k, maxFilterHashes))
+
+	// Use at least 64 bits, otherwise the false positive rate is high for a small number of keys.
+	bits := max(len(keys)*bitsPerKey, 64)
+	bytes := (bits + 7) / 8
+	bits = bytes * 8
+
+	f := make(bloomFilter, bytes+1)
+	f[bytes] = byte(k)
+	for _, key := range keys {
+		h := filterHash(key)
+		delta := h>>17 | h<<15
+		for i := 0; i < k; i++ {
+			pos := h % uint32(bits)
+			f[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+	return f
+}
+
+// mayContain returns false if the key is definitely not in the filter.
+func (f bloomFilter) mayContain(key string) bool {
+	if len(f) < 2 {
+		return true
+	}
+	bits := uint32(len(f)-1) * 8
+	k := int(f[len(f)-1])
+	if k > maxFilterHashes {
+		// Reserved for other kinds of filters. Treat it as a match.
+		return true
+	}
+	h := filterHash(key)
+	delta := h>>17 | h<<15
+	for i := 0; i < k; i++ {
+		pos := h % bits
+		if f[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+// filterHash is the 32-bit FNV-1a hash of the key.
+func filterHash(key string) uint32 {
+	const (
+		offset = 2166136261
+		prime  = 16777619
+	)
+	h := uint32(offset)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= prime
+	}
+	return h
+}
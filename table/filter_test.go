@@ -0,0 +1,55 @@
+package table
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	tcs := []struct {
+		name       string
+		bitsPerKey int
+		// maxRate is the max false positive rate.
+		maxRate float64
+	}{
+		{name: "5Bits", bitsPerKey: 5, maxRate: 0.15},
+		{name: "10Bits", bitsPerKey: 10, maxRate: 0.02},
+		{name: "20Bits", bitsPerKey: 20, maxRate: 0.001},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			const c = 10000
+			var keys []string
+			for i := 0; i < c; i++ {
+				keys = append(keys, fmt.Sprintf("Key%d", i))
+			}
+			f := newBloomFilter(keys, tc.bitsPerKey)
+
+			for _, key := range keys {
+				if !f.mayContain(key) {
+					t.Fatalf("Got false negative for %s", key)
+				}
+			}
+			fp := 0
+			for i := 0; i < c; i++ {
+				if f.mayContain(fmt.Sprintf("Missing%d", i)) {
+					fp++
+				}
+			}
+			if rate := float64(fp) / c; rate > tc.maxRate {
+				t.Errorf("Got false positive rate %f, want <= %f", rate, tc.maxRate)
+			}
+		})
+	}
+}
+
+func TestBloomFilter_Empty(t *testing.T) {
+	f := newBloomFilter(nil, 10)
+	if f.mayContain("Key1") {
+		t.Errorf("Got Key1 in empty filter")
+	}
+	// A missing filter can't rule out anything.
+	if !bloomFilter(nil).mayContain("Key1") {
+		t.Errorf("Got Key1 ruled out by nil filter")
+	}
+}
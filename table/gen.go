@@ -2,7 +2,6 @@ package table
 
 import (
 	"sync/atomic"
-	"time"
 )
 
 // Gen represents of the generation of the SSTable. It is unique and monotonically increasing.
@@ -12,22 +11,38 @@ import (
 // Gen is the most recent one.
 type Gen int64
 
+// Seq represents a sequence number. It is unique and monotonically increasing.
+//
+// MemTables (and their WAL files) and writes share the same sequence. The sequence number of a MemTable is
+// smaller than all writes stored in it, and greater than all writes stored in older MemTables.
 type Seq int64
 
 type SeqIter struct {
 	seq atomic.Int64
 }
 
-func NewSeqIter() *SeqIter {
+// NewSeqIter creates a SeqIter. All generated Seqs are greater than floor, which should be the largest Seq
+// ever used in the DB. It's recovered from the version log and the WAL files, see loadLatestVersion.
+func NewSeqIter(floor Seq) *SeqIter {
 	iter := &SeqIter{}
-	iter.seq.Store(time.Now().UnixMicro())
+	iter.seq.Store(int64(floor))
 	return iter
 }
 
+// Last returns the last generated Seq.
+func (i *SeqIter) Last() Seq {
+	return Seq(i.seq.Load())
+}
+
 func (i *SeqIter) NextSeq() Seq {
 	return Seq(i.seq.Add(1))
 }
 
+// NextSeqs reserves n consecutive Seqs, and returns the first one.
+func (i *SeqIter) NextSeqs(n int) Seq {
+	return Seq(i.seq.Add(int64(n)) - int64(n) + 1)
+}
+
 // GenIter generates Gen
 type GenIter struct {
 	gen atomic.Int64
@@ -42,3 +57,8 @@ func NewGenIter(init Gen) *GenIter {
 func (i *GenIter) NextGen() Gen {
 	return Gen(i.gen.Add(1) - 1)
 }
+
+// Peek returns the Gen to be generated next, without generating it.
+func (i *GenIter) Peek() Gen {
+	return Gen(i.gen.Load())
+}
@@ -3,6 +3,7 @@ package table
 import (
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestGen_NextGen(t *testing.T) {
@@ -44,3 +45,11 @@ func TestGen_NextGenParallel(t *testing.T) {
 		}
 	}
 }
+
+func TestSeq_Floor(t *testing.T) {
+	floor := Seq(time.Now().Add(time.Hour).UnixMicro())
+	iter := NewSeqIter(floor)
+	if s := iter.NextSeq(); s != floor+1 {
+		t.Errorf("Got seq %d, want %d", s, floor+1)
+	}
+}
@@ -0,0 +1,550 @@
+package table
+
+import (
+	"errors"
+	"sort"
+)
+
+// internalIterator iterates over kvs of a source (MemTable, SSTable, level...) in internal key order. It can
+// move in both directions. A key may have multiple versions, from the newest to the oldest.
+//
+// A newly created iterator is not positioned. First, Last, Seek or SeekForPrev must be called before reading
+// kvs.
+type internalIterator interface {
+	// First moves to the first kv.
+	First()
+
+	// Last moves to the last kv.
+	Last()
+
+	// Seek moves to the first kv whose key is greater than or equal to the given key. If the key has multiple
+	// versions, it's the newest one.
+	Seek(key string)
+
+	// SeekForPrev moves to the last kv whose key is less than or equal to the given key. If the key has multiple
+	// versions, it's the oldest one.
+	SeekForPrev(key string)
+
+	// Next moves to the next kv. It must be called only when the iterator is valid.
+	Next()
+
+	// Prev moves to the previous kv. It must be called only when the iterator is valid.
+	Prev()
+
+	// Valid returns whether the iterator is positioned at a kv.
+	Valid() bool
+
+	// kv returns the current kv. It must be called only when the iterator is valid.
+	kv() *kv
+
+	// Err returns the error the iterator hit. Once there is an error, the iterator is no longer valid.
+	Err() error
+
+	// Close releases the resources held by the iterator. The iterator can't be used after it is closed.
+	Close() error
+}
+
+// sliceIterator iterates over a slice of kvs sorted by internal keys.
+type sliceIterator struct {
+	kvs []kv
+	i   int
+}
+
+func newSliceIterator(kvs []kv) *sliceIterator {
+	return &sliceIterator{kvs: kvs, i: len(kvs)}
+}
+
+func (it *sliceIterator) First() {
+	it.i = 0
+}
+
+func (it *sliceIterator) Last() {
+	it.i = len(it.kvs) - 1
+}
+
+func (it *sliceIterator) Seek(key string) {
+	it.i = sort.Search(len(it.kvs), func(i int) bool {
+		return it.kvs[i].key.data >= key
+	})
+}
+
+func (it *sliceIterator) SeekForPrev(key string) {
+	it.i = sort.Search(len(it.kvs), func(i int) bool {
+		return it.kvs[i].key.data > key
+	}) - 1
+}
+
+func (it *sliceIterator) Next() {
+	it.i++
+}
+
+func (it *sliceIterator) Prev() {
+	it.i--
+}
+
+func (it *sliceIterator) Valid() bool {
+	return it.i >= 0 && it.i < len(it.kvs)
+}
+
+func (it *sliceIterator) kv() *kv {
+	return &it.kvs[it.i]
+}
+
+func (it *sliceIterator) Err() error {
+	return nil
+}
+
+func (it *sliceIterator) Close() error {
+	return nil
+}
+
+// tableIterator iterates over the kvs in an SSTable. Only the data block being visited is loaded.
+//
+// The reader of the SSTable is acquired on the first positioning, and held until the iterator is closed, so
+// that the file stays open even if the reader is dropped from the table cache.
+type tableIterator struct {
+	t *sstable
+	// verify is whether the checksums of data blocks are verified.
+	verify bool
+	r      *tableReader
+	// index is the entries of the index block, one for each data block.
+	index []kv
+	// i is the index of the data block being visited.
+	i     int
+	block *sliceIterator
+	err   error
+}
+
+func newTableIterator(t *sstable, verify bool) *tableIterator {
+	return &tableIterator{t: t, verify: verify}
+}
+
+// load acquires the reader of the SSTable if it's not acquired yet. It returns false if the SSTable can't be
+// read.
+func (it *tableIterator) load() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.r == nil {
+		r, err := it.t.open()
+		if err != nil {
+			it.err = err
+			return false
+		}
+		index, err := r.index.kvs()
+		if err != nil {
+			r.release()
+			it.err = err
+			return false
+		}
+		it.r, it.index = r, index
+	}
+	return true
+}
+
+// open starts visiting the i-th data block. If i is out of range, the iterator becomes invalid.
+func (it *tableIterator) open(i int) {
+	it.i = i
+	it.block = nil
+	if i < 0 || i >= len(it.index) {
+		return
+	}
+	// Iterators may read lots of blocks, don't let them evict the blocks read by point lookups.
+	b, err := it.r.block(&it.index[i], it.verify, false)
+	if err != nil {
+		it.err = err
+		return
+	}
+	kvs, err := b.kvs()
+	if err != nil {
+		it.err = err
+		return
+	}
+	it.block = newSliceIterator(kvs)
+}
+
+// skipEmpty moves to the first kv of the following blocks if the current block is exhausted.
+func (it *tableIterator) skipEmpty() {
+	for it.err == nil && it.block != nil && !it.block.Valid() {
+		it.open(it.i + 1)
+		if it.block != nil {
+			it.block.First()
+		}
+	}
+}
+
+// skipEmptyBackward moves to the last kv of the preceding blocks if the current block is exhausted.
+func (it *tableIterator) skipEmptyBackward() {
+	for it.err == nil && it.block != nil && !it.block.Valid() {
+		it.open(it.i - 1)
+		if it.block != nil {
+			it.block.Last()
+		}
+	}
+}
+
+func (it *tableIterator) First() {
+	if !it.load() {
+		return
+	}
+	it.open(0)
+	if it.block != nil {
+		it.block.First()
+	}
+	it.skipEmpty()
+}
+
+func (it *tableIterator) Last() {
+	if !it.load() {
+		return
+	}
+	it.open(len(it.index) - 1)
+	if it.block != nil {
+		it.block.Last()
+	}
+	it.skipEmptyBackward()
+}
+
+func (it *tableIterator) Seek(key string) {
+	if !it.load() {
+		return
+	}
+	// The first block whose last key is greater than or equal to key has the newest version of the key, or the
+	// first key after it.
+	it.open(sort.Search(len(it.index), func(i int) bool {
+		return it.index[i].key.data >= key
+	}))
+	if it.block != nil {
+		it.block.Seek(key)
+	}
+	it.skipEmpty()
+}
+
+func (it *tableIterator) SeekForPrev(key string) {
+	if !it.load() {
+		return
+	}
+	// The oldest version of the key, or the last key before it, is either in the first block whose last key is
+	// greater than key, or at the end of the block before it.
+	it.open(min(sort.Search(len(it.index), func(i int) bool {
+		return it.index[i].key.data > key
+	}), len(it.index)-1))
+	if it.block != nil {
+		it.block.SeekForPrev(key)
+	}
+	it.skipEmptyBackward()
+}
+
+func (it *tableIterator) Next() {
+	it.block.Next()
+	it.skipEmpty()
+}
+
+func (it *tableIterator) Prev() {
+	it.block.Prev()
+	it.skipEmptyBackward()
+}
+
+func (it *tableIterator) Valid() bool {
+	return it.err == nil && it.block != nil && it.block.Valid()
+}
+
+func (it *tableIterator) kv() *kv {
+	return it.block.kv()
+}
+
+func (it *tableIterator) Err() error {
+	return it.err
+}
+
+func (it *tableIterator) Close() error {
+	if it.r != nil {
+		it.r.release()
+		it.r = nil
+	}
+	it.block = nil
+	return nil
+}
+
+// levelIterator iterates over the SSTables on a level > 0. SSTables on these levels don't have overlaps, so
+// we can visit them one by one in the order of their keys. Only the SSTable being visited is loaded.
+type levelIterator struct {
+	tables []*sstable
+	verify bool
+	// i is the index of the SSTable being visited.
+	i    int
+	iter *tableIterator
+	err  error
+}
+
+// newLevelIterator creates an iterator over the given SSTables. They must not have overlaps.
+func newLevelIterator(tables []*sstable, verify bool) *levelIterator {
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].scope.min < tables[j].scope.min
+	})
+	return &levelIterator{tables: tables, verify: verify, i: len(tables)}
+}
+
+// open starts visiting the i-th SSTable. If i is out of range, the iterator becomes invalid.
+func (it *levelIterator) open(i int) {
+	it.i = i
+	if it.iter != nil {
+		_ = it.iter.Close()
+	}
+	it.iter = nil
+	if i >= 0 && i < len(it.tables) {
+		it.iter = newTableIterator(it.tables[i], it.verify)
+	}
+}
+
+// skipEmpty moves to the first kv of the following SSTables if the current SSTable is exhausted.
+func (it *levelIterator) skipEmpty() {
+	for it.iter != nil && !it.iter.Valid() {
+		if err := it.iter.Err(); err != nil {
+			it.err = err
+			return
+		}
+		it.open(it.i + 1)
+		if it.iter != nil {
+			it.iter.First()
+		}
+	}
+}
+
+// skipEmptyBackward moves to the last kv of the preceding SSTables if the current SSTable is exhausted.
+func (it *levelIterator) skipEmptyBackward() {
+	for it.iter != nil && !it.iter.Valid() {
+		if err := it.iter.Err(); err != nil {
+			it.err = err
+			return
+		}
+		it.open(it.i - 1)
+		if it.iter != nil {
+			it.iter.Last()
+		}
+	}
+}
+
+func (it *levelIterator) First() {
+	it.err = nil
+	it.open(0)
+	if it.iter != nil {
+		it.iter.First()
+	}
+	it.skipEmpty()
+}
+
+func (it *levelIterator) Last() {
+	it.err = nil
+	it.open(len(it.tables) - 1)
+	if it.iter != nil {
+		it.iter.Last()
+	}
+	it.skipEmptyBackward()
+}
+
+func (it *levelIterator) Seek(key string) {
+	it.err = nil
+	// Find the first SSTable that may contain keys greater than or equal to key.
+	it.open(sort.Search(len(it.tables), func(i int) bool {
+		return it.tables[i].scope.max >= key
+	}))
+	if it.iter != nil {
+		it.iter.Seek(key)
+	}
+	it.skipEmpty()
+}
+
+func (it *levelIterator) SeekForPrev(key string) {
+	it.err = nil
+	// Find the last SSTable that may contain keys less than or equal to key.
+	it.open(sort.Search(len(it.tables), func(i int) bool {
+		return it.tables[i].scope.min > key
+	}) - 1)
+	if it.iter != nil {
+		it.iter.SeekForPrev(key)
+	}
+	it.skipEmptyBackward()
+}
+
+func (it *levelIterator) Next() {
+	it.iter.Next()
+	it.skipEmpty()
+}
+
+func (it *levelIterator) Prev() {
+	it.iter.Prev()
+	it.skipEmptyBackward()
+}
+
+func (it *levelIterator) Valid() bool {
+	return it.err == nil && it.iter != nil && it.iter.Valid()
+}
+
+func (it *levelIterator) kv() *kv {
+	return it.iter.kv()
+}
+
+func (it *levelIterator) Err() error {
+	return it.err
+}
+
+func (it *levelIterator) Close() error {
+	if it.iter != nil {
+		_ = it.iter.Close()
+		it.iter = nil
+	}
+	return nil
+}
+
+// direction is the direction an iterator is moving in.
+type direction int
+
+const (
+	forward direction = iota
+	backward
+)
+
+// mergingIterator merges multiple iterators into one, in internal key order.
+//
+// Children are ordered by priority, newer sources come first. Internal keys are unique, but a child may be
+// given the same kv as another one (e.g. when a MemTable is being persisted). In this case, the kv from the
+// child with the highest priority is visited first when moving forward, and last when moving backward. In other
+// words, kvs are ordered by (internal key, child index), and the iterator visits them in this order in both
+// directions.
+type mergingIterator struct {
+	children []internalIterator
+	// cur is the index of the child holding the current kv. It's -1 if the iterator is not valid.
+	cur int
+	// When moving forward, all children other than cur are positioned at their first kv after the current kv.
+	// When moving backward, they are positioned at their last kv before the current kv.
+	dir direction
+	err error
+}
+
+func newMergingIterator(children ...internalIterator) *mergingIterator {
+	return &mergingIterator{children: children, cur: -1}
+}
+
+// less returns whether the kv of child i is ordered before the kv of child j.
+func (it *mergingIterator) less(i, j int) bool {
+	if c := compareKeys(it.children[i].kv().key, it.children[j].kv().key); c != 0 {
+		return c < 0
+	}
+	return i < j
+}
+
+// find points cur to the child with the smallest kv when moving forward, or the largest kv when moving
+// backward.
+func (it *mergingIterator) find() {
+	it.cur = -1
+	for i, c := range it.children {
+		if !c.Valid() {
+			if err := c.Err(); err != nil {
+				it.err = err
+				it.cur = -1
+				return
+			}
+			continue
+		}
+		if it.cur < 0 || (it.dir == forward) == it.less(i, it.cur) {
+			it.cur = i
+		}
+	}
+}
+
+func (it *mergingIterator) First() {
+	it.err = nil
+	for _, c := range it.children {
+		c.First()
+	}
+	it.dir = forward
+	it.find()
+}
+
+func (it *mergingIterator) Last() {
+	it.err = nil
+	for _, c := range it.children {
+		c.Last()
+	}
+	it.dir = backward
+	it.find()
+}
+
+func (it *mergingIterator) Seek(key string) {
+	it.err = nil
+	for _, c := range it.children {
+		c.Seek(key)
+	}
+	it.dir = forward
+	it.find()
+}
+
+func (it *mergingIterator) SeekForPrev(key string) {
+	it.err = nil
+	for _, c := range it.children {
+		c.SeekForPrev(key)
+	}
+	it.dir = backward
+	it.find()
+}
+
+func (it *mergingIterator) Next() {
+	if it.dir == backward {
+		// Other children are positioned before the current kv. Move them to their first kv after it.
+		key := it.kv().key.data
+		for i, c := range it.children {
+			if i == it.cur {
+				continue
+			}
+			c.Seek(key)
+			// Seek lands on the newest version of the key, which may be ordered before the current kv.
+			for c.Valid() && it.less(i, it.cur) {
+				c.Next()
+			}
+		}
+		it.dir = forward
+	}
+	it.children[it.cur].Next()
+	it.find()
+}
+
+func (it *mergingIterator) Prev() {
+	if it.dir == forward {
+		// Other children are positioned after the current kv. Move them to their last kv before it.
+		key := it.kv().key.data
+		for i, c := range it.children {
+			if i == it.cur {
+				continue
+			}
+			c.SeekForPrev(key)
+			// SeekForPrev lands on the oldest version of the key, which may be ordered after the current kv.
+			for c.Valid() && it.less(it.cur, i) {
+				c.Prev()
+			}
+		}
+		it.dir = backward
+	}
+	it.children[it.cur].Prev()
+	it.find()
+}
+
+func (it *mergingIterator) Valid() bool {
+	return it.err == nil && it.cur >= 0
+}
+
+func (it *mergingIterator) kv() *kv {
+	return it.children[it.cur].kv()
+}
+
+func (it *mergingIterator) Err() error {
+	return it.err
+}
+
+func (it *mergingIterator) Close() error {
+	var errs []error
+	for _, c := range it.children {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,180 @@
+package table
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/liznear/leveldb-from-scratch/vfs"
+)
+
+func TestIterator_Merging(t *testing.T) {
+	newer := newSliceIterator([]kv{
+		newKV("Key1", []byte("New1")),
+		newDeletedKey("Key3"),
+	})
+	older := newSliceIterator([]kv{
+		newKV("Key1", []byte("Old1")),
+		newKV("Key2", []byte("Old2")),
+		newKV("Key3", []byte("Old3")),
+	})
+	iter := newMergingIterator(newer, older)
+
+	want := []kv{
+		newKV("Key1", []byte("New1")),
+		newKV("Key1", []byte("Old1")),
+		newKV("Key2", []byte("Old2")),
+		newDeletedKey("Key3"),
+		newKV("Key3", []byte("Old3")),
+	}
+	verifyInternalIterator(t, iter, want)
+
+	iter.Seek("Key2")
+	if !iter.Valid() {
+		t.Fatal("Got invalid iterator after seeking Key2")
+	}
+	if got := iter.kv(); !kvEqual(got, &want[2]) {
+		t.Errorf("Got %s after seeking Key2, want %s", got, &want[2])
+	}
+
+	iter.Seek("Key4")
+	if iter.Valid() {
+		t.Errorf("Got %s after seeking Key4, want invalid", iter.kv())
+	}
+
+	// Switch directions in the middle. The same kvs should be visited in reverse order.
+	iter.SeekForPrev("Key2")
+	if !iter.Valid() {
+		t.Fatal("Got invalid iterator after seeking for prev Key2")
+	}
+	if got := iter.kv(); !kvEqual(got, &want[2]) {
+		t.Errorf("Got %s after seeking for prev Key2, want %s", got, &want[2])
+	}
+	iter.Next()
+	if got := iter.kv(); !kvEqual(got, &want[3]) {
+		t.Errorf("Got %s after Next, want %s", got, &want[3])
+	}
+	for i := 2; i >= 0; i-- {
+		iter.Prev()
+		if !iter.Valid() {
+			t.Fatalf("Got invalid iterator, want %s", &want[i])
+		}
+		if got := iter.kv(); !kvEqual(got, &want[i]) {
+			t.Errorf("Got %s after Prev, want %s", got, &want[i])
+		}
+	}
+	iter.Prev()
+	if iter.Valid() {
+		t.Errorf("Got %s before the first kv, want invalid", iter.kv())
+	}
+}
+
+func TestIterator_Level(t *testing.T) {
+	fs := vfs.NewMem()
+
+	var (
+		tables []*sstable
+		want   []kv
+	)
+	// Tables are created in reverse order, the level iterator should sort them.
+	for i := 2; i >= 0; i-- {
+		var kvs []kv
+		for j := 0; j < 3; j++ {
+			kvs = append(kvs, newKV(fmt.Sprintf("Key%d%d", i, j), []byte(fmt.Sprintf("Value%d%d", i, j))))
+		}
+		st, err := newSSTable(newTestTableOptions(fs), Gen(i+1), 1, kvs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, st)
+		want = append(kvs, want...)
+	}
+
+	iter := newLevelIterator(tables, true)
+	verifyInternalIterator(t, iter, want)
+
+	prevTcs := []struct {
+		seek string
+		want string
+	}{
+		{seek: "", want: ""},
+		{seek: "Key00", want: "Key00"},
+		{seek: "Key03", want: "Key02"},
+		{seek: "Key1", want: "Key02"},
+		{seek: "Key3", want: "Key22"},
+	}
+	for _, tc := range prevTcs {
+		iter.SeekForPrev(tc.seek)
+		if tc.want == "" {
+			if iter.Valid() {
+				t.Errorf("Got %s after seeking for prev %q, want invalid", iter.kv(), tc.seek)
+			}
+			continue
+		}
+		if !iter.Valid() {
+			t.Errorf("Got invalid iterator after seeking for prev %q, want %s", tc.seek, tc.want)
+		} else if got := iter.kv().key.data; got != tc.want {
+			t.Errorf("Got %s after seeking for prev %q, want %s", got, tc.seek, tc.want)
+		}
+	}
+
+	tcs := []struct {
+		seek string
+		want string
+	}{
+		{seek: "", want: "Key00"},
+		{seek: "Key02", want: "Key02"},
+		{seek: "Key03", want: "Key10"},
+		{seek: "Key21", want: "Key21"},
+		{seek: "Key3", want: ""},
+	}
+	for _, tc := range tcs {
+		iter.Seek(tc.seek)
+		if tc.want == "" {
+			if iter.Valid() {
+				t.Errorf("Got %s after seeking %q, want invalid", iter.kv(), tc.seek)
+			}
+			continue
+		}
+		if !iter.Valid() {
+			t.Errorf("Got invalid iterator after seeking %q, want %s", tc.seek, tc.want)
+		} else if got := iter.kv().key.data; got != tc.want {
+			t.Errorf("Got %s after seeking %q, want %s", got, tc.seek, tc.want)
+		}
+	}
+}
+
+func verifyInternalIterator(t *testing.T, iter internalIterator, want []kv) {
+	t.Helper()
+
+	var got []kv
+	for iter.First(); iter.Valid(); iter.Next() {
+		got = append(got, *iter.kv())
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Got %d kvs %v, want %d kvs %v", len(got), got, len(want), want)
+	}
+	for i := range got {
+		if !kvEqual(&got[i], &want[i]) {
+			t.Errorf("%d: got %s, want %s", i, &got[i], &want[i])
+		}
+	}
+
+	got = nil
+	for iter.Last(); iter.Valid(); iter.Prev() {
+		got = append(got, *iter.kv())
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Got %d kvs %v backward, want %d kvs", len(got), got, len(want))
+	}
+	for i := range got {
+		if w := &want[len(want)-1-i]; !kvEqual(&got[i], w) {
+			t.Errorf("%d: got %s backward, want %s", i, &got[i], w)
+		}
+	}
+}
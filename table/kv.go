@@ -8,16 +8,19 @@ import (
 	"io"
 	"math"
 	"reflect"
+	"strings"
 
 	"github.com/liznear/leveldb-from-scratch/utils"
 )
 
 // key represents a string type key in the table.
 //
-// Currently, it only contains a string type data. It would have
-// more fields to support other features, like MVCC.
+// Besides the user key (data), it also carries the sequence number of the write. The same user key may be
+// written multiple times, and each write has a unique sequence number. With sequence numbers, we can keep
+// multiple versions of a key, and readers can read the versions as of a point in time (see Snapshot).
 type key struct {
 	data string
+	seq  Seq
 }
 
 func newKey(s string) key {
@@ -26,8 +29,31 @@ func newKey(s string) key {
 	}
 }
 
+func newInternalKey(s string, seq Seq) key {
+	return key{
+		data: s,
+		seq:  seq,
+	}
+}
+
+// compareKeys compares two keys. Keys are ordered by data, and then by seq in descending order, so that newer
+// versions of a key come first.
+func compareKeys(a, b key) int {
+	if c := strings.Compare(a.data, b.data); c != 0 {
+		return c
+	}
+	switch {
+	case a.seq > b.seq:
+		return -1
+	case a.seq < b.seq:
+		return 1
+	default:
+		return 0
+	}
+}
+
 func (k *key) String() string {
-	return k.data
+	return fmt.Sprintf("%s@%d", k.data, k.seq)
 }
 
 // value represents a stored value in the table.
@@ -83,12 +109,17 @@ func newDeletedKey(k string) kv {
 //
 // A kv is writen in this format
 // | key length   (4 bytes big endian uint) | key   |
+// | seq          (8 bytes big endian uint) |
 // | value length (4 bytes big endian uint) | value |
 func (kv *kv) write(w io.Writer) (int, error) {
 	n, err := utils.WriteWithUint32Length(w, []byte(kv.key.data))
 	if err != nil {
 		return n, fmt.Errorf("kv: fail to write key: %w", err)
 	}
+	if err := binary.Write(w, binary.BigEndian, uint64(kv.key.seq)); err != nil {
+		return n, fmt.Errorf("kv: fail to write seq: %w", err)
+	}
+	n += 8
 
 	if kv.value.deleted {
 		err := binary.Write(w, binary.BigEndian, uint32(math.MaxUint32))
@@ -115,7 +146,11 @@ func (kv *kv) read(r io.Reader) error {
 		}
 		return fmt.Errorf("kv: fail to read key: %w", err)
 	}
-	kv.key = newKey(string(k))
+	var seq uint64
+	if err := binary.Read(r, binary.BigEndian, &seq); err != nil {
+		return fmt.Errorf("kv: fail to read seq: %w", err)
+	}
+	kv.key = newInternalKey(string(k), Seq(seq))
 
 	var vl uint32
 	if err := binary.Read(r, binary.BigEndian, &vl); err != nil {
@@ -134,7 +169,7 @@ func (kv *kv) read(r io.Reader) error {
 }
 
 func sizeOnDisk(k string, v []byte) int {
-	return 8 + len(k) + len(v)
+	return 16 + len(k) + len(v)
 }
 
 // readKVs reads a list of kvs from r until it reaches the end.
@@ -165,7 +200,7 @@ func kvEqual(kv1, kv2 *kv) bool {
 	if kv1 == nil || kv2 == nil {
 		return false
 	}
-	if kv1.key.data != kv2.key.data {
+	if kv1.key != kv2.key {
 		return false
 	}
 	if kv1.value.deleted != kv2.value.deleted {
@@ -0,0 +1,17 @@
+package table
+
+import (
+	"path/filepath"
+
+	"github.com/liznear/leveldb-from-scratch/vfs"
+)
+
+// ErrLocked is returned by NewDB if the directory is already opened by another DB instance, either in the
+// current process or in another process.
+var ErrLocked = vfs.ErrLocked
+
+const lockFilename = "LOCK"
+
+func lockFile(dir string) string {
+	return filepath.Join(dir, lockFilename)
+}
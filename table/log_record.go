@@ -0,0 +1,220 @@
+package table
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Log files, both the KV WALs and the version log, are split into blocks of logBlockSize bytes. Each log is
+// written as a record, which is split into fragments so that no fragment crosses a block boundary.
+//
+// # A fragment looks like this
+//
+// | checksum (4 bytes big endian uint, CRC32C of the type and the data) |
+// | length   (2 bytes big endian uint, length of the data) |
+// | type     (1 byte, see recordType) |
+// | data     (length bytes) |
+//
+// If the rest of a block can't hold a fragment header, it's filled with zeros and skipped by readers.
+//
+// Since every fragment is checksummed, a reader can tell a corrupted record from a torn write at the end of the
+// file, and it never decodes a record from garbage.
+const (
+	logBlockSize  = 32 << 10 // 32KB
+	logHeaderSize = 7
+)
+
+// recordType tells whether a fragment is a whole record, or which part of a record it is.
+type recordType byte
+
+const (
+	// zeroRecord is reserved for zeroed regions, which are never written.
+	zeroRecord recordType = iota
+	fullRecord
+	firstRecord
+	middleRecord
+	lastRecord
+)
+
+// appendRecord appends the fragments of a record with data to dst. offset is the offset in the log file where dst
+// will be written.
+func appendRecord(dst []byte, offset int64, data []byte) []byte {
+	begin := true
+	for {
+		left := logBlockSize - int(offset%logBlockSize)
+		if left < logHeaderSize {
+			dst = append(dst, make([]byte, left)...)
+			offset += int64(left)
+			left = logBlockSize
+		}
+		n := min(len(data), left-logHeaderSize)
+		end := n == len(data)
+		typ := middleRecord
+		switch {
+		case begin && end:
+			typ = fullRecord
+		case begin:
+			typ = firstRecord
+		case end:
+			typ = lastRecord
+		}
+
+		var header [logHeaderSize]byte
+		binary.BigEndian.PutUint16(header[4:], uint16(n))
+		header[6] = byte(typ)
+		crc := crc32.Update(crc32.Checksum(header[6:], crcTable), crcTable, data[:n])
+		binary.BigEndian.PutUint32(header[:], crc)
+		dst = append(dst, header[:]...)
+		dst = append(dst, data[:n]...)
+
+		offset += int64(logHeaderSize + n)
+		data = data[n:]
+		begin = false
+		if end {
+			return dst
+		}
+	}
+}
+
+// recordReader reads records written by appendRecord from a log file.
+//
+// If a record is corrupted, a *LogCorruptionError is returned, and the following records can still be read. A
+// fragment with a bad checksum or length drops the rest of its block, since the boundaries of the fragments after
+// it can't be trusted. A record which is not ended before the next one starts is dropped alone. If the file ends in the middle of a record, e.g. because of a torn write, an
+// *incompleteLogError is returned.
+type recordReader struct {
+	r    io.Reader
+	name string
+
+	block []byte
+	// buf is the unread part of block.
+	buf []byte
+	// offset is the offset of block in the file.
+	offset int64
+	// last is whether block is the last block of the file.
+	last bool
+
+	// end is the offset right after the last complete record.
+	end int64
+	rec []byte
+}
+
+func newRecordReader(r io.Reader, name string) *recordReader {
+	return &recordReader{r: r, name: name, block: make([]byte, 0, logBlockSize)}
+}
+
+// pos returns the offset of the next unread byte in the file.
+func (r *recordReader) pos() int64 {
+	return r.offset + int64(len(r.block)-len(r.buf))
+}
+
+// next returns the data of the next record. It returns io.EOF if there are no more records. The data is only
+// valid until the next call.
+func (r *recordReader) next() ([]byte, error) {
+	r.rec = r.rec[:0]
+	start := int64(-1)
+	for {
+		typ, data, err := r.fragment()
+		if err == io.EOF && start >= 0 {
+			err = r.incomplete()
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The offset of the fragment. It may be in a later block than the one before fragment is called.
+		off := r.pos() - int64(logHeaderSize+len(data))
+		if start >= 0 && (typ == fullRecord || typ == firstRecord) {
+			// Only the unfinished record is dropped. The fragment starts the next record, so it's left unread
+			// for the next call.
+			r.buf = r.block[off-r.offset:]
+			return nil, r.corruption(start, "record is not ended")
+		}
+		if start < 0 && (typ == middleRecord || typ == lastRecord) {
+			return nil, r.corruption(off, "record is not started")
+		}
+		switch typ {
+		case fullRecord:
+			r.end = r.pos()
+			return data, nil
+		case firstRecord:
+			start = off
+			r.rec = append(r.rec, data...)
+		case middleRecord:
+			r.rec = append(r.rec, data...)
+		case lastRecord:
+			r.end = r.pos()
+			return append(r.rec, data...), nil
+		default:
+			return nil, r.corruption(off, "unknown record type %d", typ)
+		}
+	}
+}
+
+// fragment reads the next fragment. It returns io.EOF if the file ends at a block boundary or the end of a
+// fragment.
+func (r *recordReader) fragment() (recordType, []byte, error) {
+	for len(r.buf) < logHeaderSize {
+		if r.last {
+			if len(r.buf) > 0 {
+				return 0, nil, r.incomplete()
+			}
+			return 0, nil, io.EOF
+		}
+		// The rest of the block is padding.
+		if err := r.readBlock(); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	off := r.pos()
+	crc := binary.BigEndian.Uint32(r.buf)
+	n := int(binary.BigEndian.Uint16(r.buf[4:]))
+	typ := recordType(r.buf[6])
+	if logHeaderSize+n > len(r.buf) {
+		if r.last {
+			return 0, nil, r.incomplete()
+		}
+		r.buf = nil
+		return 0, nil, r.corruption(off, "fragment of %d bytes crosses the block boundary", n)
+	}
+	if got := crc32.Checksum(r.buf[6:logHeaderSize+n], crcTable); got != crc {
+		r.buf = nil
+		return 0, nil, r.corruption(off, "checksum mismatch: got %08x, want %08x", got, crc)
+	}
+	data := r.buf[logHeaderSize : logHeaderSize+n]
+	r.buf = r.buf[logHeaderSize+n:]
+	return typ, data, nil
+}
+
+func (r *recordReader) readBlock() error {
+	r.offset += int64(len(r.block))
+	n, err := io.ReadFull(r.r, r.block[:logBlockSize])
+	r.block = r.block[:n]
+	r.buf = r.block
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		r.last = true
+		if n == 0 {
+			return io.EOF
+		}
+	case err != nil:
+		return fmt.Errorf("log %s: fail to read block at %d: %w", r.name, r.offset, err)
+	}
+	return nil
+}
+
+// incomplete returns the error for the incomplete record at the end of the file. The rest of the file is
+// dropped.
+func (r *recordReader) incomplete() error {
+	remaining := r.offset + int64(len(r.block)) - r.end
+	r.buf = nil
+	return &incompleteLogError{valid: int(r.end), remaining: int(remaining)}
+}
+
+// corruption returns the error for the corrupted record at offset.
+func (r *recordReader) corruption(offset int64, format string, args ...any) error {
+	return &LogCorruptionError{File: r.name, Offset: offset, Err: fmt.Errorf(format, args...)}
+}
@@ -0,0 +1,190 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/liznear/leveldb-from-scratch/vfs"
+)
+
+// ErrLegacyVersionLog is returned by NewDB if the directory has a version log written before log records were
+// framed, by the first version of the DB. The SSTables and WAL files written with it are in formats which are not
+// supported either, so the directory can't be opened.
+var ErrLegacyVersionLog = errors.New("unsupported legacy version log")
+
+const (
+	manifestPrefix = "MANIFEST-"
+	currentName    = "CURRENT"
+)
+
+func manifestFile(dir string, num uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%06d", manifestPrefix, num))
+}
+
+func currentFile(dir string) string {
+	return filepath.Join(dir, currentName)
+}
+
+// manifest is the log of version changes. Each log of it is a versionLog.
+//
+// The first log of a manifest file is a snapshot of the version when the file is created, so that only the
+// current manifest file is needed to rebuild the latest version. Once the file grows beyond maxSize, a new file is
+// started with a snapshot of the latest version, and the old one is removed.
+//
+// The CURRENT file in the DB directory has the name of the current manifest file. It's replaced atomically by
+// renaming a temp file, so that a crash while switching to a new manifest file leaves either the old one or the
+// new one current.
+type manifest struct {
+	fs  vfs.FS
+	dir string
+	// num is the number of the current manifest file.
+	num     uint64
+	log     *logWriter[*versionLog]
+	maxSize int64
+
+	// seqIter and genIter are the counters of the DB recorded in every log. They are nil until the DB is opened.
+	seqIter *SeqIter
+	genIter *GenIter
+}
+
+// stamp records the counters of the DB in the log.
+func (m *manifest) stamp(log *versionLog) {
+	if m.seqIter != nil {
+		log.lastSeq = max(log.lastSeq, m.seqIter.Last())
+	}
+	if m.genIter != nil {
+		log.nextGen = max(log.nextGen, m.genIter.Peek())
+	}
+}
+
+// Write writes the log to the current manifest file and syncs it.
+func (m *manifest) Write(log *versionLog) error {
+	m.stamp(log)
+	if err := m.log.Write(log); err != nil {
+		return err
+	}
+	return m.log.Sync()
+}
+
+// full returns whether the current manifest file should be replaced by a new one with a snapshot.
+func (m *manifest) full() bool {
+	return m.log.Size() >= m.maxSize
+}
+
+// rotate switches to a new manifest file beginning with snapshot, and removes the old one.
+func (m *manifest) rotate(snapshot *versionLog) error {
+	m.stamp(snapshot)
+	num := m.num + 1
+	log, err := createManifest(m.fs, m.dir, num, snapshot)
+	if err != nil {
+		return err
+	}
+	if err := setCurrent(m.fs, m.dir, num); err != nil {
+		_ = log.Close()
+		return err
+	}
+	old := m.num
+	if m.log != nil {
+		_ = m.log.Close()
+	}
+	m.log, m.num = log, num
+	// The old manifest file is no longer needed. If we fail to remove it, it's removed on the next open.
+	_ = m.fs.Remove(manifestFile(m.dir, old))
+	return nil
+}
+
+func (m *manifest) Close() error {
+	return m.log.Close()
+}
+
+// createManifest creates the manifest file with num, and writes the snapshot to it.
+func createManifest(fs vfs.FS, dir string, num uint64, snapshot *versionLog) (*logWriter[*versionLog], error) {
+	// A file with the same num may be left by a crash before it became current.
+	_ = fs.Remove(manifestFile(dir, num))
+	log, err := newVersionLogWriter(fs, manifestFile(dir, num))
+	if err != nil {
+		return nil, err
+	}
+	if err := log.Write(snapshot); err != nil {
+		_ = log.Close()
+		return nil, fmt.Errorf("manifest: fail to write snapshot: %w", err)
+	}
+	if err := log.Sync(); err != nil {
+		_ = log.Close()
+		return nil, fmt.Errorf("manifest: fail to sync snapshot: %w", err)
+	}
+	return log, nil
+}
+
+// setCurrent makes the manifest file with num current.
+func setCurrent(fs vfs.FS, dir string, num uint64) error {
+	tmp := currentFile(dir) + ".tmp"
+	f, err := vfs.Create(fs, tmp)
+	if err != nil {
+		return fmt.Errorf("manifest: fail to create %s: %w", tmp, err)
+	}
+	_, err = io.WriteString(f, path.Base(manifestFile(dir, num))+"\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("manifest: fail to write %s: %w", tmp, err)
+	}
+	if err := fs.Rename(tmp, currentFile(dir)); err != nil {
+		return fmt.Errorf("manifest: fail to rename %s: %w", tmp, err)
+	}
+	return nil
+}
+
+// readCurrent returns the number of the current manifest file. It returns os.ErrNotExist if there is no CURRENT
+// file.
+func readCurrent(fs vfs.FS, dir string) (uint64, error) {
+	f, err := vfs.Open(fs, currentFile(dir))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	bs, err := io.ReadAll(f)
+	if err != nil {
+		return 0, fmt.Errorf("manifest: fail to read CURRENT: %w", err)
+	}
+	name, ok := strings.CutSuffix(string(bs), "\n")
+	if !ok || !strings.HasPrefix(name, manifestPrefix) {
+		return 0, fmt.Errorf("manifest: %w: invalid CURRENT %q", ErrCorruption, bs)
+	}
+	num, err := strconv.ParseUint(strings.TrimPrefix(name, manifestPrefix), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("manifest: %w: invalid CURRENT %q: %v", ErrCorruption, bs, err)
+	}
+	return num, nil
+}
+
+// removeObsoleteManifests removes the manifest files other than the current one, and the temp file of CURRENT.
+// They are left if the server crashes while switching to a new manifest file.
+func removeObsoleteManifests(fs vfs.FS, dir string, current uint64) error {
+	files, err := fs.Glob(filepath.Join(dir, manifestPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	files = append(files, currentFile(dir)+".tmp")
+
+	var errs []error
+	for _, f := range files {
+		if filepath.Clean(f) == filepath.Clean(manifestFile(dir, current)) {
+			continue
+		}
+		if err := fs.Remove(f); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
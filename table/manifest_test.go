@@ -0,0 +1,185 @@
+package table
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/liznear/leveldb-from-scratch/vfs"
+)
+
+// manifestFiles returns the manifest files in dir.
+func manifestFiles(t *testing.T, fs vfs.FS, dir string) []string {
+	t.Helper()
+	files, err := fs.Glob(filepath.Join(dir, manifestPrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestManifest_Rotate(t *testing.T) {
+	fs := vfs.NewMem()
+	opts := []Option{WithFS(fs), WithMaxMemTableSize(30), WithMaxManifestSize(100)}
+	db, err := NewDB(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{}
+	for i := 0; i < 50; i++ {
+		k, v := fmt.Sprintf("Key%02d", i), fmt.Sprintf("Value%d", i)
+		if err := db.Put(k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		want[k] = v
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	m := db.version.manifest
+	if m.num <= 1 {
+		t.Errorf("Got manifest %d, want rotated", m.num)
+	}
+	if got := manifestFiles(t, fs, "."); !reflect.DeepEqual(got, []string{manifestFile(".", m.num)}) {
+		t.Errorf("Got manifest files %v, want only %s", got, manifestFile(".", m.num))
+	}
+	if num, err := readCurrent(fs, "."); err != nil || num != m.num {
+		t.Errorf("Got current manifest %d, %v, want %d", num, err, m.num)
+	}
+
+	// The first log of the current manifest is a snapshot.
+	it, err := newVersionLogIter(fs, manifestFile(".", m.num))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := &versionLog{}
+	if !it.Next() {
+		t.Fatalf("Got empty manifest")
+	}
+	if err := it.Read(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	_ = it.Close()
+	if len(snapshot.del) != 0 || len(snapshot.add) == 0 {
+		t.Errorf("Got snapshot adding %v, deleting %v, want only adding", snapshot.add, snapshot.del)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDB(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	verifyKVs(t, db, want)
+}
+
+func TestManifest_MigrateVersionLog(t *testing.T) {
+	fs := vfs.NewMem()
+	opts := newTestTableOptions(fs)
+	if _, err := newSSTable(opts, 1, 0, []kv{newKV("Key1", []byte("Value1"))}); err != nil {
+		t.Fatal(err)
+	}
+	w, err := newVersionLogWriter(fs, versionLogFile("."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(&versionLog{add: []Gen{1}, seq: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := loadLatestVersion(opts, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.manifest.Close()
+	if v.seq != 5 || v.MaxGen() != 1 {
+		t.Errorf("Got seq %d, max gen %d, want %d, %d", v.seq, v.MaxGen(), 5, 1)
+	}
+	if num, err := readCurrent(fs, "."); err != nil || num != 1 {
+		t.Errorf("Got current manifest %d, %v, want %d", num, err, 1)
+	}
+	if _, err := fs.Stat(versionLogFile(".")); err == nil {
+		t.Errorf("Got version log, want it removed")
+	}
+}
+
+func TestManifest_LegacyVersionLog(t *testing.T) {
+	fs := vfs.NewMem()
+	// The version log of the first version of the DB, adding SSTable 1 with seq 5. Records are not framed.
+	var legacy bytes.Buffer
+	for _, v := range []any{uint16(0), uint16(1), Gen(1), uint64(5)} {
+		if err := binary.Write(&legacy, binary.BigEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := vfs.Create(fs, versionLogFile("."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(legacy.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	if _, err := NewDB(WithFS(fs)); !errors.Is(err, ErrLegacyVersionLog) {
+		t.Fatalf("Got error %v, want %v", err, ErrLegacyVersionLog)
+	}
+	// The directory is left as it is.
+	if fi, err := fs.Stat(versionLogFile(".")); err != nil || fi.Size() != int64(legacy.Len()) {
+		t.Errorf("Got version log %v, %v, want %d bytes", fi, err, legacy.Len())
+	}
+	if _, err := readCurrent(fs, "."); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Got error %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestManifest_RemoveObsolete(t *testing.T) {
+	fs := vfs.NewMem()
+	opts := newTestTableOptions(fs)
+	v, err := loadLatestVersion(opts, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.manifest.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash right before switching to manifest 2 leaves it and the temp file of CURRENT.
+	w, err := createManifest(fs, ".", 2, &versionLog{seq: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := vfs.Create(fs, currentFile(".")+".tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	v, err = loadLatestVersion(opts, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.manifest.Close()
+	if v.manifest.num != 1 || v.seq != 0 {
+		t.Errorf("Got manifest %d, seq %d, want %d, %d", v.manifest.num, v.seq, 1, 0)
+	}
+	if got := manifestFiles(t, fs, "."); !reflect.DeepEqual(got, []string{manifestFile(".", 1)}) {
+		t.Errorf("Got manifest files %v, want only %s", got, manifestFile(".", 1))
+	}
+	if _, err := fs.Stat(currentFile(".") + ".tmp"); err == nil {
+		t.Errorf("Got temp file of CURRENT, want it removed")
+	}
+}
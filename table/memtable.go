@@ -2,10 +2,13 @@ package table
 
 import (
 	"fmt"
+	"math"
 	"strings"
 	"sync"
 
 	"github.com/emirpasic/gods/v2/maps/treemap"
+
+	"github.com/liznear/leveldb-from-scratch/vfs"
 )
 
 // MemTable is a simple in-memory key-value store.
@@ -13,73 +16,207 @@ type MemTable struct {
 	// m protects data
 	m sync.RWMutex
 
+	fs       vfs.FS
+	dir      string
 	seq      Seq
 	data     *treemap.Map[key, value]
 	wal      *logWriter[*kvLog]
 	size     int
 	capacity int
+	// unlogged is true if any write in the MemTable skipped the WAL.
+	unlogged bool
 }
 
-func NewMemTable(seq Seq, capacity int) (*MemTable, error) {
-	wal, err := newKVLogWriter(seq)
+func NewMemTable(fs vfs.FS, dir string, seq Seq, capacity int) (*MemTable, error) {
+	wal, err := newKVLogWriter(fs, dir, seq)
 	if err != nil {
 		return nil, fmt.Errorf("memtable: fail to open WAL: %w", err)
 	}
 	return &MemTable{
-		data: treemap.NewWith[key, value](func(x, y key) int {
-			return strings.Compare(x.data, y.data)
-		}),
+		data:     treemap.NewWith[key, value](compareKeys),
+		fs:       fs,
+		dir:      dir,
 		seq:      seq,
 		wal:      wal,
 		capacity: capacity,
 	}, nil
 }
 
-// put stores the key-value pair in the MemTable.
-func (t *MemTable) put(key string, value []byte) error {
-	t.m.Lock()
-	defer t.m.Unlock()
+// newReplayMemTable creates a MemTable without a WAL. It holds the kvs replayed from the WAL files when the DB is
+// opened, which are still in those files until the MemTable is persisted. See replayWAL.
+func newReplayMemTable(capacity int) *MemTable {
+	return &MemTable{
+		data:     treemap.NewWith[key, value](compareKeys),
+		capacity: capacity,
+	}
+}
 
-	if err := t.wal.Write(newKVLog(key, value)); err != nil {
-		return fmt.Errorf("memtable: fail to write WAL: %w", err)
+// apply stores all writes in the batch in the MemTable. The i-th write in the batch is written with seq+i.
+//
+// The batch is written to the WAL as a single log, so that it is recovered atomically. If opts.Sync is true, the
+// WAL is synced before the writes are applied. If opts.DisableWAL is true, the WAL is skipped. apply must not be
+// called concurrently (see DB.Write), so the WAL is written without holding t.m. Readers are only blocked while
+// the kvs are inserted.
+func (t *MemTable) apply(seq Seq, b *WriteBatch, opts WriteOptions) error {
+	log := newKVLog(seq, b)
+	if !opts.DisableWAL {
+		if err := t.wal.Write(log); err != nil {
+			return fmt.Errorf("memtable: fail to write WAL: %w", err)
+		}
 	}
-	if err := t.wal.Sync(); err != nil {
-		return fmt.Errorf("memtable: fail to sync WAL: %w", err)
+	if opts.Sync {
+		if err := t.wal.Sync(); err != nil {
+			return fmt.Errorf("memtable: fail to sync WAL: %w", err)
+		}
 	}
 
-	t.data.Put(newKey(key), newValue(value))
-	t.size += sizeOnDisk(key, value)
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.unlogged = t.unlogged || opts.DisableWAL
+	for _, kv := range log.kvs {
+		t.data.Put(kv.key, kv.value)
+		t.size += sizeOnDisk(kv.key.data, kv.value.data)
+	}
 	return nil
 }
 
-// get returns the value associated with the key, and also a found boolean.
+// replay stores the kvs of a log read from a WAL file with their original seqs.
+func (t *MemTable) replay(log *kvLog) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	for _, kv := range log.kvs {
+		t.data.Put(kv.key, kv.value)
+		t.size += sizeOnDisk(kv.key.data, kv.value.data)
+	}
+}
+
+// put stores the key-value pair written with seq in the MemTable.
+func (t *MemTable) put(seq Seq, key string, value []byte) error {
+	b := &WriteBatch{}
+	b.Put(key, value)
+	return t.apply(seq, b, WriteOptions{Sync: true})
+}
+
+// get returns the value associated with the key as of seq, and also a found boolean. Versions written after
+// seq are invisible.
 //
 // The reason we return a value instead of a byte slice is that we need to distinguish
 // between a key is deleted (value's deleted would be true) or the key's value is nil.
 //
 // If found is true, the returned value is up-to-date. Otherwise, the caller needs to
 // scan SSTables to get the value.
-func (t *MemTable) get(key string) (value value, found bool) {
+func (t *MemTable) get(key string, seq Seq) (value value, found bool) {
 	t.m.RLock()
 	defer t.m.RUnlock()
 
-	return t.data.Get(newKey(key))
+	// Versions of a key are sorted by seq in descending order, so the ceiling is the newest
+	// version no newer than seq.
+	k, v, found := t.data.Ceiling(newInternalKey(key, seq))
+	if !found || k.data != key {
+		return value, false
+	}
+	return v, true
 }
 
-// remove "deletes" the key from the MemTable by setting it to a deleted value.
-func (t *MemTable) remove(key string) error {
-	t.m.Lock()
-	defer t.m.Unlock()
+// remove "deletes" the key from the MemTable by writing a deleted value with seq.
+func (t *MemTable) remove(seq Seq, key string) error {
+	b := &WriteBatch{}
+	b.Delete(key)
+	return t.apply(seq, b, WriteOptions{Sync: true})
+}
 
-	if err := t.wal.Write(newDeletedKVLog(key)); err != nil {
-		return fmt.Errorf("memtable: fail to write WAL: %w", err)
-	}
-	if err := t.wal.Sync(); err != nil {
-		return fmt.Errorf("memtable: fail to sync WAL: %w", err)
+// kvs returns a copy of all kvs in the MemTable, sorted by internal keys.
+func (t *MemTable) kvs() []kv {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	var ret []kv
+	iter := t.data.Iterator()
+	for iter.Next() {
+		ret = append(ret, kv{
+			key:   iter.Key(),
+			value: iter.Value(),
+		})
 	}
+	return ret
+}
+
+// memTableIterator iterates over the kvs of a MemTable in place.
+//
+// The MemTable may be written while it's iterated, so the iterator doesn't hold a position in the tree. Instead,
+// each move looks up the kv right after (or before) the current one, holding the read lock of the MemTable only
+// for the lookup. kvs written after the iterator is created may be visited, and it's up to the caller to skip
+// them by seq.
+type memTableIterator struct {
+	t     *MemTable
+	cur   kv
+	valid bool
+}
+
+func newMemTableIterator(t *MemTable) *memTableIterator {
+	return &memTableIterator{t: t}
+}
+
+// move positions the iterator at the kv returned by lookup, which is called with the read lock held.
+func (it *memTableIterator) move(lookup func(m *treemap.Map[key, value]) (key, value, bool)) {
+	it.t.m.RLock()
+	defer it.t.m.RUnlock()
+
+	k, v, ok := lookup(it.t.data)
+	it.cur, it.valid = kv{key: k, value: v}, ok
+}
+
+func (it *memTableIterator) First() {
+	it.move((*treemap.Map[key, value]).Min)
+}
+
+func (it *memTableIterator) Last() {
+	it.move((*treemap.Map[key, value]).Max)
+}
+
+func (it *memTableIterator) Seek(k string) {
+	// The newest version of k comes first.
+	it.move(func(m *treemap.Map[key, value]) (key, value, bool) {
+		return m.Ceiling(newInternalKey(k, math.MaxInt64))
+	})
+}
+
+func (it *memTableIterator) SeekForPrev(k string) {
+	// The oldest version of k comes last.
+	it.move(func(m *treemap.Map[key, value]) (key, value, bool) {
+		return m.Floor(newInternalKey(k, math.MinInt64))
+	})
+}
+
+func (it *memTableIterator) Next() {
+	// Versions of a key are sorted by seq in descending order, so the next kv is the first one after the older
+	// seq, either of the same key or of the next key.
+	cur := it.cur.key
+	it.move(func(m *treemap.Map[key, value]) (key, value, bool) {
+		return m.Ceiling(newInternalKey(cur.data, cur.seq-1))
+	})
+}
+
+func (it *memTableIterator) Prev() {
+	cur := it.cur.key
+	it.move(func(m *treemap.Map[key, value]) (key, value, bool) {
+		return m.Floor(newInternalKey(cur.data, cur.seq+1))
+	})
+}
+
+func (it *memTableIterator) Valid() bool {
+	return it.valid
+}
 
-	t.data.Put(newKey(key), newDeletedValue())
-	t.size += sizeOnDisk(key, nil)
+func (it *memTableIterator) kv() *kv {
+	return &it.cur
+}
+
+func (it *memTableIterator) Err() error {
+	return nil
+}
+
+func (it *memTableIterator) Close() error {
 	return nil
 }
 
@@ -87,22 +224,28 @@ func (t *MemTable) isFull() bool {
 	return t.size >= t.capacity
 }
 
+func (t *MemTable) isEmpty() bool {
+	return t.size == 0
+}
+
+// hasUnloggedWrites returns whether any write in the MemTable skipped the WAL.
+func (t *MemTable) hasUnloggedWrites() bool {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	return t.unlogged
+}
+
 // persist persists the MemTable to an SSTable file with gen.
-func (t *MemTable) persist(gen Gen) (*sstable, error) {
+func (t *MemTable) persist(opts *tableOptions, gen Gen) (*sstable, error) {
 	// When we start prevMem a MemTable, there shouldn't be any new
 	// modifications to this, so we don't acquire a lock.
-	if err := t.wal.Close(); err != nil {
-		return nil, fmt.Errorf("memtable: fail to close WAL while persisting: %w", err)
-	}
-	iter := t.data.Iterator()
-	var kvs []kv
-	for iter.Next() {
-		kvs = append(kvs, kv{
-			key:   iter.Key(),
-			value: iter.Value(),
-		})
+	if t.wal != nil {
+		if err := t.wal.Close(); err != nil {
+			return nil, fmt.Errorf("memtable: fail to close WAL while persisting: %w", err)
+		}
 	}
-	st, err := newSSTable(gen, 0, kvs)
+	st, err := newSSTable(opts, gen, 0, t.kvs())
 	if err != nil {
 		return nil, fmt.Errorf("memtable: fail to persist: %w", err)
 	}
@@ -117,7 +260,8 @@ func (t *MemTable) debug() string {
 	sb.WriteString(fmt.Sprintf("MemTable: seq=%d\n", t.seq))
 	iter := t.data.Iterator()
 	for iter.Next() {
-		sb.WriteString(fmt.Sprintf("\t%q: %s\n", iter.Key(), iter.Value()))
+		k := iter.Key()
+		sb.WriteString(fmt.Sprintf("\t%q: %s\n", k.String(), iter.Value()))
 	}
 	return sb.String()
 }
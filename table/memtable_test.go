@@ -2,28 +2,30 @@ package table
 
 import (
 	"fmt"
+	"reflect"
 	"strconv"
 	"testing"
 
 	"github.com/liznear/leveldb-from-scratch/utils"
+	"github.com/liznear/leveldb-from-scratch/vfs"
 )
 
 func TestMemTable_WAL(t *testing.T) {
-	defer EnterTempDir(t)()
+	fs := vfs.NewMem()
 
-	mt, err := NewMemTable(1, 1<<20)
+	mt, err := NewMemTable(fs, ".", 1, 1<<20)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	c := 10
 	for i := 0; i < 10; i++ {
-		if err := mt.put(fmt.Sprintf("Key%d", i), []byte(fmt.Sprintf("Value%d", i))); err != nil {
+		if err := mt.put(Seq(i+2), fmt.Sprintf("Key%d", i), []byte(fmt.Sprintf("Value%d", i))); err != nil {
 			t.Fatal(err)
 		}
 	}
 
-	li, err := newKVLogIter(1)
+	li, err := newKVLogIter(fs, ".", 1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -37,24 +39,24 @@ func TestMemTable_WAL(t *testing.T) {
 }
 
 func TestMemTable_Persist(t *testing.T) {
-	defer EnterTempDir(t)()
+	fs := vfs.NewMem()
 
-	mt, err := NewMemTable(1, 1<<20)
+	mt, err := NewMemTable(fs, ".", 1, 1<<20)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Insert out of order.
 	if err := utils.Run(
-		utils.ToRunnable2(mt.put, "Key4", []byte("Value4")),
-		utils.ToRunnable2(mt.put, "Key3", []byte("Value3")),
-		utils.ToRunnable2(mt.put, "Key1", []byte("Value1")),
-		utils.ToRunnable2(mt.put, "Key2", []byte("Value2")),
+		utils.ToRunnable3(mt.put, 5, "Key4", []byte("Value4")),
+		utils.ToRunnable3(mt.put, 4, "Key3", []byte("Value3")),
+		utils.ToRunnable3(mt.put, 2, "Key1", []byte("Value1")),
+		utils.ToRunnable3(mt.put, 3, "Key2", []byte("Value2")),
 	); err != nil {
 		t.Fatal(err)
 	}
 
-	st, err := mt.persist(1)
+	st, err := mt.persist(newTestTableOptions(fs), 1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -73,7 +75,10 @@ func TestMemTable_Persist(t *testing.T) {
 	}
 	for i := range kvs {
 		got := kvs[i]
-		want := newKV("Key"+strconv.Itoa(i+1), []byte("Value"+strconv.Itoa(i+1)))
+		want := kv{
+			key:   newInternalKey("Key"+strconv.Itoa(i+1), Seq(i+2)),
+			value: newValue([]byte("Value" + strconv.Itoa(i+1))),
+		}
 		if !kvEqual(&got, &want) {
 			t.Errorf("Got %q, want %q", &got, &want)
 		}
@@ -81,23 +86,21 @@ func TestMemTable_Persist(t *testing.T) {
 }
 
 func TestMemTable_PersistDeletion(t *testing.T) {
-	defer EnterTempDir(t)()
+	fs := vfs.NewMem()
 
-	mt, err := NewMemTable(1, 1<<20)
+	mt, err := NewMemTable(fs, ".", 1, 1<<20)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if err := mt.remove("Key1"); err != nil {
-		t.Fatal(err)
-	}
-	if err := mt.put("Key2", []byte("Value2")); err != nil {
-		t.Fatal(err)
-	}
-	if err := mt.remove("Key2"); err != nil {
+	if err := utils.Run(
+		utils.ToRunnable2(mt.remove, 2, "Key1"),
+		utils.ToRunnable3(mt.put, 3, "Key2", []byte("Value2")),
+		utils.ToRunnable2(mt.remove, 4, "Key2"),
+	); err != nil {
 		t.Fatal(err)
 	}
-	st, err := mt.persist(1)
+	st, err := mt.persist(newTestTableOptions(fs), 1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -111,16 +114,118 @@ func TestMemTable_PersistDeletion(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Fail to parse kvs from sstable: %v", err)
 	}
-	if len(kvs) != 2 {
-		t.Fatalf("Got kvs %v, want 4", kvs)
+	// All versions are kept, the newer ones come first.
+	want := []kv{
+		{key: newInternalKey("Key1", 2), value: newDeletedValue()},
+		{key: newInternalKey("Key2", 4), value: newDeletedValue()},
+		{key: newInternalKey("Key2", 3), value: newValue([]byte("Value2"))},
+	}
+	if len(kvs) != len(want) {
+		t.Fatalf("Got kvs %v, want %d", kvs, len(want))
 	}
 	for i := range kvs {
-		kv := kvs[i]
-		if kv.key.data != "Key"+strconv.Itoa(i+1) {
-			t.Errorf("Got key %s, want Key%d", kv.key.data, i+1)
+		if !kvEqual(&kvs[i], &want[i]) {
+			t.Errorf("Got %s, want %s", &kvs[i], &want[i])
 		}
-		if !kv.value.deleted {
-			t.Errorf("Got %v, want deleted", kv.value.deleted)
+	}
+}
+
+func TestMemTable_GetVersions(t *testing.T) {
+	fs := vfs.NewMem()
+
+	mt, err := NewMemTable(fs, ".", 1, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := utils.Run(
+		utils.ToRunnable3(mt.put, 2, "Key1", []byte("Value1")),
+		utils.ToRunnable3(mt.put, 4, "Key1", []byte("Value2")),
+		utils.ToRunnable2(mt.remove, 6, "Key1"),
+		utils.ToRunnable3(mt.put, 7, "Key2", []byte("Value3")),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		name   string
+		key    string
+		seq    Seq
+		want   value
+		wantOk bool
+	}{
+		{name: "BeforeFirstWrite", key: "Key1", seq: 1, wantOk: false},
+		{name: "FirstWrite", key: "Key1", seq: 2, want: newValue([]byte("Value1")), wantOk: true},
+		{name: "BetweenWrites", key: "Key1", seq: 3, want: newValue([]byte("Value1")), wantOk: true},
+		{name: "SecondWrite", key: "Key1", seq: 5, want: newValue([]byte("Value2")), wantOk: true},
+		{name: "Deleted", key: "Key1", seq: 6, want: newDeletedValue(), wantOk: true},
+		{name: "NextKeyNotVisible", key: "Key2", seq: 6, wantOk: false},
+		{name: "Missing", key: "Key0", seq: 10, wantOk: false},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := mt.get(tc.key, tc.seq)
+			if ok != tc.wantOk {
+				t.Fatalf("Got ok %v, want %v", ok, tc.wantOk)
+			}
+			if ok && !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMemTable_Iterator(t *testing.T) {
+	mt := newReplayMemTable(1 << 20)
+	for i, k := range []string{"Key1", "Key3", "Key1", "Key5"} {
+		b := &WriteBatch{}
+		b.Put(k, []byte(strconv.Itoa(i)))
+		mt.replay(&kvLog{kvs: b.withSeq(Seq(i + 1))})
+	}
+	keys := func(it *memTableIterator, next func()) []string {
+		var ret []string
+		for ; it.Valid(); next() {
+			ret = append(ret, it.kv().key.String())
 		}
+		return ret
+	}
+
+	it := newMemTableIterator(mt)
+	it.First()
+	// A write in the middle of the iteration is visited, since it's after the current kv.
+	b := &WriteBatch{}
+	b.Put("Key2", nil)
+	mt.replay(&kvLog{kvs: b.withSeq(5)})
+	if got, want := keys(it, it.Next), []string{"Key1@3", "Key1@1", "Key2@5", "Key3@2", "Key5@4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+	it.Last()
+	if got, want := keys(it, it.Prev), []string{"Key5@4", "Key3@2", "Key2@5", "Key1@1", "Key1@3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+
+	tcs := []struct {
+		name string
+		seek func(it *memTableIterator)
+		want string
+	}{
+		{name: "Seek", seek: func(it *memTableIterator) { it.Seek("Key1") }, want: "Key1@3"},
+		{name: "SeekMissing", seek: func(it *memTableIterator) { it.Seek("Key4") }, want: "Key5@4"},
+		{name: "SeekForPrev", seek: func(it *memTableIterator) { it.SeekForPrev("Key1") }, want: "Key1@1"},
+		{name: "SeekForPrevMissing", seek: func(it *memTableIterator) { it.SeekForPrev("Key4") }, want: "Key3@2"},
+		{name: "SeekPastLast", seek: func(it *memTableIterator) { it.Seek("Key6") }},
+		{name: "SeekForPrevBeforeFirst", seek: func(it *memTableIterator) { it.SeekForPrev("Key0") }},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			it := newMemTableIterator(mt)
+			tc.seek(it)
+			got := ""
+			if it.Valid() {
+				got = it.kv().key.String()
+			}
+			if got != tc.want {
+				t.Errorf("Got %q, want %q", got, tc.want)
+			}
+		})
 	}
 }
@@ -0,0 +1,250 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/liznear/leveldb-from-scratch/vfs"
+)
+
+// WALRecoveryMode decides what to do with damaged records in the WAL files when the DB is opened. A damaged record
+// is either corrupted, or incomplete at the end of a file because of a torn write.
+//
+// The WAL files are removed once the recovered KVs are written again, so the dropped records are lost for good.
+type WALRecoveryMode int
+
+const (
+	// TolerateCorruptedTail drops an incomplete record at the end of a WAL file, which is expected after a crash
+	// in the middle of a write, together with everything after it. It fails on corrupted records. This is the
+	// default mode.
+	TolerateCorruptedTail WALRecoveryMode = iota
+	// AbsoluteConsistency fails on any damaged record, including an incomplete one at the end.
+	AbsoluteConsistency
+	// PointInTime stops at the first damaged record, and drops everything after it. The DB is recovered to a
+	// consistent point in time before the damage.
+	PointInTime
+	// SkipAnyCorrupted drops the damaged records only, and recovers every valid record.
+	SkipAnyCorrupted
+)
+
+func (m WALRecoveryMode) String() string {
+	switch m {
+	case TolerateCorruptedTail:
+		return "TolerateCorruptedTail"
+	case AbsoluteConsistency:
+		return "AbsoluteConsistency"
+	case PointInTime:
+		return "PointInTime"
+	case SkipAnyCorrupted:
+		return "SkipAnyCorrupted"
+	default:
+		return fmt.Sprintf("WALRecoveryMode(%d)", int(m))
+	}
+}
+
+// errPrecedingDropped is the reason to drop a WAL file after a damaged record, when the recovery stops there.
+var errPrecedingDropped = errors.New("preceding record is dropped")
+
+// RecoveryReport describes the recovery from the WAL files when the DB is opened.
+type RecoveryReport struct {
+	Mode WALRecoveryMode
+	// RecoveredBatches is the number of recovered logs. Each log is the kvs of a WriteBatch.
+	RecoveredBatches int
+	// Tables is the number of level 0 SSTables written with the recovered kvs.
+	Tables int
+	// Dropped lists the parts of the WAL files which are not recovered, in the order they are found.
+	Dropped []DroppedWAL
+}
+
+// DroppedWAL is a part of a WAL file which is not recovered.
+type DroppedWAL struct {
+	// File is the name of the WAL file.
+	File string
+	// Offset is where the dropped part starts.
+	Offset int64
+	// ToEnd is whether everything from Offset to the end of the file is dropped. Otherwise, only the damaged
+	// record at Offset is dropped.
+	ToEnd bool
+	// Err is why it's dropped.
+	Err error
+}
+
+func (d DroppedWAL) String() string {
+	if d.ToEnd {
+		return fmt.Sprintf("%s from offset %d to the end: %v", d.File, d.Offset, d.Err)
+	}
+	return fmt.Sprintf("%s at offset %d: %v", d.File, d.Offset, d.Err)
+}
+
+// RecoveryReport returns the report of the recovery from the WAL files when the DB was opened.
+func (db *DB) RecoveryReport() RecoveryReport {
+	return db.recovery
+}
+
+// walReplay is the result of replayWAL.
+type walReplay struct {
+	// tables are the level 0 SSTables written with the replayed kvs, from the oldest to the newest.
+	tables []*sstable
+	// seqs are the seqs of all KV WAL files in the directory, including the ones already persisted. They can be
+	// removed once tables are added to the version.
+	seqs []Seq
+	// maxSeq is the largest seq seen, either of a WAL file or of a KV.
+	maxSeq Seq
+	report RecoveryReport
+}
+
+// replayWAL replays the KV WAL files in opts.dir that have a sequence number higher than the given seq.
+//
+// This function is called after we rebuild the latest version from the manifest file. All KV WAL files with sequence
+// numbers higher than the version's sequence number are inserted, but not included in the version. We need to re-insert
+// these KVs into the DB.
+//
+// The WAL files are replayed one log at a time in seq order, so that later writes and deletions of a key shadow the
+// earlier ones. Each kv keeps its original seq. The kvs are put into a MemTable without a WAL, which is persisted to a
+// level 0 SSTable whenever it's full, so at most one MemTable and one log are in memory no matter how many WAL files
+// there are. The last MemTable is persisted as well.
+//
+// The SSTables are not in the version yet. The caller adds all of them in a single version log, and removes the WAL
+// files after that. If the server crashes before that, the SSTables are removed by loadLatestVersion on the next
+// recovery, and the WAL files are replayed again from the start.
+//
+// Each log in the WAL files is a WriteBatch. A damaged log, either incomplete because the server crashed while
+// writing the batch, or corrupted, is handled according to mode. The batch is always dropped as a whole. What's
+// dropped is listed in the report.
+func replayWAL(opts *tableOptions, since Seq, mode WALRecoveryMode, capacity int, genIter *GenIter) (_ *walReplay, err error) {
+	ret := &walReplay{report: RecoveryReport{Mode: mode}}
+	defer func() {
+		if err != nil {
+			for _, st := range ret.tables {
+				st.unref()
+			}
+		}
+	}()
+
+	seqs, err := kvLogSeqs(opts.fs, opts.dir)
+	if err != nil {
+		return nil, err
+	}
+	// We collect all seqs, no matter if they are higher than since, because we need to remove all these WAL files
+	// after the KVs are re-inserted.
+	ret.seqs = seqs
+	var pending []Seq
+	for _, seq := range seqs {
+		ret.maxSeq = max(ret.maxSeq, seq)
+		if seq > since {
+			pending = append(pending, seq)
+		}
+	}
+
+	mem := newReplayMemTable(capacity)
+	flush := func() error {
+		if mem.isEmpty() {
+			return nil
+		}
+		st, err := mem.persist(opts, genIter.NextGen())
+		if err != nil {
+			return err
+		}
+		ret.tables = append(ret.tables, st)
+		ret.report.Tables++
+		mem = newReplayMemTable(capacity)
+		return nil
+	}
+
+	// stopped is set once the recovery stops at a damaged log. All logs after it are dropped.
+	stopped := false
+	for i, seq := range pending {
+		file := kvLogFile(opts.dir, seq)
+		if stopped {
+			ret.report.Dropped = append(ret.report.Dropped, DroppedWAL{File: file, ToEnd: true, Err: errPrecedingDropped})
+			continue
+		}
+		// A WAL file listed but missing has acknowledged writes, which can't be recovered. It's never skipped.
+		logIter, err := newKVLogIter(opts.fs, opts.dir, seq)
+		if err != nil {
+			return nil, err
+		}
+		for logIter.Next() {
+			kvLog := &kvLog{}
+			if err := logIter.Read(kvLog); err != nil {
+				d, incomplete, ok := droppedWAL(file, err)
+				if !ok || mode == AbsoluteConsistency || (mode == TolerateCorruptedTail && !incomplete) {
+					_ = logIter.Close()
+					return nil, err
+				}
+				// We don't need to truncate the WAL file since the file would be deleted.
+				if mode != SkipAnyCorrupted {
+					d.ToEnd, stopped = true, true
+				}
+				ret.report.Dropped = append(ret.report.Dropped, d)
+				if stopped {
+					break
+				}
+				continue
+			}
+			mem.replay(kvLog)
+			for _, kv := range kvLog.kvs {
+				ret.maxSeq = max(ret.maxSeq, kv.key.seq)
+			}
+			ret.report.RecoveredBatches++
+			if mem.isFull() {
+				if err := flush(); err != nil {
+					_ = logIter.Close()
+					return nil, err
+				}
+			}
+		}
+		_ = logIter.Close()
+		log.Printf("WAL recovery replayed %s (%d/%d): %d batches, %d tables so far\n", file, i+1, len(pending), ret.report.RecoveredBatches, ret.report.Tables)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// kvLogSeqs returns the seqs of the KV WAL files in dir in ascending order.
+func kvLogSeqs(fs vfs.FS, dir string) ([]Seq, error) {
+	wals, err := fs.Glob(filepath.Join(dir, "*"+walExtension))
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []Seq
+	for _, wal := range wals {
+		if wal == versionLogFile(dir) {
+			continue
+		}
+		base := path.Base(wal)
+		seq, err := strconv.ParseInt(strings.TrimSuffix(base, walExtension), 10, 64)
+		if err != nil {
+			log.Printf("fail to parse wal %q: %v\n", wal, err)
+			continue
+		}
+		seqs = append(seqs, Seq(seq))
+	}
+	sort.Slice(seqs, func(i, j int) bool {
+		return seqs[i] < seqs[j]
+	})
+	return seqs, nil
+}
+
+// droppedWAL returns what's dropped from the WAL file because of err, and whether it's an incomplete log at the
+// end of the file. It returns false if err isn't caused by a damaged log, e.g. an I/O error.
+func droppedWAL(file string, err error) (_ DroppedWAL, incomplete bool, ok bool) {
+	ierr := &incompleteLogError{}
+	if errors.As(err, &ierr) {
+		return DroppedWAL{File: file, Offset: int64(ierr.valid), ToEnd: true, Err: err}, true, true
+	}
+	cerr := &LogCorruptionError{}
+	if errors.As(err, &cerr) {
+		return DroppedWAL{File: file, Offset: cerr.Offset, Err: err}, false, true
+	}
+	return DroppedWAL{}, false, false
+}
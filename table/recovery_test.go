@@ -0,0 +1,318 @@
+package table
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/liznear/leveldb-from-scratch/vfs"
+)
+
+// writeTestWAL writes the KV WAL with seq. Each of logs is either a key, which is put with its seq, or raw bytes
+// of a corrupted log. If tear > 0, the last tear bytes are dropped.
+func writeTestWAL(t *testing.T, fs vfs.FS, seq Seq, logs []any, tear int) {
+	t.Helper()
+	var data []byte
+	for i, l := range logs {
+		var buf bytes.Buffer
+		switch l := l.(type) {
+		case string:
+			b := &WriteBatch{}
+			b.Put(l, []byte(l))
+			if _, err := newKVLog(seq+Seq(i), b).write(&buf); err != nil {
+				t.Fatal(err)
+			}
+		case []byte:
+			buf.Write(l)
+		}
+		data = appendRecord(data, int64(len(data)), buf.Bytes())
+	}
+	f, err := fs.OpenFile(kvLogFile(".", seq), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data[:len(data)-tear]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDB_WALRecoveryMode(t *testing.T) {
+	garbage := []byte{0xff, 0xff}
+	// The offset of the garbage log in the first WAL, after two logs with 1 kv of 4 bytes.
+	garbageOffset := int64(2 * (logHeaderSize + 4 + sizeOnDisk("Key0", []byte("Key0"))))
+
+	type dropped struct {
+		file   string
+		offset int64
+		toEnd  bool
+	}
+	tcs := []struct {
+		name string
+		mode WALRecoveryMode
+		// tear is the number of bytes torn from the end of the second WAL.
+		tear        int
+		wantErr     bool
+		wantKeys    []string
+		wantDropped []dropped
+	}{
+		{
+			name:    "Corrupted/AbsoluteConsistency",
+			mode:    AbsoluteConsistency,
+			wantErr: true,
+		},
+		{
+			name:    "Corrupted/TolerateCorruptedTail",
+			mode:    TolerateCorruptedTail,
+			wantErr: true,
+		},
+		{
+			name:     "Corrupted/PointInTime",
+			mode:     PointInTime,
+			wantKeys: []string{"Key0", "Key1"},
+			wantDropped: []dropped{
+				{file: kvLogFile(".", 1), offset: garbageOffset, toEnd: true},
+				{file: kvLogFile(".", 10), offset: 0, toEnd: true},
+			},
+		},
+		{
+			name:     "Corrupted/SkipAnyCorrupted",
+			mode:     SkipAnyCorrupted,
+			wantKeys: []string{"Key0", "Key1", "Key2", "Key3", "Key4"},
+			wantDropped: []dropped{
+				{file: kvLogFile(".", 1), offset: garbageOffset},
+			},
+		},
+		{
+			name:    "TornTail/AbsoluteConsistency",
+			mode:    AbsoluteConsistency,
+			tear:    3,
+			wantErr: true,
+		},
+		{
+			name:     "TornTail/TolerateCorruptedTail",
+			mode:     TolerateCorruptedTail,
+			tear:     3,
+			wantKeys: []string{"Key0", "Key1", "Key2", "Key3"},
+			wantDropped: []dropped{
+				{file: kvLogFile(".", 10), offset: logHeaderSize + 4 + int64(sizeOnDisk("Key3", []byte("Key3"))), toEnd: true},
+			},
+		},
+		{
+			name:     "TornTail/SkipAnyCorrupted",
+			mode:     SkipAnyCorrupted,
+			tear:     3,
+			wantKeys: []string{"Key0", "Key1", "Key2", "Key3"},
+			wantDropped: []dropped{
+				{file: kvLogFile(".", 10), offset: logHeaderSize + 4 + int64(sizeOnDisk("Key3", []byte("Key3"))), toEnd: true},
+			},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := vfs.NewMem()
+			first := []any{"Key0", "Key1", "Key2"}
+			if tc.tear == 0 {
+				// Put the garbage log before Key2.
+				first = []any{"Key0", "Key1", garbage, "Key2"}
+			}
+			writeTestWAL(t, fs, 1, first, 0)
+			writeTestWAL(t, fs, 10, []any{"Key3", "Key4"}, tc.tear)
+
+			db, err := NewDB(WithFS(fs), WithWALRecoveryMode(tc.mode))
+			if tc.wantErr {
+				if !errors.Is(err, ErrCorruption) {
+					t.Fatalf("Got error %v, want %v", err, ErrCorruption)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			want := map[string]string{}
+			for _, k := range tc.wantKeys {
+				want[k] = k
+			}
+			verifyKVs(t, db, want)
+			for i := 0; i < 5; i++ {
+				k := fmt.Sprintf("Key%d", i)
+				if _, ok := want[k]; ok {
+					continue
+				}
+				if _, ok, err := db.Get(k); err != nil || ok {
+					t.Errorf("Got %s, %v, want it dropped", k, err)
+				}
+			}
+
+			report := db.RecoveryReport()
+			if report.Mode != tc.mode || report.RecoveredBatches != len(tc.wantKeys) {
+				t.Errorf("Got mode %s, %d batches, want %s, %d", report.Mode, report.RecoveredBatches, tc.mode, len(tc.wantKeys))
+			}
+			var got []dropped
+			for _, d := range report.Dropped {
+				if d.Err == nil {
+					t.Errorf("Got no reason to drop %s", d)
+				}
+				got = append(got, dropped{file: d.File, offset: d.Offset, toEnd: d.ToEnd})
+			}
+			if !reflect.DeepEqual(got, tc.wantDropped) {
+				t.Errorf("Got dropped %v, want %v", got, tc.wantDropped)
+			}
+		})
+	}
+}
+
+func TestDB_ReplayWAL(t *testing.T) {
+	fs := vfs.NewMem()
+	const files, keys = 10, 10
+	// The i-th key is set to its file number in every file. In the last file, even keys are deleted.
+	for f := 0; f < files; f++ {
+		seq := Seq(1 + f*100)
+		w, err := newKVLogWriter(fs, ".", seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < keys; i++ {
+			b := &WriteBatch{}
+			b.Put(fmt.Sprintf("Key%d", i), []byte(fmt.Sprintf("Value%d", f)))
+			if f == files-1 && i%2 == 0 {
+				b.Delete(fmt.Sprintf("Key%d", i))
+			}
+			if err := w.Write(newKVLog(seq+Seq(1+i*2), b)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]string{}
+	for i := 1; i < keys; i += 2 {
+		want[fmt.Sprintf("Key%d", i)] = fmt.Sprintf("Value%d", files-1)
+	}
+	verify := func(db *DB) {
+		t.Helper()
+		verifyKVs(t, db, want)
+		for i := 0; i < keys; i += 2 {
+			if v, ok, err := db.Get(fmt.Sprintf("Key%d", i)); err != nil || ok {
+				t.Errorf("Got Key%d=%q, %v, want it deleted", i, v, err)
+			}
+		}
+	}
+
+	opts := []Option{WithFS(fs), WithMaxMemTableSize(100)}
+	db, err := NewDB(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify(db)
+	report := db.RecoveryReport()
+	if report.RecoveredBatches != files*keys || report.Tables <= 1 {
+		t.Errorf("Got %d batches, %d tables, want %d, more than 1", report.RecoveredBatches, report.Tables, files*keys)
+	}
+	// Only the WAL of the new MemTable is left.
+	if wals, err := fs.Glob("*" + walExtension); err != nil || len(wals) != 1 || wals[0] != kvLogFile(".", db.mem.seq) {
+		t.Errorf("Got WAL files %v, %v, want only %s", wals, err, kvLogFile(".", db.mem.seq))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The replayed KVs are in SSTables now.
+	db, err = NewDB(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	verify(db)
+	if report := db.RecoveryReport(); report.RecoveredBatches != 0 {
+		t.Errorf("Got %d batches, want 0", report.RecoveredBatches)
+	}
+}
+
+func TestDB_ReplayWALBacklog(t *testing.T) {
+	fs := vfs.NewMem()
+	const files, keys = 50, 20
+	// Every file sets all keys, so all recovered SSTables overlap.
+	for f := 0; f < files; f++ {
+		seq := Seq(1 + f*100)
+		w, err := newKVLogWriter(fs, ".", seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < keys; i++ {
+			b := &WriteBatch{}
+			b.Put(fmt.Sprintf("Key%02d", i), []byte(fmt.Sprintf("Value%d", f)))
+			if err := w.Write(newKVLog(seq+Seq(1+i), b)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]string{}
+	for i := 0; i < keys; i++ {
+		want[fmt.Sprintf("Key%02d", i)] = fmt.Sprintf("Value%d", files-1)
+	}
+
+	opts := []Option{WithFS(fs), WithMaxMemTableSize(200), WithCompactionConfig(1, 10)}
+	db, err := NewDB(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyKVs(t, db, want)
+	if report := db.RecoveryReport(); report.Tables <= maxCompactionTables {
+		t.Fatalf("Got %d tables, want more than %d", report.Tables, maxCompactionTables)
+	}
+	// Close waits for the compaction of the recovered SSTables.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The L0 SSTables, and the SSTables on the next level read one after another.
+	if got := db.maxCompactionWidth.Load(); got > maxCompactionTables+1 {
+		t.Errorf("Got %d iterators merged at once, want at most %d", got, maxCompactionTables+1)
+	}
+
+	db, err = NewDB(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	verifyKVs(t, db, want)
+	if got := db.version.levels[0].Size(); got > 1 {
+		t.Errorf("Got %d SSTables on level 0, want at most 1", got)
+	}
+}
+
+func TestDB_ReplayWALMissingFile(t *testing.T) {
+	fs := vfs.NewFault()
+	writeTestWAL(t, fs, 1, []any{"Key0"}, 0)
+	writeTestWAL(t, fs, 10, []any{"Key1"}, 0)
+
+	// The first WAL file vanishes after it's listed.
+	fs.InjectError(func(op vfs.Op, name string) error {
+		if op == vfs.OpOpen && name == kvLogFile(".", 1) {
+			return os.ErrNotExist
+		}
+		return nil
+	})
+	if _, err := NewDB(WithFS(fs), WithWALRecoveryMode(SkipAnyCorrupted)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Got error %v, want %v", err, os.ErrNotExist)
+	}
+	fs.InjectError(nil)
+
+	// Nothing is removed, so the later WAL file is still recovered.
+	db, err := NewDB(WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	verifyKVs(t, db, map[string]string{"Key0": "Key0", "Key1": "Key1"})
+}
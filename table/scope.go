@@ -15,6 +15,12 @@ func (s *scope) contains(v string) bool {
 	return s.min <= v && v <= s.max
 }
 
+// overlapsRange returns whether the scope has overlaps with the range [start, end). An empty end means the
+// range has no upper bound.
+func (s *scope) overlapsRange(start, end string) bool {
+	return s.max >= start && (end == "" || s.min < end)
+}
+
 func fusion(scopes []*scope) *scope {
 	if len(scopes) == 0 {
 		return nil
@@ -94,3 +94,28 @@ func TestScope_HasOverlap(t *testing.T) {
 		})
 	}
 }
+
+func TestScope_OverlapsRange(t *testing.T) {
+	tcs := []struct {
+		name  string
+		start string
+		end   string
+		want  bool
+	}{
+		{name: "Inside", start: "Key2", end: "Key3", want: true},
+		{name: "Cover", start: "Key0", end: "Key9", want: true},
+		{name: "Before", start: "A", end: "B", want: false},
+		{name: "EndIsExclusive", start: "Key0", end: "Key1", want: false},
+		{name: "StartIsInclusive", start: "Key4", end: "Key9", want: true},
+		{name: "After", start: "Key5", end: "Key9", want: false},
+		{name: "NoUpperBound", start: "Key3", end: "", want: true},
+	}
+	s := newScope("Key1", "Key4")
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := s.overlapsRange(tc.start, tc.end); got != tc.want {
+				t.Errorf("Got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
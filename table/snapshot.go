@@ -0,0 +1,62 @@
+package table
+
+// Snapshot is a point-in-time view of the DB. Reads with a snapshot see the DB as it was when the snapshot was
+// taken, no matter what is written after that.
+//
+// A snapshot must be released by DB.ReleaseSnapshot once it is no longer used. Until then, compaction keeps
+// all versions of keys visible to it.
+type Snapshot struct {
+	seq Seq
+}
+
+// ReadOptions controls the behavior of reads.
+type ReadOptions struct {
+	// Snapshot makes the read see the DB as of the snapshot. If it's nil, the read sees the latest data.
+	Snapshot *Snapshot
+	// VerifyChecksums makes the read verify the checksums of the SSTable data blocks it reads, and fail with
+	// ErrCorruption on a mismatch. Checksums of the index, filter and metadata blocks are always verified, and
+	// so are the checksums of data blocks read by compaction.
+	VerifyChecksums bool
+}
+
+// GetSnapshot returns a snapshot of the current state of the DB.
+func (db *DB) GetSnapshot() *Snapshot {
+	db.snapshotsMu.Lock()
+	defer db.snapshotsMu.Unlock()
+
+	s := &Snapshot{seq: Seq(db.lastSeq.Load())}
+	db.snapshots[s] = struct{}{}
+	return s
+}
+
+// ReleaseSnapshot releases the snapshot. The snapshot can't be used after it is released.
+func (db *DB) ReleaseSnapshot(s *Snapshot) {
+	db.snapshotsMu.Lock()
+	defer db.snapshotsMu.Unlock()
+
+	delete(db.snapshots, s)
+}
+
+// smallestSnapshot returns the seq of the oldest live snapshot. If there is no live snapshot, it's the seq of
+// the latest write.
+//
+// A snapshot taken after this call has a seq no smaller than the returned one, so compaction can safely drop
+// versions shadowed by a newer version with seq <= the returned seq.
+func (db *DB) smallestSnapshot() Seq {
+	db.snapshotsMu.Lock()
+	defer db.snapshotsMu.Unlock()
+
+	smallest := Seq(db.lastSeq.Load())
+	for s := range db.snapshots {
+		smallest = min(smallest, s.seq)
+	}
+	return smallest
+}
+
+// readSeq returns the seq a read with opts should see.
+func (db *DB) readSeq(opts ReadOptions) Seq {
+	if opts.Snapshot != nil {
+		return opts.Snapshot.seq
+	}
+	return Seq(db.lastSeq.Load())
+}
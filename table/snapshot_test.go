@@ -0,0 +1,148 @@
+package table
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/liznear/leveldb-from-scratch/vfs"
+)
+
+func TestDB_Snapshot(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := NewDB(
+		WithFS(fs),
+		WithMaxMemTableSize(100),
+		WithMaxSSTableSize(100),
+		WithCompactionConfig(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	c := 20
+	write := func(format string) {
+		for i := 0; i < c; i++ {
+			if err := db.Put(fmt.Sprintf("Key%02d", i), []byte(fmt.Sprintf(format, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	write("Value%d")
+	s1 := db.GetSnapshot()
+	defer db.ReleaseSnapshot(s1)
+
+	write("NewValue%d")
+	for i := 0; i < c; i += 2 {
+		if err := db.Remove(fmt.Sprintf("Key%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s2 := db.GetSnapshot()
+	defer db.ReleaseSnapshot(s2)
+
+	// Writes after the snapshots trigger flushes and compactions, which must keep the versions visible to
+	// the snapshots.
+	write("LatestValue%d")
+	db.waitPersist()
+
+	tcs := []struct {
+		name string
+		opts ReadOptions
+		want func(i int) (string, bool)
+	}{
+		{
+			name: "FirstSnapshot",
+			opts: ReadOptions{Snapshot: s1},
+			want: func(i int) (string, bool) {
+				return fmt.Sprintf("Value%d", i), true
+			},
+		},
+		{
+			name: "SecondSnapshot",
+			opts: ReadOptions{Snapshot: s2},
+			want: func(i int) (string, bool) {
+				return fmt.Sprintf("NewValue%d", i), i%2 == 1
+			},
+		},
+		{
+			name: "Latest",
+			want: func(i int) (string, bool) {
+				return fmt.Sprintf("LatestValue%d", i), true
+			},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			var wantKeys, wantValues []string
+			for i := 0; i < c; i++ {
+				key := fmt.Sprintf("Key%02d", i)
+				want, wantOk := tc.want(i)
+				got, ok, err := db.GetWithOptions(key, tc.opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok != wantOk {
+					t.Errorf("Got found %v for %q, want %v", ok, key, wantOk)
+					continue
+				}
+				if ok && string(got) != want {
+					t.Errorf("Got %q for %q, want %q", got, key, want)
+				}
+				if wantOk {
+					wantKeys = append(wantKeys, key)
+					wantValues = append(wantValues, want)
+				}
+			}
+
+			iter := db.NewIteratorWithOptions(tc.opts)
+			defer iter.Close()
+			var gotKeys, gotValues []string
+			for iter.Last(); iter.Valid(); iter.Prev() {
+				gotKeys = append([]string{iter.Key()}, gotKeys...)
+				gotValues = append([]string{string(iter.Value())}, gotValues...)
+			}
+			if err := iter.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(gotKeys) != fmt.Sprint(wantKeys) {
+				t.Errorf("Got keys %v, want %v", gotKeys, wantKeys)
+			}
+			if fmt.Sprint(gotValues) != fmt.Sprint(wantValues) {
+				t.Errorf("Got values %v, want %v", gotValues, wantValues)
+			}
+		})
+	}
+}
+
+func TestDB_SmallestSnapshot(t *testing.T) {
+	db, err := NewDB(WithFS(vfs.NewMem()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("Key1", []byte("Value1")); err != nil {
+		t.Fatal(err)
+	}
+	s1 := db.GetSnapshot()
+	if err := db.Put("Key2", []byte("Value2")); err != nil {
+		t.Fatal(err)
+	}
+	s2 := db.GetSnapshot()
+	if err := db.Put("Key3", []byte("Value3")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := db.smallestSnapshot(); got != s1.seq {
+		t.Errorf("Got smallest snapshot %d, want %d", got, s1.seq)
+	}
+	db.ReleaseSnapshot(s1)
+	if got := db.smallestSnapshot(); got != s2.seq {
+		t.Errorf("Got smallest snapshot %d, want %d", got, s2.seq)
+	}
+	db.ReleaseSnapshot(s2)
+	if got, want := db.smallestSnapshot(), Seq(db.lastSeq.Load()); got != want {
+		t.Errorf("Got smallest snapshot %d, want %d", got, want)
+	}
+}
@@ -1,12 +1,19 @@
 package table
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 
 	"github.com/liznear/leveldb-from-scratch/utils"
+	"github.com/liznear/leveldb-from-scratch/vfs"
 )
 
 // Level is the level of the SSTable. It is used for compaction.
@@ -16,142 +23,342 @@ type Level byte
 
 const sstableExtension = ".sstable"
 
+// tableOptions are the options to write and read SSTables. They are shared by all SSTables of a DB.
+type tableOptions struct {
+	fs  vfs.FS
+	dir string
+	// blockSize is the size of data blocks before they are finished. A block may be larger than it if its
+	// last kv is large.
+	blockSize int
+	// restartInterval is the number of keys between restart points in data blocks.
+	restartInterval int
+	// filterBitsPerKey is the number of bits for each key in the bloom filter. No filter is written if it's 0.
+	filterBitsPerKey int
+	// compression is the compressor of the blocks of SSTables on each level. nil means no compression.
+	compression [maxLevels]Compressor
+	// compressors can decompress the blocks of all SSTables.
+	compressors compressors
+
+	// tables caches the readers of SSTables. It's nil if the table cache is disabled.
+	tables *tableCache
+	// cache caches data blocks read by point lookups. It's nil if the block cache is disabled.
+	cache *blockCache
+	// stats collects the statistics of reading SSTables.
+	stats *tableStats
+}
+
+// tableStats are the statistics of reading SSTables.
+type tableStats struct {
+	// filterHits is the number of lookups the bloom filters couldn't rule out.
+	filterHits atomic.Int64
+	// filterMisses is the number of lookups the bloom filters ruled out, which don't read any data block.
+	filterMisses atomic.Int64
+}
+
 // SSTable is a reference to the actual SSTable file on disk.
 // It only includes the metadata of the SSTable.
 type sstable struct {
+	opts  *tableOptions
 	gen   Gen
 	level Level
 	scope *scope
+
+	// refs is the number of references to the SSTable. Versions hold one reference, and every iterator
+	// reading the SSTable holds one. The file is removed once there are no references.
+	refs atomic.Int32
 }
 
-// newSSTable creates a new SSTable file with the given kvs. It returns the SSTable
+// newSSTable creates a new SSTable file in opts.dir with the given kvs. It returns the SSTable
 // reference and the error.
-func newSSTable(gen Gen, level Level, kvs []kv) (*sstable, error) {
+func newSSTable(opts *tableOptions, gen Gen, level Level, kvs []kv) (*sstable, error) {
 	t := &sstable{
+		opts:  opts,
 		gen:   gen,
 		level: level,
 		scope: newScope(kvs[0].key.data, kvs[len(kvs)-1].key.data),
 	}
-	filename := sstableFilename(gen)
-	if _, err := os.Stat(filename); err == nil {
+	t.refs.Store(1)
+	filename := sstableFilename(opts.dir, gen)
+	if _, err := opts.fs.Stat(filename); err == nil {
 		return nil, fmt.Errorf("sstable: file %s already exists", filename)
 	}
-	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0644)
+	f, err := opts.fs.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("sstable: fail to open file %s: %w", filename, err)
 	}
 	defer f.Close()
-	if err := write(f, t.level, kvs); err != nil {
+	if err := write(f, opts, t.level, kvs); err != nil {
 		return nil, err
 	}
+	// The SSTable would be recorded in the version log once it's created. Make sure it's on the disk before
+	// that, otherwise it could be lost in a crash while the version still refers to it.
+	if err := f.Sync(); err != nil {
+		return nil, fmt.Errorf("sstable: fail to sync file %s: %w", filename, err)
+	}
 	return t, nil
 }
 
-func (t *sstable) load() (io.ReadSeekCloser, error) {
-	return os.Open(sstableFilename(t.gen))
+func (t *sstable) load() (vfs.File, error) {
+	return vfs.Open(t.opts.fs, sstableFilename(t.opts.dir, t.gen))
 }
 
-// loadSSTable loads an existing SSTable file.
-func loadSSTable(gen Gen) (*sstable, error) {
-	file, err := os.Open(sstableFilename(gen))
+// loadSSTable loads an existing SSTable file in opts.dir.
+func loadSSTable(opts *tableOptions, gen Gen) (*sstable, error) {
+	file, err := vfs.Open(opts.fs, sstableFilename(opts.dir, gen))
 	if err != nil {
 		return nil, fmt.Errorf("sstable[%d]: fail to open: %w", gen, err)
 	}
 	defer file.Close()
 
 	footer := &footer{}
-	if err := loadFooter(file, footer); err != nil {
-		return nil, fmt.Errorf("sstable[%d]: %w", gen, err)
+	if err := loadFooter(file, gen, footer); err != nil {
+		return nil, err
 	}
 
 	metadata := &Metadata{}
-	if err := loadMetadata(file, metadata, footer); err != nil {
-		return nil, fmt.Errorf("sstable[%d]: %w", gen, err)
+	if err := loadMetadata(file, opts.compressors, gen, metadata, footer); err != nil {
+		return nil, err
 	}
 
-	return &sstable{
+	t := &sstable{
+		opts:  opts,
 		gen:   gen,
 		level: footer.level,
 		scope: newScope(metadata.min, metadata.max),
-	}, nil
+	}
+	t.refs.Store(1)
+	return t, nil
+}
+
+// ref adds a reference to the SSTable, so that its file is kept until unref is called.
+func (t *sstable) ref() {
+	t.refs.Add(1)
+}
+
+// unref drops a reference to the SSTable. The file is removed when the last reference is dropped, and its reader
+// and blocks are evicted from the table cache and the block cache.
+func (t *sstable) unref() {
+	if t.refs.Add(-1) == 0 {
+		_ = t.opts.fs.Remove(sstableFilename(t.opts.dir, t.gen))
+		if t.opts.tables != nil {
+			t.opts.tables.evict(t.gen)
+		}
+		if t.opts.cache != nil {
+			t.opts.cache.evictTable(t.gen)
+		}
+	}
 }
 
-func sstableFilename(gen Gen) string {
-	return fmt.Sprintf("%d%s", gen, sstableExtension)
+func sstableFilename(dir string, gen Gen) string {
+	return filepath.Join(dir, fmt.Sprintf("%d%s", gen, sstableExtension))
 }
 
 func (t *sstable) footer() (*footer, error) {
-	r, err := t.load()
+	r, err := t.open()
 	if err != nil {
-		return nil, fmt.Errorf("sstable: fail to open file %s: %w", sstableFilename(t.gen), err)
-	}
-	footer := &footer{}
-	if err := loadFooter(r, footer); err != nil {
-		return nil, fmt.Errorf("sstable: fail to load footer from %s: %w", sstableFilename(t.gen), err)
+		return nil, err
 	}
-	return footer, nil
+	defer r.release()
+
+	footer := r.footer
+	return &footer, nil
 }
 
+// kvs reads all kvs in the SSTable. Checksums of all blocks are verified.
 func (t *sstable) kvs() ([]kv, error) {
-	r, err := t.load()
+	return t.scan(true)
+}
+
+// scan reads all kvs in the SSTable. Checksums of data blocks are verified only if verify is true.
+//
+// Blocks read by scan are not added to the block cache, so that scanning large SSTables (e.g. by compaction)
+// doesn't evict the blocks read by point lookups.
+func (t *sstable) scan(verify bool) ([]kv, error) {
+	r, err := t.open()
 	if err != nil {
 		return nil, err
 	}
-	defer r.Close()
+	defer r.release()
 
-	_, err = r.Seek(-footerSize, io.SeekEnd)
-	if err != nil {
-		return nil, fmt.Errorf("sstable: fail to seek to the start of footer: %w", err)
-	}
-	f := footer{}
-	if err := f.read(r); err != nil {
-		return nil, fmt.Errorf("sstable: fail to read footer: %w", err)
+	var kvs []kv
+	it := r.index.iter()
+	for it.next() {
+		b, err := r.block(&it.kv, verify, false)
+		if err != nil {
+			return nil, err
+		}
+		bkvs, err := b.kvs()
+		if err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, bkvs...)
 	}
-
-	_, err = r.Seek(0, io.SeekStart)
-	if err != nil {
-		return nil, fmt.Errorf("sstable: fail to seek to the start of data: %w", err)
+	if it.err != nil {
+		return nil, it.err
 	}
-	return readKVs(io.LimitReader(r, int64(f.indexOffset)))
+	return kvs, nil
 }
 
-// get returns the value of the key if exists. If no value is found, ok would be false.
+// get returns the value of the key as of seq if exists. If no value is found, ok would be false.
 //
 // Note that if a key is deleted, ok would still be true. The caller should check the value's
 // deleted field.
 //
-// TODO: it could be optimized
-//   - Since kvs are sorted, we can stop if the key is greater than the target key.
-//   - We haven't built the index or metadata
-//   - We haven't built the bloom filter
-//   - We can cache the data in memory
-func (t *sstable) get(key string) (v value, ok bool, err error) {
+// The bloom filter is checked first. Only if it can't rule out the key, the data block which may contain the key
+// is read. Its checksum is verified only if verify is true.
+func (t *sstable) get(key string, seq Seq, verify bool) (v value, ok bool, err error) {
 	if !t.scope.contains(key) {
 		return value{}, false, nil
 	}
-	kvs, err := t.kvs()
+	r, err := t.open()
 	if err != nil {
-		return value{}, false, fmt.Errorf("sstable: fail to read kvs: %w", err)
+		return value{}, false, err
 	}
-	for _, kv := range kvs {
-		if kv.key.data == key {
-			return kv.value, true, nil
+	defer r.release()
+
+	if r.filter != nil {
+		if !r.filter.mayContain(key) {
+			t.opts.stats.filterMisses.Add(1)
+			return value{}, false, nil
 		}
+		t.opts.stats.filterHits.Add(1)
 	}
-	return value{}, false, nil
+
+	// Versions of a key are sorted by seq in descending order, so the first kv not less than target is the
+	// newest visible version of the key if there is any. The first block whose last key is not less than target
+	// is the only block which may have it.
+	target := newInternalKey(key, seq)
+	e, err := r.index.seek(target)
+	if err != nil {
+		return value{}, false, err
+	}
+	if e == nil {
+		return value{}, false, nil
+	}
+	b, err := r.block(e, verify, true)
+	if err != nil {
+		return value{}, false, err
+	}
+	kv, err := b.seek(target)
+	if err != nil {
+		return value{}, false, err
+	}
+	if kv == nil || kv.key.data != key {
+		return value{}, false, nil
+	}
+	return kv.value, true, nil
+}
+
+// tableReader reads blocks from an opened SSTable file.
+type tableReader struct {
+	t      *sstable
+	f      vfs.File
+	footer footer
+	index  *block
+	// filter is nil if the SSTable has no filter.
+	filter bloomFilter
+
+	// refs is the number of references to the reader. The file is closed when the last reference is released.
+	refs atomic.Int32
 }
 
-// write writes the given kvs to the writer as an SSTable. kvs must be already sorted by keys.
+// open returns a reader of the SSTable from the table cache, or a new one if the table cache is disabled. The
+// caller must release the reader after use.
+func (t *sstable) open() (*tableReader, error) {
+	if t.opts.tables != nil {
+		return t.opts.tables.get(t)
+	}
+	return newTableReader(t)
+}
+
+// newTableReader opens the SSTable file and loads its footer, index block and filter block. Their checksums are
+// always verified, since they are used by all reads. The reader has one reference held for the caller.
+func newTableReader(t *sstable) (_ *tableReader, err error) {
+	f, err := t.load()
+	if err != nil {
+		return nil, fmt.Errorf("sstable[%d]: fail to open: %w", t.gen, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+		}
+	}()
+
+	r := &tableReader{t: t, f: f}
+	r.refs.Store(1)
+	if err := loadFooter(f, t.gen, &r.footer); err != nil {
+		return nil, err
+	}
+	r.index, err = readBlock(f, t.opts.compressors, t.gen, r.footer.index, true)
+	if err != nil {
+		return nil, fmt.Errorf("sstable[%d]: fail to load index: %w", t.gen, err)
+	}
+	if r.footer.filter.length > 0 {
+		r.filter, err = readBlockData(f, t.opts.compressors, t.gen, r.footer.filter, true)
+		if err != nil {
+			return nil, fmt.Errorf("sstable[%d]: fail to load filter: %w", t.gen, err)
+		}
+	}
+	return r, nil
+}
+
+// block reads the data block pointed by the index entry e. The block is looked up in the block cache first. If
+// it's read from the file, its checksum is verified if verify is true, and it's added to the cache if fillCache
+// is true.
+//
+// Blocks in the cache are not verified again, even if they were read without verifying their checksums.
+func (r *tableReader) block(e *kv, verify, fillCache bool) (*block, error) {
+	h, err := decodeBlockHandle(e.value.data, r.footer.version)
+	if err != nil {
+		return nil, &CorruptionError{Gen: r.t.gen, Offset: int64(r.footer.index.offset), Err: err}
+	}
+	cache := r.t.opts.cache
+	k := blockCacheKey{gen: r.t.gen, offset: h.offset}
+	if cache != nil {
+		if b, ok := cache.get(k); ok {
+			return b, nil
+		}
+	}
+	b, err := readBlock(r.f, r.t.opts.compressors, r.t.gen, h, verify)
+	if err != nil {
+		return nil, err
+	}
+	if cache != nil && fillCache {
+		cache.put(k, b)
+	}
+	return b, nil
+}
+
+func (r *tableReader) ref() {
+	r.refs.Add(1)
+}
+
+// release drops a reference to the reader. The file is closed when the last reference is dropped.
+func (r *tableReader) release() {
+	if r.refs.Add(-1) == 0 {
+		_ = r.f.Close()
+	}
+}
+
+// write writes the given kvs to the writer as an SSTable. kvs must be already sorted by internal keys.
 //
 // # The SSTable on disk looks like this
 //
-// - data block.
-// - if value length == uint.max, it means the kv is deleted.
-// | key1 length   (4 bytes big endian uint) | key1    |
-// | value1 length (4 bytes big endian uint) | value1  |
-// | key2 length ...                         |
+// - data blocks.
+// kvs are split into blocks of about blockSize bytes, see blockBuilder for the format. Versions of a key may be
+// in different blocks.
+//
+// Every block, including the index, filter and metadata blocks, is followed by a trailer with its compression ID
+// and checksum. See blockTrailerSize. Data and index blocks are compressed with the compressor of the level.
 //
 // - index block
+// It has the same format as data blocks. There is one kv for each data block, its key is the last internal
+// key of the block, and its value is the handle of the block.
+// | block offset  (8 bytes big endian uint) |
+// | block length  (8 bytes big endian uint) |
+//
+// - filter block
+// A bloom filter of all keys, see bloomFilter. It's empty if the filter is disabled.
 //
 // - metadata block
 // | min key length (4 bytes big endian uint) | min key value |
@@ -159,34 +366,108 @@ func (t *sstable) get(key string) (v value, ok bool, err error) {
 //
 // - footer block (has fixed size)
 // | level           (1 byte uint) |
-// | index offset    (4 bytes big endian uint) |
-// | index length    (4 bytes big endian uint) |
-// | metadata offset (4 bytes big endian uint) |
-// | metadata length (4 bytes big endian uint) |
+// | index offset    (8 bytes big endian uint) |
+// | index length    (8 bytes big endian uint) |
+// | metadata offset (8 bytes big endian uint) |
+// | metadata length (8 bytes big endian uint) |
+// | filter offset   (8 bytes big endian uint) |
+// | filter length   (8 bytes big endian uint) |
+// | checksum        (4 bytes big endian uint, CRC32C of the fields above) |
+// | format version  (4 bytes big endian uint) |
+// | magic number    (8 bytes big endian uint) |
 //
-// We write the data block at first. While writing, we can calculate the index and metadata in memory.
+// This is the layout of the latest format version. See formatVersion for older ones.
+//
+// We write the data blocks at first. While writing, we can calculate the index and metadata in memory.
 // After writing the index and metadata, we have the foot data.
 //
 // While reading, we first seek to the file end - footer size to load the footer only. With footer
-// information, we can load index and metadata without loading all actual data.
-func write(w io.Writer, lvl Level, kvs []kv) error {
-	var dataLen uint32 = 0
-	for _, kv := range kvs {
-		n, err := kv.write(w)
+// information, we can load the index and metadata without loading all actual data. With the index, we can
+// find the only data block which may contain a key.
+func write(w io.Writer, opts *tableOptions, lvl Level, kvs []kv) error {
+	return writeVersion(w, opts, lvl, kvs, latestFormatVersion)
+}
+
+// writeVersion writes the given kvs to the writer as an SSTable of version v. The DB always writes the latest
+// version, older ones are only written by tests to make sure they can still be read.
+func writeVersion(w io.Writer, opts *tableOptions, lvl Level, kvs []kv, v formatVersion) error {
+	c := opts.compression[lvl]
+	if c == nil {
+		c = NoCompression
+	}
+	var offset uint64 = 0
+	data := newBlockBuilder(opts.restartInterval)
+	// Index entries are looked up by binary search, so every entry is a restart point.
+	index := newBlockBuilder(1)
+	flush := func() error {
+		h, err := writeBlock(w, offset, data.finish(), c)
+		if err != nil {
+			return fmt.Errorf("sstable: fail to write data block: %w", err)
+		}
+		index.add(&kv{key: data.last, value: newValue(h.encode(v))})
+		offset = h.end()
+		data.reset()
+		return nil
+	}
+	for i := range kvs {
+		data.add(&kvs[i])
+		if data.size() >= opts.blockSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if !data.empty() {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+
+	indexHandle, err := writeBlock(w, offset, index.finish(), c)
+	if err != nil {
+		return fmt.Errorf("sstable: fail to write index block: %w", err)
+	}
+	offset = indexHandle.end()
+
+	filterHandle := blockHandle{offset: offset}
+	if opts.filterBitsPerKey > 0 {
+		var keys []string
+		for i := range kvs {
+			// Versions of a key are adjacent.
+			if i == 0 || kvs[i].key.data != kvs[i-1].key.data {
+				keys = append(keys, kvs[i].key.data)
+			}
+		}
+		// Bits of filters are random, they can't be compressed.
+		filterHandle, err = writeBlock(w, offset, newBloomFilter(keys, opts.filterBitsPerKey), NoCompression)
 		if err != nil {
-			return fmt.Errorf("sstable: fail to write kv %v: %w", kv, err)
+			return fmt.Errorf("sstable: fail to write filter block: %w", err)
 		}
-		dataLen += uint32(n)
+		offset = filterHandle.end()
 	}
 
 	m := Metadata{min: kvs[0].key.data, max: kvs[len(kvs)-1].key.data}
-	metadataLen, err := m.write(w)
+	var buf bytes.Buffer
+	if _, err := m.write(&buf); err != nil {
+		return fmt.Errorf("sstable: fail to encode metadata: %w", err)
+	}
+	metaHandle, err := writeBlock(w, offset, buf.Bytes(), NoCompression)
 	if err != nil {
 		return fmt.Errorf("sstable: fail to write metadata: %w", err)
 	}
 
-	f := footer{lvl, dataLen, 0, dataLen, uint32(metadataLen)}
-	if _, err := f.write(w); err != nil {
+	if v == formatVersion0 && metaHandle.end() > math.MaxUint32 {
+		return fmt.Errorf("sstable: %d bytes are too large for format version %d", metaHandle.end(), v)
+	}
+
+	f := footer{
+		version: v,
+		level:   lvl,
+		index:   indexHandle,
+		meta:    metaHandle,
+		filter:  filterHandle,
+	}
+	if _, err := w.Write(f.encode()); err != nil {
 		return fmt.Errorf("sstable: fail to write footer: %w", err)
 	}
 	return nil
@@ -222,66 +503,153 @@ func (m *Metadata) read(r io.Reader) error {
 	return nil
 }
 
-func loadMetadata(rs io.ReadSeeker, m *Metadata, footer *footer) error {
-	if _, err := rs.Seek(int64(footer.metaOffset), io.SeekStart); err != nil {
-		return fmt.Errorf("fail to load metadata: %w", err)
+func loadMetadata(r io.ReaderAt, cs compressors, gen Gen, m *Metadata, footer *footer) error {
+	data, err := readBlockData(r, cs, gen, footer.meta, true)
+	if err != nil {
+		return fmt.Errorf("sstable[%d]: fail to load metadata: %w", gen, err)
+	}
+	if err := m.read(bytes.NewReader(data)); err != nil {
+		return &CorruptionError{Gen: gen, Offset: int64(footer.meta.offset), Err: fmt.Errorf("fail to decode metadata: %w", err)}
 	}
-	return m.read(rs)
+	return nil
 }
 
-// footerSize is the size of footer block on disk.
-const footerSize = 17
+// formatVersion is the version of the SSTable file format. It's recorded in the footer, so that files written in
+// older versions can still be read after the format changes.
+type formatVersion uint32
+
+const (
+	// formatVersion0 is the format before versions were recorded. Its footer has no version and magic number, and
+	// block handles in it are 32-bit, which caps SSTables at 4GiB.
+	//
+	// | level           (1 byte uint) |
+	// | index offset    (4 bytes big endian uint) |
+	// | index length    (4 bytes big endian uint) |
+	// | metadata offset (4 bytes big endian uint) |
+	// | metadata length (4 bytes big endian uint) |
+	// | filter offset   (4 bytes big endian uint) |
+	// | filter length   (4 bytes big endian uint) |
+	// | checksum        (4 bytes big endian uint, CRC32C of the fields above) |
+	formatVersion0 formatVersion = 0
+	// formatVersion1 has a versioned footer and 64-bit block handles. See write for its layout.
+	formatVersion1 formatVersion = 1
+
+	latestFormatVersion = formatVersion1
+)
 
-// footer represents the footer block in memory. It has fixed size on disk.
+// ErrUnsupportedFormatVersion is returned when loading an SSTable written in a format version this package doesn't
+// know, e.g. by a newer release.
+var ErrUnsupportedFormatVersion = errors.New("unsupported SSTable format version")
+
+// footerMagic ends the footer of SSTables with recorded format versions. SSTables not ending with it are in
+// formatVersion0.
+const footerMagic uint64 = 0x6c6466732d737374 // "ldfs-sst"
+
+// footerTailSize is the size of the format version and magic number at the end of versioned footers.
+const footerTailSize = 12
+
+// footerSize returns the size of the footer block on disk in SSTables of version v.
+func footerSize(v formatVersion) (int, error) {
+	switch v {
+	case formatVersion0:
+		return 1 + 6*4 + 4, nil
+	case formatVersion1:
+		return 1 + 6*8 + 4 + footerTailSize, nil
+	default:
+		return 0, fmt.Errorf("%w %d, want at most %d", ErrUnsupportedFormatVersion, v, latestFormatVersion)
+	}
+}
+
+// footer represents the footer block in memory. It has fixed size on disk for each format version.
 type footer struct {
-	level       Level
-	indexOffset uint32
-	indexLength uint32
-	metaOffset  uint32
-	metaLength  uint32
+	version formatVersion
+	level   Level
+	index   blockHandle
+	meta    blockHandle
+	filter  blockHandle
 }
 
-// write writers footer into w as bytes.
-//
-// | level           (1 byte) |
-// | index offset    (4 bytes big endian) |
-// | index length    (4 bytes big endian) |
-// | metadata offset (4 bytes big endian) |
-// | metadata length (4 bytes big endian) |
-func (f *footer) write(w io.Writer) (int, error) {
-	if _, err := w.Write([]byte{byte(f.level)}); err != nil {
-		return 0, err
-	}
-
-	n := 1
-	for _, v := range []uint32{f.indexOffset, f.indexLength, f.metaOffset, f.metaLength} {
-		if err := binary.Write(w, binary.BigEndian, v); err != nil {
-			return n, err
-		}
-		n += 4
+// encode encodes the footer as bytes in its format version.
+func (f *footer) encode() []byte {
+	bs := []byte{byte(f.level)}
+	for _, h := range []blockHandle{f.index, f.meta, f.filter} {
+		bs = append(bs, h.encode(f.version)...)
+	}
+	bs = binary.BigEndian.AppendUint32(bs, crc32.Checksum(bs, crcTable))
+	if f.version == formatVersion0 {
+		return bs
 	}
-	return n, nil
+	bs = binary.BigEndian.AppendUint32(bs, uint32(f.version))
+	return binary.BigEndian.AppendUint64(bs, footerMagic)
 }
 
-// fromBytes decodes the bytes into the footer.
-func (f *footer) read(r io.Reader) error {
-	l := [1]byte{}
-	if _, err := r.Read(l[:]); err != nil {
-		return err
+// decode decodes the fields of the footer, without the checksum and the tail, in the format version f.version.
+func (f *footer) decode(bs []byte) error {
+	n := blockHandleSize(f.version)
+	if len(bs) != 1+3*n {
+		return fmt.Errorf("footer: got %d bytes, want %d", len(bs), 1+3*n)
 	}
-	f.level = Level(l[0])
-
-	return utils.Run(
-		utils.ToRunnable3(binary.Read, r, binary.ByteOrder(binary.BigEndian), any(&f.indexOffset)),
-		utils.ToRunnable3(binary.Read, r, binary.ByteOrder(binary.BigEndian), any(&f.indexLength)),
-		utils.ToRunnable3(binary.Read, r, binary.ByteOrder(binary.BigEndian), any(&f.metaOffset)),
-		utils.ToRunnable3(binary.Read, r, binary.ByteOrder(binary.BigEndian), any(&f.metaLength)),
-	)
+	f.level = Level(bs[0])
+	bs = bs[1:]
+	for _, h := range []*blockHandle{&f.index, &f.meta, &f.filter} {
+		var err error
+		if *h, err = decodeBlockHandle(bs[:n], f.version); err != nil {
+			return err
+		}
+		bs = bs[n:]
+	}
+	return nil
 }
 
-func loadFooter(rs io.ReadSeeker, footer *footer) error {
-	if _, err := rs.Seek(-footerSize, io.SeekEnd); err != nil {
-		return fmt.Errorf("fail to load footer: %w", err)
+// loadFooter loads the footer of the SSTable file with gen, and verifies its checksum. The format version is
+// detected from the magic number at the end of the file.
+func loadFooter(rs io.ReadSeeker, gen Gen, footer *footer) error {
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("sstable[%d]: fail to seek to the end: %w", gen, err)
 	}
-	return footer.read(rs)
+	readAt := func(bs []byte, offset int64) error {
+		if offset < 0 {
+			// The file is shorter than the footer.
+			return &CorruptionError{Gen: gen, Offset: 0, Err: fmt.Errorf("file of %d bytes is too short for footer", size)}
+		}
+		if _, err := rs.Seek(offset, io.SeekStart); err != nil {
+			return fmt.Errorf("sstable[%d]: fail to seek to footer: %w", gen, err)
+		}
+		if _, err := io.ReadFull(rs, bs); err != nil {
+			return fmt.Errorf("sstable[%d]: fail to read footer: %w", gen, err)
+		}
+		return nil
+	}
+
+	footer.version = formatVersion0
+	if size >= footerTailSize {
+		tail := make([]byte, footerTailSize)
+		if err := readAt(tail, size-footerTailSize); err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint64(tail[4:]) == footerMagic {
+			footer.version = formatVersion(binary.BigEndian.Uint32(tail))
+		}
+	}
+	n, err := footerSize(footer.version)
+	if err != nil {
+		return fmt.Errorf("sstable[%d]: %w", gen, err)
+	}
+	offset := size - int64(n)
+	bs := make([]byte, n)
+	if err := readAt(bs, offset); err != nil {
+		return err
+	}
+	if footer.version != formatVersion0 {
+		bs = bs[:n-footerTailSize]
+	}
+	data, trailer := bs[:len(bs)-4], bs[len(bs)-4:]
+	if got, want := crc32.Checksum(data, crcTable), binary.BigEndian.Uint32(trailer); got != want {
+		return &CorruptionError{Gen: gen, Offset: offset, Err: fmt.Errorf("footer checksum mismatch: got %08x, want %08x", got, want)}
+	}
+	if err := footer.decode(data); err != nil {
+		return &CorruptionError{Gen: gen, Offset: offset, Err: err}
+	}
+	return nil
 }
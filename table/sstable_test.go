@@ -2,35 +2,91 @@ package table
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"os"
 	"reflect"
 	"testing"
+
+	"github.com/liznear/leveldb-from-scratch/vfs"
 )
 
+// newTestTableOptions returns the options to write and read SSTables in the root of fs.
+func newTestTableOptions(fs vfs.FS) *tableOptions {
+	cs, _ := newCompressors()
+	return &tableOptions{
+		fs:               fs,
+		dir:              ".",
+		blockSize:        4 << 10,
+		restartInterval:  16,
+		filterBitsPerKey: 10,
+		compressors:      cs,
+		stats:            &tableStats{},
+	}
+}
+
 func TestSSTable_Write(t *testing.T) {
 	buf := bytes.Buffer{}
-	kvs := []kv{
-		newKV("Key1", []byte("Value1")),
-		newKV("Key2", []byte("Value2")),
+	var kvs []kv
+	for i := 0; i < 10; i++ {
+		kvs = append(kvs, newKV(fmt.Sprintf("Key%d", i), []byte(fmt.Sprintf("Value%d", i))))
 	}
-	err := write(&buf, 1, kvs)
+	// With the restart array, a block with 2 kvs takes 47 bytes, so every block has 2 kvs.
+	opts := newTestTableOptions(vfs.NewMem())
+	opts.blockSize = 40
+	err := write(&buf, opts, 1, kvs)
 	if err != nil {
 		t.Fatalf("Fail to write SSTable: %v", err)
 	}
 
-	bs := buf.Bytes()
-
+	r := bytes.NewReader(buf.Bytes())
 	f := footer{}
-	if err := f.read(bytes.NewReader(bs[len(bs)-footerSize:])); err != nil {
-		t.Fatalf("Fail to read footer from %v: %v", bs[len(bs)-footerSize:], err)
+	if err := loadFooter(r, 1, &f); err != nil {
+		t.Fatalf("Fail to load footer: %v", err)
+	}
+	if f.version != latestFormatVersion {
+		t.Errorf("Got format version %d, want %d", f.version, latestFormatVersion)
 	}
 	if f.level != Level(1) {
 		t.Errorf("Got level %d, want %d", f.level, 1)
 	}
 
-	got, err := readKVs(io.LimitReader(&buf, int64(f.indexOffset)))
+	cs, err := newCompressors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := readBlock(r, cs, 1, f.index, true)
 	if err != nil {
-		t.Fatalf("Fail to load KVs from SSTable: %v", err)
+		t.Fatalf("Fail to read index block: %v", err)
+	}
+	entries, err := index.kvs()
+	if err != nil {
+		t.Fatalf("Fail to decode index block: %v", err)
+	}
+	if len(entries) != 5 {
+		t.Fatalf("Got %d blocks, want %d", len(entries), 5)
+	}
+	var got []kv
+	for i, e := range entries {
+		h, err := decodeBlockHandle(e.value.data, f.version)
+		if err != nil {
+			t.Fatalf("Fail to decode block handle %d: %v", i, err)
+		}
+		b, err := readBlock(r, cs, 1, h, true)
+		if err != nil {
+			t.Fatalf("Fail to read block %d: %v", i, err)
+		}
+		bkvs, err := b.kvs()
+		if err != nil {
+			t.Fatalf("Fail to decode block %d: %v", i, err)
+		}
+		if last := bkvs[len(bkvs)-1].key; compareKeys(last, e.key) != 0 {
+			t.Errorf("Got index key %s for block %d, want %s", &e.key, i, &last)
+		}
+		got = append(got, bkvs...)
 	}
 	if len(got) != len(kvs) {
 		t.Errorf("Got %d kvs, want %d", len(got), len(kvs))
@@ -44,19 +100,18 @@ func TestSSTable_Write(t *testing.T) {
 
 func TestSSTable_Get(t *testing.T) {
 	t.Parallel()
-	clean := EnterTempDir(t)
-	defer clean()
+	fs := vfs.NewMem()
 
 	kvs := []kv{
 		newKV("Key1", []byte("Value1")),
 		newDeletedKey("Key3"),
 	}
-	sstable, err := newSSTable(1, 0, kvs)
+	sstable, err := newSSTable(newTestTableOptions(fs), 1, 0, kvs)
 	if err != nil {
 		t.Fatalf("Fail to create SSTable: %v", err)
 	}
 
-	got, ok, err := sstable.get("Key1")
+	got, ok, err := sstable.get("Key1", math.MaxInt64, true)
 	if err != nil {
 		t.Fatalf("Fail to get Key1: %v", err)
 	}
@@ -67,7 +122,7 @@ func TestSSTable_Get(t *testing.T) {
 		t.Errorf("Got %v, want %v", got, []byte("Value1"))
 	}
 
-	_, ok, err = sstable.get("Key2")
+	_, ok, err = sstable.get("Key2", math.MaxInt64, true)
 	if err != nil {
 		t.Fatalf("Fail to get Key2: %v", err)
 	}
@@ -75,7 +130,7 @@ func TestSSTable_Get(t *testing.T) {
 		t.Fatal("Found non-existing Key2")
 	}
 
-	got, ok, err = sstable.get("Key3")
+	got, ok, err = sstable.get("Key3", math.MaxInt64, true)
 	if err != nil {
 		t.Fatalf("Fail to get Key3: %v", err)
 	}
@@ -86,3 +141,309 @@ func TestSSTable_Get(t *testing.T) {
 		t.Errorf("Got %v, want deleted", got)
 	}
 }
+
+func TestSSTable_GetFromBlocks(t *testing.T) {
+	t.Parallel()
+	fs := vfs.NewMem()
+
+	put := func(k string, seq Seq, v string) kv {
+		return kv{key: newInternalKey(k, seq), value: newValue([]byte(v))}
+	}
+	// With tiny blocks, every kv is in its own block, so versions of Key2 span several blocks.
+	kvs := []kv{
+		put("Key1", 9, "V9"),
+		put("Key2", 8, "V8"),
+		put("Key2", 6, "V6"),
+		{key: newInternalKey("Key2", 4), value: newDeletedValue()},
+		put("Key2", 2, "V2"),
+		put("Key4", 7, "V7"),
+	}
+	opts := newTestTableOptions(fs)
+	opts.blockSize = 1
+	st, err := newSSTable(opts, 1, 0, kvs)
+	if err != nil {
+		t.Fatalf("Fail to create SSTable: %v", err)
+	}
+
+	tcs := []struct {
+		name   string
+		key    string
+		seq    Seq
+		want   value
+		wantOk bool
+	}{
+		{name: "FirstBlock", key: "Key1", seq: math.MaxInt64, want: newValue([]byte("V9")), wantOk: true},
+		{name: "NotVisible", key: "Key1", seq: 8, wantOk: false},
+		{name: "Newest", key: "Key2", seq: math.MaxInt64, want: newValue([]byte("V8")), wantOk: true},
+		{name: "OlderVersion", key: "Key2", seq: 7, want: newValue([]byte("V6")), wantOk: true},
+		{name: "Deleted", key: "Key2", seq: 5, want: newDeletedValue(), wantOk: true},
+		{name: "Oldest", key: "Key2", seq: 3, want: newValue([]byte("V2")), wantOk: true},
+		{name: "BeforeOldest", key: "Key2", seq: 1, wantOk: false},
+		{name: "Missing", key: "Key3", seq: math.MaxInt64, wantOk: false},
+		{name: "LastBlock", key: "Key4", seq: 7, want: newValue([]byte("V7")), wantOk: true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok, err := st.get(tc.key, tc.seq, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tc.wantOk {
+				t.Fatalf("Got ok %v, want %v", ok, tc.wantOk)
+			}
+			if ok && !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Got %s, want %s", got, tc.want)
+			}
+		})
+	}
+
+	got, err := st.kvs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(kvs) {
+		t.Fatalf("Got %d kvs, want %d", len(got), len(kvs))
+	}
+	for i := range got {
+		if !kvEqual(&got[i], &kvs[i]) {
+			t.Errorf("%d: got %s, want %s", i, &got[i], &kvs[i])
+		}
+	}
+}
+
+// corruptFile flips the bits of the byte at offset in the file.
+func corruptFile(t *testing.T, fs vfs.FS, name string, offset int64) {
+	t.Helper()
+	f, err := fs.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b := []byte{0}
+	if _, err := f.ReadAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSSTable_Checksum(t *testing.T) {
+	kvs := []kv{
+		newKV("Key1", []byte("Value1")),
+		newKV("Key2", []byte("Value2")),
+	}
+	tcs := []struct {
+		name string
+		// offset returns the offset of the byte to corrupt, and the wanted offset of the corruption.
+		offset func(f *footer, size int64) (int64, int64)
+		// wantLoadErr is whether loading the SSTable fails.
+		wantLoadErr bool
+		// wantErrs are whether getting Key1 and Key2 with checksums verified fail.
+		wantErrs [2]bool
+		// wantUnverifyErr is whether getting Key2 without checksums verified fails.
+		wantUnverifyErr bool
+	}{
+		{
+			name:     "DataBlock",
+			offset:   func(f *footer, size int64) (int64, int64) { return 5, 0 },
+			wantErrs: [2]bool{true, false},
+		},
+		{
+			name: "IndexBlock",
+			offset: func(f *footer, size int64) (int64, int64) {
+				return int64(f.index.offset), int64(f.index.offset)
+			},
+			wantErrs:        [2]bool{true, true},
+			wantUnverifyErr: true,
+		},
+		{
+			name: "FilterBlock",
+			offset: func(f *footer, size int64) (int64, int64) {
+				return int64(f.filter.offset), int64(f.filter.offset)
+			},
+			wantErrs:        [2]bool{true, true},
+			wantUnverifyErr: true,
+		},
+		{
+			name: "MetadataBlock",
+			offset: func(f *footer, size int64) (int64, int64) {
+				return int64(f.meta.offset), int64(f.meta.offset)
+			},
+			wantLoadErr: true,
+		},
+		{
+			name: "Footer",
+			offset: func(f *footer, size int64) (int64, int64) {
+				n, _ := footerSize(f.version)
+				return size - int64(n) + 1, size - int64(n)
+			},
+			wantLoadErr: true,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := vfs.NewMem()
+			opts := newTestTableOptions(fs)
+			opts.blockSize = 1
+			if _, err := newSSTable(opts, 1, 0, kvs); err != nil {
+				t.Fatal(err)
+			}
+			name := sstableFilename(".", 1)
+			f, err := vfs.Open(fs, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			footer := &footer{}
+			if err := loadFooter(f, 1, footer); err != nil {
+				t.Fatal(err)
+			}
+			fi, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = f.Close()
+			offset, wantOffset := tc.offset(footer, fi.Size())
+			corruptFile(t, fs, name, offset)
+
+			verifyErr := func(err error) {
+				t.Helper()
+				if !errors.Is(err, ErrCorruption) {
+					t.Fatalf("Got error %v, want %v", err, ErrCorruption)
+				}
+				cerr := &CorruptionError{}
+				if !errors.As(err, &cerr) {
+					t.Fatalf("Got error %T, want %T", err, cerr)
+				}
+				if cerr.Gen != 1 || cerr.Offset != wantOffset {
+					t.Errorf("Got corruption in %d at %d, want in %d at %d", cerr.Gen, cerr.Offset, 1, wantOffset)
+				}
+			}
+
+			st, err := loadSSTable(opts, 1)
+			if tc.wantLoadErr {
+				verifyErr(err)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, kv := range kvs {
+				got, ok, err := st.get(kv.key.data, math.MaxInt64, true)
+				if tc.wantErrs[i] {
+					verifyErr(err)
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ok || !reflect.DeepEqual(got, kv.value) {
+					t.Errorf("Got %s, %v, want %s", got, ok, kv.value)
+				}
+			}
+			_, _, err = st.get("Key2", math.MaxInt64, false)
+			if tc.wantUnverifyErr {
+				verifyErr(err)
+			} else if err != nil {
+				t.Errorf("Got error %v without verifying checksums, want nil", err)
+			}
+		})
+	}
+}
+
+// writeTestSSTable writes kvs as the SSTable with gen in format version v.
+func writeTestSSTable(t *testing.T, opts *tableOptions, gen Gen, kvs []kv, v formatVersion) {
+	t.Helper()
+	f, err := vfs.Create(opts.fs, sstableFilename(opts.dir, gen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := writeVersion(f, opts, 1, kvs, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSSTable_FormatVersion(t *testing.T) {
+	var kvs []kv
+	for i := 0; i < 20; i++ {
+		kvs = append(kvs, newKV(fmt.Sprintf("Key%02d", i), []byte(fmt.Sprintf("Value%d", i))))
+	}
+	tcs := []struct {
+		name    string
+		version formatVersion
+	}{
+		{name: "V0", version: formatVersion0},
+		{name: "V1", version: formatVersion1},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := newTestTableOptions(vfs.NewMem())
+			opts.blockSize = 40
+			writeTestSSTable(t, opts, 1, kvs, tc.version)
+
+			st, err := loadSSTable(opts, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := st.footer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.version != tc.version || f.level != 1 {
+				t.Errorf("Got version %d, level %d, want %d, %d", f.version, f.level, tc.version, 1)
+			}
+			for _, kv := range kvs {
+				got, ok, err := st.get(kv.key.data, math.MaxInt64, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ok || !bytes.Equal(got.data, kv.value.data) {
+					t.Errorf("Got %q, %v for %s, want %q", got.data, ok, kv.key.data, kv.value.data)
+				}
+			}
+			got, err := st.kvs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(kvs) {
+				t.Errorf("Got %d kvs, want %d", len(got), len(kvs))
+			}
+		})
+	}
+}
+
+func TestSSTable_UnsupportedFormatVersion(t *testing.T) {
+	opts := newTestTableOptions(vfs.NewMem())
+	writeTestSSTable(t, opts, 1, []kv{newKV("Key1", []byte("Value1"))}, latestFormatVersion)
+
+	// Bump the format version right before the magic number.
+	name := sstableFilename(opts.dir, 1)
+	fi, err := opts.fs.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := opts.fs.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(fi.Size()-footerTailSize, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(binary.BigEndian.AppendUint32(nil, uint32(latestFormatVersion+1))); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	_, err = loadSSTable(opts, 1)
+	if !errors.Is(err, ErrUnsupportedFormatVersion) {
+		t.Errorf("Got error %v, want %v", err, ErrUnsupportedFormatVersion)
+	}
+	if errors.Is(err, ErrCorruption) {
+		t.Errorf("Got error %v, want it not to be a corruption", err)
+	}
+}
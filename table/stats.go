@@ -0,0 +1,35 @@
+package table
+
+// Stats are the statistics of a DB since it's opened.
+type Stats struct {
+	// FilterHits is the number of SSTable lookups the bloom filters couldn't rule out. Some of them are false
+	// positives, which read a data block without finding the key.
+	FilterHits int64
+	// FilterMisses is the number of SSTable lookups the bloom filters ruled out without reading any data block.
+	FilterMisses int64
+
+	// BlockCacheHits is the number of data blocks found in the block cache.
+	BlockCacheHits int64
+	// BlockCacheMisses is the number of data blocks not found in the block cache, which are read from files.
+	BlockCacheMisses int64
+	// BlockCacheEvictions is the number of blocks evicted from the block cache to make room for other blocks.
+	// Blocks of deleted SSTables are removed from the cache as well, but they are not counted.
+	BlockCacheEvictions int64
+	// BlockCacheSize is the total size in bytes of the blocks in the block cache.
+	BlockCacheSize int64
+}
+
+// Stats returns the statistics of the DB.
+func (db *DB) Stats() Stats {
+	s := Stats{
+		FilterHits:   db.tableOpts.stats.filterHits.Load(),
+		FilterMisses: db.tableOpts.stats.filterMisses.Load(),
+	}
+	if c := db.tableOpts.cache; c != nil {
+		s.BlockCacheHits = c.hits.Load()
+		s.BlockCacheMisses = c.misses.Load()
+		s.BlockCacheEvictions = c.evictions.Load()
+		s.BlockCacheSize = int64(c.size())
+	}
+	return s
+}
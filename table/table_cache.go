@@ -0,0 +1,108 @@
+package table
+
+import (
+	"container/list"
+	"sync"
+)
+
+// tableCache keeps the readers of recently used SSTables, with their files opened and their footers, index
+// blocks and filters loaded, so that reads don't open and parse the files again. At most capacity readers are
+// kept, the least recently used ones are dropped first.
+//
+// Readers are reference counted. The cache holds one reference to each cached reader, and every user holds one
+// while using it. A reader dropped from the cache is closed once its last user releases it.
+type tableCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[Gen]*list.Element
+	// lru holds *tableReader, from the most recently used to the least recently used.
+	lru *list.List
+}
+
+func newTableCache(capacity int) *tableCache {
+	return &tableCache{
+		capacity: capacity,
+		entries:  make(map[Gen]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// get returns the reader of the SSTable. The caller must release the reader after use.
+func (c *tableCache) get(t *sstable) (*tableReader, error) {
+	if r, ok := c.lookup(t.gen); ok {
+		return r, nil
+	}
+
+	// Open the file without holding the lock, so that reads of other SSTables are not blocked.
+	r, err := newTableReader(t)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[t.gen]; ok {
+		// Another reader is opened concurrently. Use it instead.
+		r.release()
+		r = e.Value.(*tableReader)
+		c.lru.MoveToFront(e)
+		r.ref()
+		return r, nil
+	}
+	// One reference for the cache, the other for the caller.
+	r.ref()
+	c.entries[t.gen] = c.lru.PushFront(r)
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+	}
+	return r, nil
+}
+
+func (c *tableCache) lookup(gen Gen) (*tableReader, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[gen]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	r := e.Value.(*tableReader)
+	r.ref()
+	return r, true
+}
+
+// evict drops the reader of the SSTable with gen. It's called once the SSTable is deleted.
+func (c *tableCache) evict(gen Gen) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[gen]; ok {
+		c.remove(e)
+	}
+}
+
+// close drops all readers.
+func (c *tableCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// len returns the number of cached readers.
+func (c *tableCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+func (c *tableCache) remove(e *list.Element) {
+	r := c.lru.Remove(e).(*tableReader)
+	delete(c.entries, r.t.gen)
+	r.release()
+}
@@ -0,0 +1,181 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/liznear/leveldb-from-scratch/vfs"
+)
+
+// isClosed returns whether the file of the reader is closed.
+func isClosed(t *testing.T, r *tableReader) bool {
+	t.Helper()
+	_, err := r.f.ReadAt(make([]byte, 1), 0)
+	if err != nil && !errors.Is(err, os.ErrClosed) {
+		t.Fatal(err)
+	}
+	return err != nil
+}
+
+func newTestSSTables(t *testing.T, opts *tableOptions, n int) []*sstable {
+	t.Helper()
+	var sts []*sstable
+	for gen := Gen(1); gen <= Gen(n); gen++ {
+		st, err := newSSTable(opts, gen, 0, []kv{newKV(fmt.Sprintf("Key%d", gen), []byte("Value"))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sts = append(sts, st)
+	}
+	return sts
+}
+
+func TestTableCache(t *testing.T) {
+	opts := newTestTableOptions(vfs.NewMem())
+	opts.tables = newTableCache(2)
+	sts := newTestSSTables(t, opts, 3)
+
+	r1, err := sts[0].open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Readers are reused until they are dropped.
+	for i := 0; i < 2; i++ {
+		r, err := sts[0].open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != r1 {
+			t.Errorf("Got a new reader, want the cached one")
+		}
+		r.release()
+	}
+
+	for _, st := range sts[1:] {
+		r, err := st.open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.release()
+	}
+	if got := opts.tables.len(); got != 2 {
+		t.Errorf("Got %d cached readers, want 2", got)
+	}
+	// r1 is the least recently used one, so it's dropped, but it's still open since it's in use.
+	if _, ok := opts.tables.lookup(sts[0].gen); ok {
+		t.Errorf("Got reader of SSTable 1 cached, want it dropped")
+	}
+	if isClosed(t, r1) {
+		t.Errorf("Got reader closed while in use")
+	}
+	r1.release()
+	if !isClosed(t, r1) {
+		t.Errorf("Got reader open after release")
+	}
+
+	// Readers are closed together with the cache.
+	r3, err := sts[2].open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r3.release()
+	opts.tables.close()
+	if got := opts.tables.len(); got != 0 {
+		t.Errorf("Got %d cached readers, want 0", got)
+	}
+	if !isClosed(t, r3) {
+		t.Errorf("Got reader open after the cache is closed")
+	}
+}
+
+func TestTableCache_Evict(t *testing.T) {
+	opts := newTestTableOptions(vfs.NewMem())
+	opts.tables = newTableCache(10)
+	sts := newTestSSTables(t, opts, 2)
+
+	for _, st := range sts {
+		if _, _, err := st.get(fmt.Sprintf("Key%d", st.gen), math.MaxInt64, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := opts.tables.len(); got != 2 {
+		t.Errorf("Got %d cached readers, want 2", got)
+	}
+
+	// An iterator holds its reader even if the SSTable is deleted.
+	it := newTableIterator(sts[0], true)
+	it.First()
+	r := it.r
+	sts[0].unref()
+	if _, ok := opts.tables.lookup(sts[0].gen); ok {
+		t.Errorf("Got reader of deleted SSTable cached")
+	}
+	if got := opts.tables.len(); got != 1 {
+		t.Errorf("Got %d cached readers, want 1", got)
+	}
+	if !it.Valid() || it.kv().key.data != "Key1" {
+		t.Fatalf("Got invalid iterator, want Key1")
+	}
+	it.Next()
+	if it.Valid() || it.Err() != nil {
+		t.Errorf("Got valid %v, err %v, want the end of the SSTable", it.Valid(), it.Err())
+	}
+	if isClosed(t, r) {
+		t.Errorf("Got reader closed while the iterator is open")
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !isClosed(t, r) {
+		t.Errorf("Got reader open after the iterator is closed")
+	}
+}
+
+func TestDB_MaxOpenFiles(t *testing.T) {
+	tcs := []struct {
+		name       string
+		maxOpen    int
+		wantCached int
+	}{
+		{name: "Bounded", maxOpen: 2, wantCached: 2},
+		{name: "Disabled", maxOpen: 0, wantCached: 0},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			db, err := NewDB(WithFS(vfs.NewMem()), WithMaxOpenFiles(tc.maxOpen))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			for i := 0; i < 4; i++ {
+				if err := db.Put(fmt.Sprintf("Key%d", i), []byte(fmt.Sprintf("Value%d", i))); err != nil {
+					t.Fatal(err)
+				}
+				if err := db.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < 4; i++ {
+				got, ok, err := db.Get(fmt.Sprintf("Key%d", i))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := fmt.Sprintf("Value%d", i); !ok || string(got) != want {
+					t.Errorf("Got %q, %v, want %s", got, ok, want)
+				}
+			}
+
+			cached := 0
+			if db.tableOpts.tables != nil {
+				cached = db.tableOpts.tables.len()
+			}
+			if cached != tc.wantCached {
+				t.Errorf("Got %d cached readers, want %d", cached, tc.wantCached)
+			}
+		})
+	}
+}
@@ -10,12 +10,18 @@ import (
 	"strings"
 
 	"github.com/emirpasic/gods/v2/sets/treeset"
+
+	"github.com/liznear/leveldb-from-scratch/vfs"
 )
 
 type version struct {
-	levels [maxLevels]*treeset.Set[*sstable]
-	log    *logWriter[*versionLog]
-	seq    Seq
+	levels   [maxLevels]*treeset.Set[*sstable]
+	manifest *manifest
+	seq      Seq
+
+	// lastSeq and nextGen are the counters of the DB recorded by the latest version log.
+	lastSeq Seq
+	nextGen Gen
 }
 
 // Apply returns a new version with the given sstables added and deleted.
@@ -36,15 +42,29 @@ func (v *version) Apply(add []*sstable, del []*sstable, seq Seq) (version, error
 	log.seq = seq
 	ret.seq = seq
 
-	if err := v.log.Write(log); err != nil {
+	if err := v.manifest.Write(log); err != nil {
 		return version{}, fmt.Errorf("version: fail to write version log: %w", err)
 	}
-	if err := v.log.Sync(); err != nil {
-		return version{}, fmt.Errorf("version: fail to sync version log: %w", err)
+	ret.lastSeq, ret.nextGen = log.lastSeq, log.nextGen
+	if v.manifest.full() {
+		if err := v.manifest.rotate(ret.snapshot()); err != nil {
+			return version{}, fmt.Errorf("version: fail to rotate manifest: %w", err)
+		}
 	}
 	return ret, nil
 }
 
+// snapshot returns a versionLog which rebuilds the version from an empty one.
+func (v *version) snapshot() *versionLog {
+	log := &versionLog{add: []Gen{}, del: []Gen{}, seq: v.seq, lastSeq: v.lastSeq, nextGen: v.nextGen}
+	for _, level := range v.levels {
+		for _, st := range level.Values() {
+			log.add = append(log.add, st.gen)
+		}
+	}
+	return log
+}
+
 // MaxGen returns the maximum generation number in the version.
 func (v *version) MaxGen() Gen {
 	maxGen := Gen(0)
@@ -62,57 +82,72 @@ func (v *version) MaxGen() Gen {
 func (v *version) clone() version {
 	ret := emptyVersion()
 	ret.seq = v.seq
-	ret.log = v.log
+	ret.lastSeq, ret.nextGen = v.lastSeq, v.nextGen
+	ret.manifest = v.manifest
 	for i, s := range v.levels {
 		ret.levels[i].Add(s.Values()...)
 	}
 	return ret
 }
 
-// loadLatestVersion would scan the version.wal file and rebuild the latest version.
+// loadLatestVersion would scan the current manifest file in dir and rebuild the latest version. New version logs
+// are appended to the manifest file, until it grows beyond maxManifestSize. See manifest for more details.
 //
-// It is possible that the server crash when the version.wal is being written. In this case, the last entry of the
-// version.wal file would be incomplete. This incompleteness doesn't affect the correctness. Just consider these two
+// It is possible that the server crash when the manifest is being written. In this case, the last entry of the
+// manifest file would be incomplete. This incompleteness doesn't affect the correctness. Just consider these two
 // cases:
 //
 // Case 1: server crashes when version is updated because a full MemTable is persisted. Since the WAL entry is not
 // written yet, we won't include the written sstable in the version. However, all the KVs in the full MemTable would
 // be loaded in the recovery, because the MemTable's WAL's sequence is higher than the last version's sequence. No data is missing.
-// See the loadKVsFromWAL function for more details.
+// See the replayWAL function for more details.
 //
-// Case 2: server crashes when a compaction is being performed. Since the version.wal entry is not written yet, all
+// Case 2: server crashes when a compaction is being performed. Since the manifest entry is not written yet, all
 // sstables being compacted are not deleted yet. No data is missing. It is possible that the compaction has already
 // created new SSTables. We would remove any sstable files that are not included in the current version to avoid storage
 // waste.
 //
-// TODO: currently, we don't make an snapshot on the version, and we need to rebuild the version from the whole
-// version WAL.
-func loadLatestVersion() (version, error) {
+// A DB without the CURRENT file is either new, or created before manifest files were introduced. In the latter
+// case, the version is rebuilt from the old version log, and a manifest file is created with its snapshot. If the
+// old version log is unframed, ErrLegacyVersionLog is returned and nothing is changed.
+func loadLatestVersion(opts *tableOptions, maxManifestSize int64) (version, error) {
+	fs, dir := opts.fs, opts.dir
 	v := emptyVersion()
-
-	verLogIter, err := newVersionLogIter()
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			log, err := newVersionLogWriter()
-			if err != nil {
-				return version{}, err
-			}
-			v.log = log
-			return v, nil
-		}
+	m := &manifest{fs: fs, dir: dir, maxSize: maxManifestSize}
+
+	num, err := readCurrent(fs, dir)
+	current := err == nil
+	name := manifestFile(dir, num)
+	if errors.Is(err, os.ErrNotExist) {
+		name = versionLogFile(dir)
+	} else if err != nil {
 		return version{}, err
 	}
-	defer verLogIter.Close()
 
 	gens := treeset.New[Gen]()
+	verLogIter, err := newVersionLogIter(fs, name)
+	switch {
+	case err == nil:
+		defer verLogIter.Close()
+	case !current && errors.Is(err, os.ErrNotExist):
+		// A new DB.
+		verLogIter = nil
+	default:
+		return version{}, err
+	}
 	versionLog := &versionLog{}
-	for verLogIter.Next() {
+	for first := true; verLogIter != nil && verLogIter.Next(); first = false {
 		if err := verLogIter.Read(versionLog); err != nil {
+			// The records of a version log written before they were framed can't be read at all. Don't truncate it
+			// as a torn log.
+			if !current && first && errors.Is(err, ErrCorruption) {
+				return version{}, fmt.Errorf("version: %w: %v", ErrLegacyVersionLog, err)
+			}
 			// If the version log is incomplete, we stop reading the logs.
-			// However, since we need to reuse the versions.wal, we need to truncate the incomplete part.
+			// However, since we need to reuse the manifest file, we need to truncate the incomplete part.
 			ierr := &incompleteLogError{}
 			if errors.As(err, &ierr) {
-				if err := os.Truncate(versionLogFile(), int64(ierr.valid)); err != nil {
+				if err := fs.Truncate(name, int64(ierr.valid)); err != nil {
 					return version{}, err
 				}
 				break
@@ -122,31 +157,47 @@ func loadLatestVersion() (version, error) {
 		gens.Add(versionLog.add...)
 		gens.Remove(versionLog.del...)
 		v.seq = versionLog.seq
+		v.lastSeq = max(v.lastSeq, versionLog.lastSeq)
+		v.nextGen = max(v.nextGen, versionLog.nextGen)
 	}
 
 	for _, gen := range gens.Values() {
-		st, err := loadSSTable(gen)
+		st, err := loadSSTable(opts, gen)
 		if err != nil {
 			return version{}, err
 		}
 		v.levels[st.level].Add(st)
 	}
 
-	if err := removeUnusedSSTables(gens); err != nil {
+	if err := removeUnusedSSTables(fs, dir, gens); err != nil {
 		return version{}, err
 	}
 
-	log, err := newVersionLogWriter()
-	if err != nil {
+	v.manifest = m
+	if current {
+		m.num = num
+		if m.log, err = newVersionLogWriter(fs, name); err != nil {
+			return version{}, err
+		}
+	}
+	if !current || m.full() {
+		if err := m.rotate(v.snapshot()); err != nil {
+			return version{}, err
+		}
+		// The old version log is migrated to the manifest file.
+		if err := fs.Remove(versionLogFile(dir)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return version{}, err
+		}
+	}
+	if err := removeObsoleteManifests(fs, dir, m.num); err != nil {
 		return version{}, err
 	}
-	v.log = log
 	return v, nil
 }
 
-// removeUnusedSSTables would remove all sstable files that are not included in the current version.
-func removeUnusedSSTables(gens *treeset.Set[Gen]) error {
-	ssts, err := filepath.Glob("./*" + sstableExtension)
+// removeUnusedSSTables would remove all sstable files in dir that are not included in the current version.
+func removeUnusedSSTables(fs vfs.FS, dir string, gens *treeset.Set[Gen]) error {
+	ssts, err := fs.Glob(filepath.Join(dir, "*"+sstableExtension))
 	if err != nil {
 		return err
 	}
@@ -160,7 +211,10 @@ func removeUnusedSSTables(gens *treeset.Set[Gen]) error {
 			continue
 		}
 		if !gens.Contains(Gen(gen)) {
-			errs = append(errs, os.Remove(sst))
+			// The file may have been removed by a previous run right before it stopped.
+			if err := fs.Remove(sst); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
 		}
 	}
 	return errors.Join(errs...)
@@ -191,5 +245,7 @@ func (v *version) debug() string {
 		}
 	}
 	sb.WriteString(fmt.Sprintf("Seq: %d\n", v.seq))
+	sb.WriteString(fmt.Sprintf("Last Seq: %d\n", v.lastSeq))
+	sb.WriteString(fmt.Sprintf("Next Gen: %d\n", v.nextGen))
 	return sb.String()
 }
@@ -3,21 +3,24 @@ package table
 import (
 	"encoding/binary"
 	"io"
-	"os"
 	"testing"
 
 	"github.com/liznear/leveldb-from-scratch/utils"
+	"github.com/liznear/leveldb-from-scratch/vfs"
 )
 
 func TestVersion_Incomplete(t *testing.T) {
-	defer EnterTempDir(t)()
+	fs := vfs.NewMem()
 
 	// Prepare an incomplete version log
 	func() {
-		verLogWriter, err := newVersionLogWriter()
+		verLogWriter, err := newVersionLogWriter(fs, manifestFile(".", 1))
 		if err != nil {
 			t.Fatal(err)
 		}
+		if err := setCurrent(fs, ".", 1); err != nil {
+			t.Fatal(err)
+		}
 
 		if err := utils.Run(
 			utils.ToRunnable1(verLogWriter.Write, &versionLog{
@@ -37,13 +40,13 @@ func TestVersion_Incomplete(t *testing.T) {
 		}
 	}()
 
-	fiBefore, err := os.Stat(versionLogFile())
+	fiBefore, err := fs.Stat(manifestFile(".", 1))
 	if err != nil {
 		t.Fatal(err)
 	}
 	fileSizeBefore := fiBefore.Size()
 
-	ver, err := loadLatestVersion()
+	ver, err := loadLatestVersion(newTestTableOptions(fs), 1<<20)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -52,7 +55,7 @@ func TestVersion_Incomplete(t *testing.T) {
 		t.Errorf("Got seq %d, want %d", ver.seq, 2)
 	}
 
-	fiAfter, err := os.Stat(versionLogFile())
+	fiAfter, err := fs.Stat(manifestFile(".", 1))
 	if err != nil {
 		t.Fatal(err)
 	}
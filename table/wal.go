@@ -1,56 +1,85 @@
 package table
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+
+	"github.com/liznear/leveldb-from-scratch/vfs"
 )
 
-// loggable is an interface to indicate that the object can be logged.
+// loggable is an interface to indicate that the object can be logged. Each log is stored as a record, see
+// appendRecord.
 type loggable interface {
 	read(io.Reader) error
 
 	write(io.Writer) (int, error)
-
-	sizeOnDisk() int
 }
 
+// kvLog records the kvs of a WriteBatch. All kvs of a batch are in a single log, so that a batch is either
+// fully recovered or dropped.
 type kvLog struct {
-	kv kv
+	kvs []kv
 }
 
-func newKVLog(key string, value []byte) *kvLog {
+func newKVLog(seq Seq, b *WriteBatch) *kvLog {
 	return &kvLog{
-		kv: newKV(key, value),
-	}
-}
-
-func newDeletedKVLog(key string) *kvLog {
-	return &kvLog{
-		kv: newDeletedKey(key),
+		kvs: b.withSeq(seq),
 	}
 }
 
+// write writes the kvLog in this format
+// | kv count (4 bytes big endian uint) | kv1 | kv2 | ...
 func (l *kvLog) write(w io.Writer) (int, error) {
-	return l.kv.write(w)
+	buf := bytes.Buffer{}
+	if err := binary.Write(&buf, binary.BigEndian, uint32(len(l.kvs))); err != nil {
+		return 0, err
+	}
+	for _, kv := range l.kvs {
+		if _, err := kv.write(&buf); err != nil {
+			return 0, err
+		}
+	}
+	return w.Write(buf.Bytes())
 }
 
 func (l *kvLog) read(r io.Reader) error {
-	return l.kv.read(r)
+	var c uint32
+	if err := binary.Read(r, binary.BigEndian, &c); err != nil {
+		return err
+	}
+	l.kvs = make([]kv, c)
+	for i := range l.kvs {
+		if err := l.kvs[i].read(r); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (l *kvLog) sizeOnDisk() int {
-	return sizeOnDisk(l.kv.key.data, l.kv.value.data)
+	n := 4
+	for _, kv := range l.kvs {
+		n += sizeOnDisk(kv.key.data, kv.value.data)
+	}
+	return n
 }
 
 type versionLog struct {
 	del []Gen
 	add []Gen
 	seq Seq
+
+	// lastSeq and nextGen are the last Seq used and the next Gen to use when the log is written. They are
+	// recovered from the logs, so that Seqs and Gens are never reused after a restart. See manifest.stamp.
+	lastSeq Seq
+	nextGen Gen
 }
 
 func (l *versionLog) debug() string {
@@ -72,6 +101,8 @@ func (l *versionLog) debug() string {
 	}
 	sb.WriteString("]\n")
 	_, _ = fmt.Fprintf(&sb, "Seq: %d\n", l.seq)
+	_, _ = fmt.Fprintf(&sb, "Last Seq: %d\n", l.lastSeq)
+	_, _ = fmt.Fprintf(&sb, "Next Gen: %d\n", l.nextGen)
 	return sb.String()
 }
 
@@ -102,7 +133,15 @@ func (l *versionLog) write(w io.Writer) (int, error) {
 	if err := binary.Write(w, binary.BigEndian, uint64(l.seq)); err != nil {
 		return n, err
 	}
-	return n + 2, nil
+	n += 8
+	if err := binary.Write(w, binary.BigEndian, uint64(l.lastSeq)); err != nil {
+		return n, err
+	}
+	n += 8
+	if err := binary.Write(w, binary.BigEndian, uint64(l.nextGen)); err != nil {
+		return n, err
+	}
+	return n + 8, nil
 }
 
 func (l *versionLog) read(r io.Reader) error {
@@ -136,108 +175,196 @@ func (l *versionLog) read(r io.Reader) error {
 		return err
 	}
 	l.seq = Seq(seq)
-	return nil
-}
 
-func (l *versionLog) sizeOnDisk() int {
-	return 2 + len(l.del)*8 + 2 + len(l.add)*8 + 8
+	// Logs written before lastSeq and nextGen were introduced end here.
+	l.lastSeq, l.nextGen = 0, 0
+	var lastSeq, nextGen uint64
+	if err := binary.Read(r, binary.BigEndian, &lastSeq); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	}
+	if err := binary.Read(r, binary.BigEndian, &nextGen); err != nil {
+		return err
+	}
+	l.lastSeq, l.nextGen = Seq(lastSeq), Gen(nextGen)
+	return nil
 }
 
 type logWriter[T loggable] struct {
-	w    io.WriteCloser
-	sync func() error
+	// m serializes writes and syncs, so that the log can be synced in the background.
+	m      sync.Mutex
+	w      io.WriteCloser
+	sync   func() error
+	closed bool
+	// offset is the size of the log file, so that records are split at block boundaries.
+	offset int64
+	// unsynced is the number of bytes written since the last sync.
+	unsynced int
+	// buf and record are reused across writes.
+	buf    bytes.Buffer
+	record []byte
 }
 
-func newKVLogWriter(seq Seq) (*logWriter[*kvLog], error) {
-	_ = os.Remove(kvLogFile(seq))
-	w, err := os.OpenFile(kvLogFile(seq), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+func newKVLogWriter(fs vfs.FS, dir string, seq Seq) (*logWriter[*kvLog], error) {
+	_ = fs.Remove(kvLogFile(dir, seq))
+	w, err := fs.OpenFile(kvLogFile(dir, seq), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("kv log writer: fail to open file: %w", err)
 	}
-	return &logWriter[*kvLog]{w, w.Sync}, nil
+	return &logWriter[*kvLog]{w: w, sync: w.Sync}, nil
 }
 
-func newVersionLogWriter() (*logWriter[*versionLog], error) {
-	w, err := os.OpenFile(versionLogFile(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+func newVersionLogWriter(fs vfs.FS, name string) (*logWriter[*versionLog], error) {
+	w, err := fs.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("version log writer: fail to open file: %w", err)
 	}
-	return &logWriter[*versionLog]{w, w.Sync}, nil
+	// New logs are appended to the existing ones.
+	fi, err := w.Stat()
+	if err != nil {
+		_ = w.Close()
+		return nil, fmt.Errorf("version log writer: fail to stat file: %w", err)
+	}
+	return &logWriter[*versionLog]{w: w, sync: w.Sync, offset: fi.Size()}, nil
 }
 
+// Sync syncs all written logs. If the writer is closed, os.ErrClosed is returned.
 func (lw *logWriter[T]) Sync() error {
-	return lw.sync()
+	lw.m.Lock()
+	defer lw.m.Unlock()
+
+	if lw.closed {
+		return os.ErrClosed
+	}
+	if err := lw.sync(); err != nil {
+		return err
+	}
+	lw.unsynced = 0
+	return nil
 }
 
+// Write writes the log as a record. The whole record is written with a single call to the file.
 func (lw *logWriter[T]) Write(log T) error {
-	if _, err := log.write(lw.w); err != nil {
+	lw.m.Lock()
+	defer lw.m.Unlock()
+
+	lw.buf.Reset()
+	if _, err := log.write(&lw.buf); err != nil {
+		return fmt.Errorf("log writer: fail to encode log: %w", err)
+	}
+	lw.record = appendRecord(lw.record[:0], lw.offset, lw.buf.Bytes())
+	n, err := lw.w.Write(lw.record)
+	lw.offset += int64(n)
+	lw.unsynced += n
+	if err != nil {
 		return fmt.Errorf("log writer: fail to write log data: %w", err)
 	}
 	return nil
 }
 
+// Size returns the size of the log file.
+func (lw *logWriter[T]) Size() int64 {
+	lw.m.Lock()
+	defer lw.m.Unlock()
+
+	return lw.offset
+}
+
+// Unsynced returns the number of bytes written since the last sync.
+func (lw *logWriter[T]) Unsynced() int {
+	lw.m.Lock()
+	defer lw.m.Unlock()
+
+	return lw.unsynced
+}
+
 func (lw *logWriter[T]) Close() error {
+	lw.m.Lock()
+	defer lw.m.Unlock()
+
+	lw.closed = true
 	return lw.w.Close()
 }
 
+// logIter iterates over the logs in a log file. Next must be called before each Read.
 type logIter[T loggable] struct {
-	r     *bufio.Reader
+	r     *recordReader
 	close func() error
-	n     int
+	// record is the record read by Next, or err if it fails.
+	record []byte
+	offset int64
+	err    error
 }
 
-func newKVLogIter(seq Seq) (*logIter[*kvLog], error) {
-	r, err := os.Open(kvLogFile(seq))
+func newKVLogIter(fs vfs.FS, dir string, seq Seq) (*logIter[*kvLog], error) {
+	r, err := vfs.Open(fs, kvLogFile(dir, seq))
 	if err != nil {
 		return nil, fmt.Errorf("kv log iter: fail to open file: %w", err)
 	}
-	return &logIter[*kvLog]{bufio.NewReader(r), r.Close, 0}, nil
+	return &logIter[*kvLog]{r: newRecordReader(r, kvLogFile(dir, seq)), close: r.Close}, nil
 }
 
-func newVersionLogIter() (*logIter[*versionLog], error) {
-	r, err := os.Open(versionLogFile())
+func newVersionLogIter(fs vfs.FS, name string) (*logIter[*versionLog], error) {
+	r, err := vfs.Open(fs, name)
 	if err != nil {
 		return nil, fmt.Errorf("version log iter: fail to open file: %w", err)
 	}
-	return &logIter[*versionLog]{bufio.NewReader(r), r.Close, 0}, nil
+	return &logIter[*versionLog]{r: newRecordReader(r, name), close: r.Close}, nil
 }
 
 func (li *logIter[T]) Close() error {
 	return li.close()
 }
 
+// Next reads the next record. It returns false if there are no more records.
 func (li *logIter[T]) Next() bool {
-	_, err := li.r.Peek(1)
-	return err == nil
+	li.offset = li.r.pos()
+	li.record, li.err = li.r.next()
+	return !errors.Is(li.err, io.EOF)
 }
 
+// Read decodes the record read by Next into v. If the end of the file is torn, an *incompleteLogError is
+// returned. If the record is corrupted, a *LogCorruptionError is returned.
 func (li *logIter[T]) Read(v T) error {
-	if err := v.read(li.r); err != nil {
-		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
-			return &incompleteLogError{valid: li.n, remaining: li.r.Buffered()}
+	if li.err != nil {
+		return li.err
+	}
+	r := bytes.NewReader(li.record)
+	if err := v.read(r); err != nil || r.Len() > 0 {
+		if err == nil {
+			err = fmt.Errorf("%d bytes left", r.Len())
 		}
-		return fmt.Errorf("log reader: fail to read log data: %w", err)
+		return &LogCorruptionError{File: li.r.name, Offset: li.offset, Err: fmt.Errorf("fail to decode log: %w", err)}
 	}
-	li.n += v.sizeOnDisk()
 	return nil
 }
 
 const walExtension = ".wal"
 
-func kvLogFile(seq Seq) string {
-	return fmt.Sprintf("%d%s", seq, walExtension)
+func kvLogFile(dir string, seq Seq) string {
+	return filepath.Join(dir, fmt.Sprintf("%d%s", seq, walExtension))
 }
 
-func versionLogFile() string {
-	return "version" + walExtension
+// versionLogFile is the log of version changes before manifest files were introduced. It's only read to migrate
+// to a manifest file, if its records are framed (see appendRecord). See ErrLegacyVersionLog otherwise.
+func versionLogFile(dir string) string {
+	return filepath.Join(dir, "version"+walExtension)
 }
 
+// incompleteLogError is returned when a log file ends in the middle of a record.
 type incompleteLogError struct {
+	// valid is the size of the complete records.
 	valid     int
 	remaining int
-	want      int
 }
 
 func (e *incompleteLogError) Error() string {
 	return fmt.Sprintf("remaining %d bytes are incomplete", e.remaining)
 }
+
+// Is reports the torn end of a log file as a corruption, for callers that don't tolerate it.
+func (e *incompleteLogError) Is(target error) bool {
+	return target == ErrCorruption
+}
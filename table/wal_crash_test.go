@@ -0,0 +1,372 @@
+package table
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/liznear/leveldb-from-scratch/vfs"
+)
+
+// TestWAL_Crash writes some KVs, crashes the file system and then recovers the DB from what was synced. Every
+// acknowledged write must be recovered.
+func TestWAL_Crash(t *testing.T) {
+	errInjected := errors.New("injected")
+
+	tcs := []struct {
+		name string
+		opts []Option
+		// n is the number of acknowledged puts before the crash.
+		n int
+		// beforeCrash is called after the acknowledged puts, right before the crash. It returns the number of
+		// unsynced bytes of the last write that survive the crash.
+		beforeCrash func(t *testing.T, db *DB, fs *vfs.FaultFS) (tear int)
+		// recoveries is the number of times we crash again right after recovering.
+		recoveries int
+	}{
+		{
+			name: "MemTableOnly",
+			n:    10,
+		},
+		{
+			name: "FlushAndCompaction",
+			opts: []Option{
+				WithMaxMemTableSize(30),
+				WithMaxSSTableSize(30),
+				WithCompactionConfig(1, 1),
+			},
+			n: 100,
+		},
+		{
+			name: "RepeatedRecovery",
+			opts: []Option{
+				WithMaxMemTableSize(30),
+				WithMaxSSTableSize(30),
+				WithCompactionConfig(1, 1),
+			},
+			n:          100,
+			recoveries: 3,
+		},
+		{
+			name: "TornKVLog",
+			n:    10,
+			beforeCrash: func(t *testing.T, db *DB, fs *vfs.FaultFS) int {
+				// The last put is written to the WAL, but not synced, so it is not acknowledged.
+				fs.InjectError(func(op vfs.Op, name string) error {
+					if op == vfs.OpSync && filepath.Ext(name) == walExtension {
+						return errInjected
+					}
+					return nil
+				})
+				defer fs.InjectError(nil)
+				if err := db.Put("Unacknowledged", []byte("Value")); !errors.Is(err, errInjected) {
+					t.Fatalf("Got error %v, want %v", err, errInjected)
+				}
+				return 5
+			},
+		},
+		{
+			name: "TornBatch",
+			n:    10,
+			beforeCrash: func(t *testing.T, db *DB, fs *vfs.FaultFS) int {
+				// Only half of a batch reaches the disk. None of its writes may be recovered.
+				fs.InjectError(func(op vfs.Op, name string) error {
+					if op == vfs.OpSync && filepath.Ext(name) == walExtension {
+						return errInjected
+					}
+					return nil
+				})
+				defer fs.InjectError(nil)
+				b := &WriteBatch{}
+				b.Put("Key0", []byte("Overwritten"))
+				b.Delete("Key1")
+				b.Put("Unacknowledged", []byte("Value"))
+				if err := db.Write(b, WriteOptions{Sync: true}); !errors.Is(err, errInjected) {
+					t.Fatalf("Got error %v, want %v", err, errInjected)
+				}
+				return newKVLog(1, b).sizeOnDisk() / 2
+			},
+		},
+		{
+			name: "TornVersionLog",
+			opts: []Option{
+				WithMaxMemTableSize(30),
+				WithMaxSSTableSize(30),
+				WithCompactionConfig(1, 1),
+			},
+			n: 100,
+			beforeCrash: func(t *testing.T, db *DB, fs *vfs.FaultFS) int {
+				// Only half of a version log reaches the disk.
+				buf := bytes.Buffer{}
+				if _, err := (&versionLog{add: []Gen{1000}, seq: 1}).write(&buf); err != nil {
+					t.Fatal(err)
+				}
+				num, err := readCurrent(fs, ".")
+				if err != nil {
+					t.Fatal(err)
+				}
+				f, err := fs.OpenFile(manifestFile(".", num), os.O_WRONLY|os.O_APPEND, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				fi, err := f.Stat()
+				if err != nil {
+					t.Fatal(err)
+				}
+				record := appendRecord(nil, fi.Size(), buf.Bytes())
+				if _, err := f.Write(record[:len(record)/2]); err != nil {
+					t.Fatal(err)
+				}
+				if err := f.Sync(); err != nil {
+					t.Fatal(err)
+				}
+				return 0
+			},
+			// The truncated version log must be usable by the recovered DB.
+			recoveries: 1,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := vfs.NewFault()
+			opts := append([]Option{WithFS(fs)}, tc.opts...)
+
+			want := make(map[string]string)
+			db, err := NewDB(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < tc.n; i++ {
+				k, v := fmt.Sprintf("Key%d", i), fmt.Sprintf("Value%d", i)
+				if err := db.Put(k, []byte(v)); err != nil {
+					t.Fatal(err)
+				}
+				want[k] = v
+			}
+			// Persisting a MemTable in the background would fail after the crash. Wait until it is done.
+			db.waitPersist()
+
+			tear := 0
+			if tc.beforeCrash != nil {
+				tear = tc.beforeCrash(t, db, fs)
+			}
+			// The crashed DB is abandoned. It can't be closed since its files are gone.
+			fs.CrashTorn(tear)
+
+			for i := 0; i <= tc.recoveries; i++ {
+				db, err = NewDB(opts...)
+				if err != nil {
+					t.Fatalf("Fail to recover: %v", err)
+				}
+				verifyKVs(t, db, want)
+				db.waitPersist()
+				fs.Crash()
+			}
+		})
+	}
+}
+
+func verifyKVs(t *testing.T, db *DB, want map[string]string) {
+	t.Helper()
+
+	for k, v := range want {
+		got, ok, err := db.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Errorf("%s not found", k)
+		} else if string(got) != v {
+			t.Errorf("Got %s=%q, want %q", k, got, v)
+		}
+	}
+	if _, ok, err := db.Get("Unacknowledged"); err != nil || ok {
+		t.Errorf("Got unacknowledged write, err: %v", err)
+	}
+}
+
+// TestWAL_CrashUnsynced writes KVs without WriteOptions.Sync and then crashes. Whether they survive depends on
+// what synced the WAL.
+func TestWAL_CrashUnsynced(t *testing.T) {
+	tcs := []struct {
+		name string
+		opts []Option
+		// afterWrites is called after the unsynced writes, right before the crash.
+		afterWrites func(t *testing.T, db *DB)
+		wantLost    bool
+	}{
+		{
+			name:     "NotSynced",
+			wantLost: true,
+		},
+		{
+			name: "SyncedByLaterWrite",
+			afterWrites: func(t *testing.T, db *DB) {
+				if err := db.Put("Synced", []byte("Value")); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "SyncedByBytes",
+			opts: []Option{WithWALSyncBytes(1)},
+		},
+		{
+			name: "SyncedByInterval",
+			opts: []Option{WithWALSyncInterval(time.Millisecond)},
+			afterWrites: func(t *testing.T, db *DB) {
+				time.Sleep(50 * time.Millisecond)
+			},
+		},
+		{
+			name: "SyncedByMemTableSwitch",
+			opts: []Option{WithMaxMemTableSize(100)},
+			afterWrites: func(t *testing.T, db *DB) {
+				// Fill the MemTable with a synced write, so that it's persisted.
+				if err := db.Put("Synced", make([]byte, 100)); err != nil {
+					t.Fatal(err)
+				}
+				db.waitPersist()
+			},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := vfs.NewFault()
+			opts := append([]Option{WithFS(fs)}, tc.opts...)
+			db, err := NewDB(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := make(map[string]string)
+			for i := 0; i < 3; i++ {
+				k, v := fmt.Sprintf("Key%d", i), fmt.Sprintf("Value%d", i)
+				b := &WriteBatch{}
+				b.Put(k, []byte(v))
+				if err := db.Write(b, WriteOptions{}); err != nil {
+					t.Fatal(err)
+				}
+				want[k] = v
+			}
+			if tc.afterWrites != nil {
+				tc.afterWrites(t, db)
+			}
+			db.waitPersist()
+			fs.Crash()
+			// The crashed DB is abandoned. Stop its background syncer.
+			close(db.closing)
+
+			db, err = NewDB(opts...)
+			if err != nil {
+				t.Fatalf("Fail to recover: %v", err)
+			}
+			defer db.Close()
+			if !tc.wantLost {
+				verifyKVs(t, db, want)
+				return
+			}
+			for k := range want {
+				if _, ok, err := db.Get(k); err != nil || ok {
+					t.Errorf("Got unsynced %s after crash, err: %v", k, err)
+				}
+			}
+		})
+	}
+}
+
+// TestWAL_CrashDisableWAL writes KVs with WriteOptions.DisableWAL. They survive a crash only if they are flushed.
+func TestWAL_CrashDisableWAL(t *testing.T) {
+	tcs := []struct {
+		name string
+		// afterWrites is called after the writes. It returns whether the DB is abandoned by a crash.
+		afterWrites func(t *testing.T, db *DB, fs *vfs.FaultFS) (crash bool)
+		wantLost    bool
+	}{
+		{
+			name: "Crash",
+			afterWrites: func(t *testing.T, db *DB, fs *vfs.FaultFS) bool {
+				// A synced write with WAL doesn't make the writes without WAL durable.
+				if err := db.Put("Synced", []byte("Value")); err != nil {
+					t.Fatal(err)
+				}
+				return true
+			},
+			wantLost: true,
+		},
+		{
+			name: "FlushAndCrash",
+			afterWrites: func(t *testing.T, db *DB, fs *vfs.FaultFS) bool {
+				if err := db.Flush(); err != nil {
+					t.Fatal(err)
+				}
+				return true
+			},
+		},
+		{
+			name: "Close",
+			afterWrites: func(t *testing.T, db *DB, fs *vfs.FaultFS) bool {
+				if err := db.Close(); err != nil {
+					t.Fatal(err)
+				}
+				return false
+			},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := vfs.NewFault()
+			db, err := NewDB(WithFS(fs))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			walSize := func() int64 {
+				info, err := fs.Stat(kvLogFile(".", db.mem.seq))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return info.Size()
+			}
+			size := walSize()
+			want := make(map[string]string)
+			for i := 0; i < 3; i++ {
+				k, v := fmt.Sprintf("Key%d", i), fmt.Sprintf("Value%d", i)
+				b := &WriteBatch{}
+				b.Put(k, []byte(v))
+				if err := db.Write(b, WriteOptions{DisableWAL: true}); err != nil {
+					t.Fatal(err)
+				}
+				want[k] = v
+			}
+			if got := walSize(); got != size {
+				t.Errorf("Got WAL size %d, want %d", got, size)
+			}
+
+			if tc.afterWrites(t, db, fs) {
+				db.waitPersist()
+				fs.Crash()
+			}
+
+			db, err = NewDB(WithFS(fs))
+			if err != nil {
+				t.Fatalf("Fail to recover: %v", err)
+			}
+			defer db.Close()
+			if !tc.wantLost {
+				verifyKVs(t, db, want)
+				return
+			}
+			for k := range want {
+				if _, ok, err := db.Get(k); err != nil || ok {
+					t.Errorf("Got %s written without WAL after crash, err: %v", k, err)
+				}
+			}
+		})
+	}
+}
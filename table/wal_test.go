@@ -2,13 +2,21 @@ package table
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"reflect"
 	"testing"
+
+	"github.com/liznear/leveldb-from-scratch/vfs"
 )
 
 func TestWAL_KVLog(t *testing.T) {
-	log := newKVLog("Hello", []byte("World"))
+	b := &WriteBatch{}
+	b.Put("Hello", []byte("World"))
+	b.Delete("Foo")
+	b.Put("Hello", []byte("Again"))
+	log := newKVLog(1, b)
 
 	buf := bytes.Buffer{}
 	if _, err := log.write(&buf); err != nil {
@@ -22,8 +30,16 @@ func TestWAL_KVLog(t *testing.T) {
 	if buf.Len() > 0 {
 		t.Errorf("Got %d remaining bytes", buf.Len())
 	}
-	if !kvEqual(&log.kv, &got.kv) {
-		t.Errorf("Got %s, want %s", &got.kv, &log.kv)
+	if len(got.kvs) != len(log.kvs) {
+		t.Fatalf("Got %d kvs, want %d", len(got.kvs), len(log.kvs))
+	}
+	for i := range got.kvs {
+		if !kvEqual(&got.kvs[i], &log.kvs[i]) {
+			t.Errorf("Got %s, want %s", &got.kvs[i], &log.kvs[i])
+		}
+		if want := Seq(i + 1); got.kvs[i].key.seq != want {
+			t.Errorf("Got seq %d, want %d", got.kvs[i].key.seq, want)
+		}
 	}
 }
 
@@ -46,7 +62,7 @@ func TestWAL_Version(t *testing.T) {
 	}
 	for _, tc := range tcs {
 		t.Run(tc.name, func(t *testing.T) {
-			log := versionLog{tc.del, tc.add, 1}
+			log := versionLog{del: tc.del, add: tc.add, seq: 1, lastSeq: 10, nextGen: 6}
 
 			buf := bytes.Buffer{}
 			if _, err := log.write(&buf); err != nil {
@@ -66,12 +82,15 @@ func TestWAL_Version(t *testing.T) {
 			if !reflect.DeepEqual(tc.add, got.add) {
 				t.Errorf("Got add %v, want %v", got.add, tc.add)
 			}
+			if got.seq != log.seq || got.lastSeq != log.lastSeq || got.nextGen != log.nextGen {
+				t.Errorf("Got seq %d, last seq %d, next gen %d, want %d, %d, %d", got.seq, got.lastSeq, got.nextGen, log.seq, log.lastSeq, log.nextGen)
+			}
 		})
 	}
 }
 
 func TestWAL_ReadWrite(t *testing.T) {
-	defer EnterTempDir(t)()
+	fs := vfs.NewMem()
 
 	c := 10
 	var kvs []kv
@@ -79,12 +98,12 @@ func TestWAL_ReadWrite(t *testing.T) {
 		kvs = append(kvs, newKV(fmt.Sprintf("Key%d", i), []byte(fmt.Sprintf("Value%d", i))))
 	}
 
-	w, err := newKVLogWriter(1)
+	w, err := newKVLogWriter(fs, ".", 1)
 	if err != nil {
 		t.Fatal(err)
 	}
 	for i := 0; i < c; i++ {
-		if err = w.Write(&kvLog{kv: kvs[i]}); err != nil {
+		if err = w.Write(&kvLog{kvs: kvs[i : i+1]}); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -92,7 +111,7 @@ func TestWAL_ReadWrite(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	r, err := newKVLogIter(1)
+	r, err := newKVLogIter(fs, ".", 1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -107,8 +126,200 @@ func TestWAL_ReadWrite(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if !kvEqual(&got.kv, &kvs[i]) {
-			t.Errorf("Got %s, want %s", &got.kv, &kvs[i])
+		if len(got.kvs) != 1 || !kvEqual(&got.kvs[0], &kvs[i]) {
+			t.Errorf("Got %v, want %s", got.kvs, &kvs[i])
 		}
 	}
 }
+
+func TestWAL_Records(t *testing.T) {
+	// The first record leaves less than a header in the first block, so the block is padded.
+	sizes := []int{logBlockSize - logHeaderSize - 3, 0, 10, logBlockSize - logHeaderSize, 3 * logBlockSize, 100}
+	var records [][]byte
+	var buf []byte
+	for i, n := range sizes {
+		r := bytes.Repeat([]byte{byte('a' + i)}, n)
+		records = append(records, r)
+		buf = appendRecord(buf, int64(len(buf)), r)
+	}
+
+	r := newRecordReader(bytes.NewReader(buf), "test")
+	for i, want := range records {
+		got, err := r.next()
+		if err != nil {
+			t.Fatalf("Fail to read record %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Got record %d of %d bytes, want %d bytes", i, len(got), len(want))
+		}
+	}
+	if _, err := r.next(); err != io.EOF {
+		t.Errorf("Got error %v, want %v", err, io.EOF)
+	}
+}
+
+func TestWAL_RecordErrors(t *testing.T) {
+	var buf []byte
+	var offsets []int64
+	// Records in 3 blocks.
+	for _, n := range []int{10, logBlockSize, 10} {
+		offsets = append(offsets, int64(len(buf)))
+		buf = appendRecord(buf, int64(len(buf)), bytes.Repeat([]byte{'a'}, n))
+	}
+	tcs := []struct {
+		name  string
+		data  func() []byte
+		check func(t *testing.T, r *recordReader)
+	}{
+		{
+			name: "Checksum",
+			data: func() []byte {
+				data := bytes.Clone(buf)
+				data[offsets[0]+logHeaderSize] ^= 0xff
+				return data
+			},
+			check: func(t *testing.T, r *recordReader) {
+				_, err := r.next()
+				cerr := &LogCorruptionError{}
+				if !errors.Is(err, ErrCorruption) || !errors.As(err, &cerr) {
+					t.Fatalf("Got error %v, want %v", err, ErrCorruption)
+				}
+				if cerr.Offset != offsets[0] {
+					t.Errorf("Got corruption at %d, want %d", cerr.Offset, offsets[0])
+				}
+				// The rest of the first block is dropped, so the record starting in it isn't started.
+				if got, err := r.next(); !errors.Is(err, ErrCorruption) {
+					t.Errorf("Got %d bytes, %v, want %v", len(got), err, ErrCorruption)
+				}
+				if got, err := r.next(); err != nil || len(got) != 10 {
+					t.Errorf("Got %d bytes, %v, want the last record", len(got), err)
+				}
+			},
+		},
+		{
+			name: "Length",
+			data: func() []byte {
+				data := bytes.Clone(buf)
+				data[offsets[0]+4] = 0xff
+				return data
+			},
+			check: func(t *testing.T, r *recordReader) {
+				if _, err := r.next(); !errors.Is(err, ErrCorruption) {
+					t.Errorf("Got error %v, want %v", err, ErrCorruption)
+				}
+			},
+		},
+		{
+			name: "TornTail",
+			data: func() []byte {
+				return buf[:len(buf)-3]
+			},
+			check: func(t *testing.T, r *recordReader) {
+				for i := 0; i < 2; i++ {
+					if _, err := r.next(); err != nil {
+						t.Fatal(err)
+					}
+				}
+				_, err := r.next()
+				ierr := &incompleteLogError{}
+				if !errors.As(err, &ierr) {
+					t.Fatalf("Got error %v, want %T", err, ierr)
+				}
+				if int64(ierr.valid) != offsets[2] {
+					t.Errorf("Got %d valid bytes, want %d", ierr.valid, offsets[2])
+				}
+				if _, err := r.next(); err != io.EOF {
+					t.Errorf("Got error %v, want %v", err, io.EOF)
+				}
+			},
+		},
+		{
+			name: "TornFragmentedRecord",
+			data: func() []byte {
+				return buf[:offsets[2]-10]
+			},
+			check: func(t *testing.T, r *recordReader) {
+				if _, err := r.next(); err != nil {
+					t.Fatal(err)
+				}
+				_, err := r.next()
+				ierr := &incompleteLogError{}
+				if !errors.As(err, &ierr) {
+					t.Fatalf("Got error %v, want %T", err, ierr)
+				}
+				if int64(ierr.valid) != offsets[1] {
+					t.Errorf("Got %d valid bytes, want %d", ierr.valid, offsets[1])
+				}
+			},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.check(t, newRecordReader(bytes.NewReader(tc.data()), "test"))
+		})
+	}
+}
+
+func TestWAL_RecordNotEnded(t *testing.T) {
+	// The first fragment of a record spanning 2 blocks, without the rest of it.
+	unended := appendRecord(nil, 0, bytes.Repeat([]byte{'a'}, logBlockSize))[:logBlockSize]
+	tcs := []struct {
+		name string
+		// next is the record after the unended one. It's read from the start of the second block.
+		next []byte
+	}{
+		{
+			name: "Full",
+			next: bytes.Repeat([]byte{'b'}, 10),
+		},
+		{
+			name: "First",
+			next: bytes.Repeat([]byte{'b'}, 2*logBlockSize),
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := appendRecord(bytes.Clone(unended), int64(len(unended)), tc.next)
+			r := newRecordReader(bytes.NewReader(buf), "test")
+			_, err := r.next()
+			cerr := &LogCorruptionError{}
+			if !errors.As(err, &cerr) || cerr.Offset != 0 {
+				t.Fatalf("Got error %v, want corruption at 0", err)
+			}
+			if got, err := r.next(); err != nil || !bytes.Equal(got, tc.next) {
+				t.Errorf("Got %d bytes, %v, want %d bytes", len(got), err, len(tc.next))
+			}
+			if _, err := r.next(); err != io.EOF {
+				t.Errorf("Got error %v, want %v", err, io.EOF)
+			}
+		})
+	}
+}
+
+func TestWAL_Corrupted(t *testing.T) {
+	fs := vfs.NewMem()
+	w, err := newKVLogWriter(fs, ".", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(&kvLog{kvs: []kv{newKV("Key", []byte("Value"))}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Corrupt the length of the key, which would be a huge allocation without the checksum.
+	corruptFile(t, fs, kvLogFile(".", 1), logHeaderSize+4)
+
+	r, err := newKVLogIter(fs, ".", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if !r.Next() {
+		t.Fatalf("Got no record, want a corrupted one")
+	}
+	if err := r.Read(&kvLog{}); !errors.Is(err, ErrCorruption) {
+		t.Errorf("Got error %v, want %v", err, ErrCorruption)
+	}
+}
@@ -0,0 +1,102 @@
+package table
+
+// maxGroupSize is the max size of the writes committed in a group. It bounds the latency of the leader's own
+// write.
+const maxGroupSize = 1 << 20 // 1MB
+
+// writer is a Write or Flush waiting in the write queue (DB.writers).
+type writer struct {
+	batch *WriteBatch
+	opts  WriteOptions
+	// flush is true for a Flush, which has no batch.
+	flush bool
+
+	// done is set once the batch is committed, and err is the result.
+	done bool
+	err  error
+}
+
+// enqueue adds w to the write queue, and waits until it's done.
+//
+// The writer at the front of the queue is the leader. It takes a group of writers at the front, commits them
+// together, and then wakes them up. Other writers can join the queue while the leader is committing. Once the DB
+// is closed, ErrClosed is returned.
+func (db *DB) enqueue(w *writer) error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	db.writers = append(db.writers, w)
+	for !w.done && db.writers[0] != w {
+		db.writeCond.Wait()
+	}
+	if w.done {
+		// Committed by a leader.
+		return w.err
+	}
+
+	// w is the leader now.
+	var (
+		group []*writer
+		err   error
+	)
+	if w.flush {
+		group = db.writers[:1]
+		db.writeMu.Unlock()
+		err = db.flush()
+	} else {
+		var (
+			batch *WriteBatch
+			opts  WriteOptions
+		)
+		group, batch, opts = db.buildGroup()
+		db.writeMu.Unlock()
+		err = db.commit(batch, opts)
+	}
+	db.writeMu.Lock()
+
+	for _, f := range group {
+		f.done = true
+		f.err = err
+	}
+	db.writers = db.writers[len(group):]
+	db.writeCond.Broadcast()
+	return err
+}
+
+// buildGroup returns the writers at the front of the queue to be committed together by the leader (the first
+// one), a batch containing all their writes, and the options to commit the batch. The batches are kept in the
+// queue order. If any writer in the group needs a sync, the group is synced.
+//
+// A group doesn't mix writes with and without WAL, and it stops at a Flush.
+//
+// It must be called with writeMu held.
+func (db *DB) buildGroup() (_ []*writer, _ *WriteBatch, opts WriteOptions) {
+	leader := db.writers[0]
+	size := leader.batch.size()
+	opts = leader.opts
+	n := 1
+	for ; n < len(db.writers); n++ {
+		w := db.writers[n]
+		if w.flush || w.opts.DisableWAL != leader.opts.DisableWAL {
+			break
+		}
+		size += w.batch.size()
+		if size > maxGroupSize {
+			break
+		}
+		opts.Sync = opts.Sync || w.opts.Sync
+	}
+	if n == 1 {
+		return db.writers[:1], leader.batch, opts
+	}
+
+	batch := &WriteBatch{}
+	for _, w := range db.writers[:n] {
+		batch.append(w.batch)
+	}
+	return db.writers[:n], batch, opts
+}
@@ -0,0 +1,199 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/liznear/leveldb-from-scratch/vfs"
+)
+
+func TestDB_GroupCommit(t *testing.T) {
+	fs := vfs.NewFault()
+	db, err := NewDB(WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// A slow WAL sync makes concurrent writers pile up in the queue.
+	var syncs atomic.Int32
+	fs.InjectError(func(op vfs.Op, name string) error {
+		if op == vfs.OpSync && filepath.Ext(name) == walExtension {
+			syncs.Add(1)
+			time.Sleep(time.Millisecond)
+		}
+		return nil
+	})
+	defer fs.InjectError(nil)
+
+	goroutines, n := 8, 50
+	wg := sync.WaitGroup{}
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				b := &WriteBatch{}
+				b.Put(fmt.Sprintf("Key%d-%d", g, i), []byte(fmt.Sprintf("Value%d", i)))
+				b.Put(fmt.Sprintf("Other%d-%d", g, i), []byte(fmt.Sprintf("Value%d", i)))
+				if err := db.Write(b, WriteOptions{Sync: true}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, writes := int(syncs.Load()), goroutines*n; got >= writes {
+		t.Errorf("Got %d syncs for %d writes, want fewer", got, writes)
+	}
+	want := make(map[string]string)
+	for g := 0; g < goroutines; g++ {
+		for i := 0; i < n; i++ {
+			want[fmt.Sprintf("Key%d-%d", g, i)] = fmt.Sprintf("Value%d", i)
+			want[fmt.Sprintf("Other%d-%d", g, i)] = fmt.Sprintf("Value%d", i)
+		}
+	}
+	verifyKVs(t, db, want)
+}
+
+func TestDB_BuildGroup(t *testing.T) {
+	batch := func(size int) *WriteBatch {
+		b := &WriteBatch{}
+		// Each kv takes 16 bytes besides the key and the value.
+		b.Put("", make([]byte, size-16))
+		return b
+	}
+
+	tcs := []struct {
+		name  string
+		sizes []int
+		want  int
+	}{
+		{name: "Single", sizes: []int{100}, want: 1},
+		{name: "All", sizes: []int{100, 100, 100}, want: 3},
+		{name: "LimitedBySize", sizes: []int{maxGroupSize / 2, maxGroupSize / 2, 100}, want: 2},
+		{name: "LargeLeader", sizes: []int{maxGroupSize * 2, 100}, want: 1},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			db := &DB{}
+			wantLen := 0
+			for i, size := range tc.sizes {
+				db.writers = append(db.writers, &writer{batch: batch(size)})
+				if i < tc.want {
+					wantLen++
+				}
+			}
+
+			group, b, _ := db.buildGroup()
+			if len(group) != tc.want {
+				t.Fatalf("Got group of %d writers, want %d", len(group), tc.want)
+			}
+			if b.Len() != wantLen {
+				t.Errorf("Got batch of %d writes, want %d", b.Len(), wantLen)
+			}
+		})
+	}
+}
+
+// BenchmarkDB_ConcurrentPut shows how the throughput of synced writes scales with the number of concurrent
+// writers. It uses the OS file system, since the cost of fsync is what group commit saves.
+func BenchmarkDB_ConcurrentPut(b *testing.B) {
+	for _, goroutines := range []int{1, 2, 4, 8, 16, 32} {
+		b.Run(fmt.Sprintf("Goroutines%d", goroutines), func(b *testing.B) {
+			db, err := NewDB(WithDir(b.TempDir()))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			value := make([]byte, 100)
+			var next atomic.Int64
+			wg := sync.WaitGroup{}
+			b.ResetTimer()
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := next.Add(1); i <= int64(b.N); i = next.Add(1) {
+						if err := db.Put(fmt.Sprintf("Key%d", i), value); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestDB_CloseWithPendingWrites(t *testing.T) {
+	fs := vfs.NewMem()
+	opts := []Option{WithFS(fs), WithMaxMemTableSize(200)}
+	db, err := NewDB(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	goroutines := 8
+	acked := make([][]string, goroutines)
+	started := sync.WaitGroup{}
+	wg := sync.WaitGroup{}
+	// Close once every writer has written a few KVs.
+	started.Add(goroutines)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var once sync.Once
+			defer once.Do(started.Done)
+			for i := 0; ; i++ {
+				if i == 10 {
+					once.Do(started.Done)
+				}
+				k := fmt.Sprintf("Key%d-%d", g, i)
+				b := &WriteBatch{}
+				b.Put(k, []byte(k))
+				// Writes without WAL are only persisted by the flush in Close.
+				err := db.Write(b, WriteOptions{DisableWAL: g%2 == 0})
+				if errors.Is(err, ErrClosed) {
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				acked[g] = append(acked[g], k)
+			}
+		}()
+	}
+	started.Wait()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if err := db.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Got error %v, want %v", err, ErrClosed)
+	}
+
+	db, err = NewDB(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := make(map[string]string)
+	for _, keys := range acked {
+		for _, k := range keys {
+			want[k] = k
+		}
+	}
+	verifyKVs(t, db, want)
+}
@@ -10,10 +10,10 @@ import (
 // WriteWithUint32Length writes the length of the bytes as uint32 and then the bytes to the writer.
 func WriteWithUint32Length(w io.Writer, bs []byte) (int, error) {
 	if err := binary.Write(w, binary.BigEndian, uint32(len(bs))); err != nil {
-		return 0, fmt.Errorf("fail to write length: %v", err)
+		return 0, fmt.Errorf("fail to write length: %w", err)
 	}
 	if n, err := w.Write(bs); err != nil {
-		return 4 + n, fmt.Errorf("fail to write bytes: %v", err)
+		return 4 + n, fmt.Errorf("fail to write bytes: %w", err)
 	}
 	return 4 + len(bs), nil
 }
@@ -31,13 +31,13 @@ func ReadWithUint32Length(r io.Reader) ([]byte, error) {
 		if errors.Is(err, io.EOF) {
 			return nil, err
 		}
-		return nil, fmt.Errorf("fail to read length: %v", err)
+		return nil, fmt.Errorf("fail to read length: %w", err)
 	}
 
 	bs := make([]byte, l)
 
 	if _, err := io.ReadFull(r, bs); err != nil {
-		return nil, fmt.Errorf("fail to read bytes: %v", err)
+		return nil, fmt.Errorf("fail to read bytes: %w", err)
 	}
 	return bs, nil
 }
@@ -0,0 +1,212 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrCrashed is returned by the files opened before FaultFS.Crash is called.
+var ErrCrashed = errors.New("vfs: file system crashed")
+
+// Op is the kind of operation on a FaultFS. It is used to decide which operation an error is injected into.
+type Op int
+
+const (
+	OpOpen Op = iota
+	OpRead
+	OpWrite
+	OpSync
+	OpClose
+	OpRemove
+	OpRename
+	OpTruncate
+	OpLock
+)
+
+// FaultFS is an in-memory FS for crash tests. It tracks which bytes of each file were synced, and it can
+// simulate a crash that loses all unsynced data. Errors can be injected into chosen operations.
+//
+// Only the file content needs to be synced. Creating, removing and renaming files are durable immediately.
+type FaultFS struct {
+	*MemFS
+
+	mu sync.Mutex
+	// durable is the synced content of each file.
+	durable map[*memData][]byte
+	// last is the file written most recently.
+	last *memData
+	// epoch is increased on every crash. Files opened in an earlier epoch are no longer usable.
+	epoch  int
+	inject func(op Op, name string) error
+}
+
+// NewFault returns an empty FaultFS.
+func NewFault() *FaultFS {
+	return &FaultFS{
+		MemFS:   NewMem(),
+		durable: make(map[*memData][]byte),
+	}
+}
+
+// InjectError sets f to be called before every operation. If f returns an error, the operation fails with the
+// error without doing anything. A nil f stops the injection.
+func (fs *FaultFS) InjectError(f func(op Op, name string) error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.inject = f
+}
+
+// Crash simulates a power failure. Every file is reverted to the content of its last sync, and all locks are
+// released. Files opened before the crash become unusable.
+func (fs *FaultFS) Crash() {
+	fs.CrashTorn(0)
+}
+
+// CrashTorn is like Crash, but the first n unsynced bytes of the file written most recently survive, as if
+// the crash happened in the middle of writing them. Files are assumed to be appended only.
+func (fs *FaultFS) CrashTorn(n int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.MemFS.mu.Lock()
+	defer fs.MemFS.mu.Unlock()
+
+	durable := make(map[*memData][]byte)
+	for name, d := range fs.MemFS.files {
+		d.mu.RLock()
+		content := append([]byte(nil), fs.durable[d]...)
+		if d == fs.last && n > 0 && len(d.data) > len(content) {
+			content = append(content, d.data[len(content):min(len(content)+n, len(d.data))]...)
+		}
+		d.mu.RUnlock()
+
+		// Use a new memData, so that writes through the handles opened before the crash can't reach it.
+		nd := &memData{data: content, modTime: d.modTime}
+		fs.MemFS.files[name] = nd
+		durable[nd] = append([]byte(nil), content...)
+	}
+	fs.durable = durable
+	fs.last = nil
+	fs.MemFS.locked = make(map[string]bool)
+	fs.epoch++
+}
+
+func (fs *FaultFS) check(op Op, name string) error {
+	fs.mu.Lock()
+	inject := fs.inject
+	fs.mu.Unlock()
+	if inject == nil {
+		return nil
+	}
+	return inject(op, name)
+}
+
+func (fs *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if err := fs.check(OpOpen, name); err != nil {
+		return nil, err
+	}
+	f, err := fs.MemFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return &faultFile{memFile: f.(*memFile), fs: fs, epoch: fs.epoch}, nil
+}
+
+func (fs *FaultFS) Remove(name string) error {
+	if err := fs.check(OpRemove, name); err != nil {
+		return err
+	}
+	return fs.MemFS.Remove(name)
+}
+
+func (fs *FaultFS) Rename(oldname, newname string) error {
+	if err := fs.check(OpRename, oldname); err != nil {
+		return err
+	}
+	return fs.MemFS.Rename(oldname, newname)
+}
+
+func (fs *FaultFS) Truncate(name string, size int64) error {
+	if err := fs.check(OpTruncate, name); err != nil {
+		return err
+	}
+	return fs.MemFS.Truncate(name, size)
+}
+
+func (fs *FaultFS) Lock(name string) (io.Closer, error) {
+	if err := fs.check(OpLock, name); err != nil {
+		return nil, err
+	}
+	return fs.MemFS.Lock(name)
+}
+
+// faultFile is an opened file in FaultFS.
+type faultFile struct {
+	*memFile
+	fs    *FaultFS
+	epoch int
+}
+
+// check returns an error if the file is opened before a crash, or an error is injected.
+func (f *faultFile) check(op Op) error {
+	f.fs.mu.Lock()
+	crashed := f.epoch != f.fs.epoch
+	f.fs.mu.Unlock()
+	if crashed {
+		return &os.PathError{Op: "fault", Path: f.name, Err: ErrCrashed}
+	}
+	return f.fs.check(op, f.name)
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.check(OpRead); err != nil {
+		return 0, err
+	}
+	return f.memFile.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check(OpRead); err != nil {
+		return 0, err
+	}
+	return f.memFile.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if err := f.check(OpWrite); err != nil {
+		return 0, err
+	}
+	n, err := f.memFile.Write(p)
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.fs.last = f.data
+	return n, err
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.check(OpSync); err != nil {
+		return err
+	}
+	if err := f.memFile.Sync(); err != nil {
+		return err
+	}
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.data.mu.RLock()
+	defer f.data.mu.RUnlock()
+	f.fs.durable[f.data] = append([]byte(nil), f.data.data...)
+	return nil
+}
+
+func (f *faultFile) Close() error {
+	if err := f.check(OpClose); err != nil {
+		return err
+	}
+	return f.memFile.Close()
+}
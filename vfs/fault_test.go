@@ -0,0 +1,118 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestFaultFS_Crash(t *testing.T) {
+	tcs := []struct {
+		name string
+		tear int
+		want string
+	}{
+		{
+			name: "DropUnsynced",
+			tear: 0,
+			want: "Synced",
+		},
+		{
+			name: "TornWrite",
+			tear: 3,
+			want: "SyncedUns",
+		},
+		{
+			name: "TearMoreThanWritten",
+			tear: 100,
+			want: "SyncedUnsynced",
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := NewFault()
+			f, err := fs.OpenFile("file", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write([]byte("Synced")); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			writeFile(t, fs, "never-synced", "Data")
+			// "file" is the file written most recently, so it is the one being torn.
+			if _, err := f.Write([]byte("Unsynced")); err != nil {
+				t.Fatal(err)
+			}
+
+			// Before crashing, all written data is visible.
+			if got := readFile(t, fs, "file"); got != "SyncedUnsynced" {
+				t.Errorf("Got %q before crash, want %q", got, "SyncedUnsynced")
+			}
+
+			fs.CrashTorn(tc.tear)
+
+			if got := readFile(t, fs, "file"); got != tc.want {
+				t.Errorf("Got %q, want %q", got, tc.want)
+			}
+			if got := readFile(t, fs, "never-synced"); got != "" {
+				t.Errorf("Got %q from never synced file, want empty", got)
+			}
+			if _, err := f.Write([]byte("x")); !errors.Is(err, ErrCrashed) {
+				t.Errorf("Got error %v writing through a handle opened before crash, want %v", err, ErrCrashed)
+			}
+		})
+	}
+}
+
+func TestFaultFS_CrashReleasesLock(t *testing.T) {
+	fs := NewFault()
+	if _, err := fs.Lock("LOCK"); err != nil {
+		t.Fatal(err)
+	}
+	fs.Crash()
+	l, err := fs.Lock("LOCK")
+	if err != nil {
+		t.Fatalf("Fail to lock after crash: %v", err)
+	}
+	_ = l.Close()
+}
+
+func TestFaultFS_InjectError(t *testing.T) {
+	fs := NewFault()
+	injected := errors.New("injected")
+	fs.InjectError(func(op Op, name string) error {
+		if op == OpSync && name == "bad" {
+			return injected
+		}
+		return nil
+	})
+
+	for _, name := range []string{"good", "bad"} {
+		f, err := Create(fs, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+		err = f.Sync()
+		if name == "bad" && !errors.Is(err, injected) {
+			t.Errorf("Got error %v syncing %q, want %v", err, name, injected)
+		}
+		if name == "good" && err != nil {
+			t.Errorf("Got error %v syncing %q, want nil", err, name)
+		}
+	}
+
+	fs.InjectError(nil)
+	fs.Crash()
+	if got := readFile(t, fs, "good"); got != "good" {
+		t.Errorf("Got %q, want %q", got, "good")
+	}
+	if got := readFile(t, fs, "bad"); got != "" {
+		t.Errorf("Got %q from file failed to sync, want empty", got)
+	}
+}
@@ -0,0 +1,107 @@
+// Package vfs provides the file system abstraction used by the DB.
+//
+// All file operations of the DB go through an FS. Default is backed by the operating system, while MemFS keeps
+// everything in memory, which is handy for tests.
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ErrLocked is returned by FS.Lock if the file is already locked.
+var ErrLocked = errors.New("vfs: file is already locked")
+
+// File is an opened file.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+
+	// Sync commits the written data to stable storage.
+	Sync() error
+
+	Stat() (os.FileInfo, error)
+}
+
+// FS is the file system used by the DB. Names are paths in the same format as the ones used by the os package.
+type FS interface {
+	// OpenFile opens the named file with the flags (os.O_RDONLY, os.O_CREATE, ...) and perm, like os.OpenFile.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+
+	// Remove removes the named file or (empty) directory.
+	Remove(name string) error
+
+	// Rename renames (moves) oldname to newname. If newname already exists, it is replaced.
+	Rename(oldname, newname string) error
+
+	// Truncate changes the size of the named file.
+	Truncate(name string, size int64) error
+
+	Stat(name string) (os.FileInfo, error)
+
+	// Glob returns the names of all files matching pattern, like filepath.Glob.
+	Glob(pattern string) ([]string, error)
+
+	// MkdirAll creates a directory named path, along with any necessary parents.
+	MkdirAll(path string, perm os.FileMode) error
+
+	// Lock acquires an exclusive lock on the named file, creating it if necessary. The lock is held until
+	// the returned closer is closed. If the file is already locked, ErrLocked is returned.
+	Lock(name string) (io.Closer, error)
+}
+
+// Open opens the named file for reading.
+func Open(fs FS, name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates the named file for writing.
+func Create(fs FS, name string) (File, error) {
+	return fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+// Default is the FS backed by the operating system.
+var Default FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (osFS) Truncate(name string, size int64) error {
+	return os.Truncate(name, size)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) Lock(name string) (io.Closer, error) {
+	return lockFile(name)
+}
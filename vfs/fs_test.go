@@ -0,0 +1,225 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testFS runs f against every FS implementation. root is an existing empty directory on the FS.
+func testFS(t *testing.T, f func(t *testing.T, fs FS, root string)) {
+	t.Run("OS", func(t *testing.T) {
+		f(t, Default, t.TempDir())
+	})
+	t.Run("Mem", func(t *testing.T) {
+		fs := NewMem()
+		if err := fs.MkdirAll("/root", 0755); err != nil {
+			t.Fatal(err)
+		}
+		f(t, fs, "/root")
+	})
+}
+
+func TestFS_ReadWrite(t *testing.T) {
+	testFS(t, func(t *testing.T, fs FS, root string) {
+		name := filepath.Join(root, "file")
+		w, err := fs.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []string{"Hello", ", ", "World"} {
+			if _, err := w.Write([]byte(s)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := Open(fs, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "Hello, World" {
+			t.Errorf("Got %q, want %q", got, "Hello, World")
+		}
+
+		if _, err := r.Seek(-5, io.SeekEnd); err != nil {
+			t.Fatal(err)
+		}
+		bs := make([]byte, 5)
+		if _, err := io.ReadFull(r, bs); err != nil {
+			t.Fatal(err)
+		}
+		if string(bs) != "World" {
+			t.Errorf("Got %q after seek, want %q", bs, "World")
+		}
+
+		bs = make([]byte, 2)
+		if _, err := r.ReadAt(bs, 5); err != nil {
+			t.Fatal(err)
+		}
+		if string(bs) != ", " {
+			t.Errorf("Got %q with ReadAt, want %q", bs, ", ")
+		}
+		if _, err := r.ReadAt(bs, 11); !errors.Is(err, io.EOF) {
+			t.Errorf("Got error %v reading past the end, want EOF", err)
+		}
+
+		if _, err := r.Write([]byte("x")); err == nil {
+			t.Error("Wrote to a read-only file")
+		}
+	})
+}
+
+func TestFS_OpenNotExist(t *testing.T) {
+	testFS(t, func(t *testing.T, fs FS, root string) {
+		if _, err := Open(fs, filepath.Join(root, "missing")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Got error %v, want %v", err, os.ErrNotExist)
+		}
+		if _, err := Create(fs, filepath.Join(root, "missing", "file")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Got error %v creating a file in a missing dir, want %v", err, os.ErrNotExist)
+		}
+	})
+}
+
+func TestFS_TruncateStat(t *testing.T) {
+	testFS(t, func(t *testing.T, fs FS, root string) {
+		name := filepath.Join(root, "file")
+		writeFile(t, fs, name, "0123456789")
+
+		if err := fs.Truncate(name, 4); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := fs.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != 4 {
+			t.Errorf("Got size %d, want 4", fi.Size())
+		}
+		if got := readFile(t, fs, name); got != "0123" {
+			t.Errorf("Got %q, want %q", got, "0123")
+		}
+	})
+}
+
+func TestFS_RemoveRename(t *testing.T) {
+	testFS(t, func(t *testing.T, fs FS, root string) {
+		a, b := filepath.Join(root, "a"), filepath.Join(root, "b")
+		writeFile(t, fs, a, "A")
+		writeFile(t, fs, b, "B")
+
+		if err := fs.Rename(a, b); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.Stat(a); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Got error %v, want %v", err, os.ErrNotExist)
+		}
+		if got := readFile(t, fs, b); got != "A" {
+			t.Errorf("Got %q, want %q", got, "A")
+		}
+
+		// A removed file is still readable through an opened handle.
+		r, err := Open(fs, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		if err := fs.Remove(b); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.Stat(b); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Got error %v, want %v", err, os.ErrNotExist)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "A" {
+			t.Errorf("Got %q from removed file, want %q", got, "A")
+		}
+	})
+}
+
+func TestFS_GlobMkdirAll(t *testing.T) {
+	testFS(t, func(t *testing.T, fs FS, root string) {
+		sub := filepath.Join(root, "x", "y")
+		if err := fs.MkdirAll(sub, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range []string{"1.wal", "2.wal", "1.sstable"} {
+			writeFile(t, fs, filepath.Join(sub, n), n)
+		}
+		writeFile(t, fs, filepath.Join(root, "x", "3.wal"), "")
+
+		got, err := fs.Glob(filepath.Join(sub, "*.wal"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{filepath.Join(sub, "1.wal"), filepath.Join(sub, "2.wal")}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Got %v, want %v", got, want)
+		}
+	})
+}
+
+func TestFS_Lock(t *testing.T) {
+	testFS(t, func(t *testing.T, fs FS, root string) {
+		name := filepath.Join(root, "LOCK")
+		l, err := fs.Lock(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.Lock(name); !errors.Is(err, ErrLocked) {
+			t.Fatalf("Got error %v, want %v", err, ErrLocked)
+		}
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+		l, err = fs.Lock(name)
+		if err != nil {
+			t.Fatalf("Fail to lock again after unlocking: %v", err)
+		}
+		_ = l.Close()
+	})
+}
+
+func writeFile(t *testing.T, fs FS, name, content string) {
+	t.Helper()
+	f, err := Create(fs, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, fs FS, name string) string {
+	t.Helper()
+	f, err := Open(fs, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	bs, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bs)
+}
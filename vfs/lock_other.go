@@ -0,0 +1,45 @@
+//go:build !unix
+
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// locked records the lock files held by this process.
+//
+// flock is not available on this platform, so we can only prevent the same file from being locked twice
+// in the current process.
+var locked sync.Map
+
+type processLock struct {
+	path string
+	f    *os.File
+}
+
+func (l *processLock) Close() error {
+	err := l.f.Close()
+	locked.Delete(l.path)
+	return err
+}
+
+// lockFile holds an exclusive lock on the file at path until the returned closer is closed.
+func lockFile(path string) (io.Closer, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("lock: fail to resolve path %s: %w", path, err)
+	}
+	if _, loaded := locked.LoadOrStore(abs, struct{}{}); loaded {
+		return nil, ErrLocked
+	}
+	f, err := os.OpenFile(abs, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		locked.Delete(abs)
+		return nil, fmt.Errorf("lock: fail to open file %s: %w", path, err)
+	}
+	return &processLock{abs, f}, nil
+}
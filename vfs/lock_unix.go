@@ -0,0 +1,32 @@
+//go:build unix
+
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// lockFile holds an exclusive advisory lock (flock) on the file at path. The lock is released when the
+// returned closer is closed, or when the process exits.
+//
+// flock locks belong to the opened file description, so a second lockFile on the same path fails even in
+// the same process.
+func lockFile(path string) (io.Closer, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("lock: fail to open file %s: %w", path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLocked
+		}
+		return nil, fmt.Errorf("lock: fail to lock file %s: %w", path, err)
+	}
+	// Closing the file releases the lock.
+	return f, nil
+}
@@ -0,0 +1,416 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemFS is an FS keeping all files in memory. It is safe for concurrent use.
+//
+// Like a POSIX file system, a removed file stays readable and writable through the handles opened before the
+// removal.
+type MemFS struct {
+	mu     sync.Mutex
+	files  map[string]*memData
+	dirs   map[string]bool
+	locked map[string]bool
+}
+
+// NewMem returns an empty MemFS.
+func NewMem() *MemFS {
+	return &MemFS{
+		files:  make(map[string]*memData),
+		dirs:   map[string]bool{".": true, "/": true},
+		locked: make(map[string]bool),
+	}
+}
+
+// memData is the content of a file. It is shared by all handles of the file.
+type memData struct {
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.dirs[name] {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	d, ok := fs.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		if !fs.dirs[filepath.Dir(name)] {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		d = &memData{modTime: time.Now()}
+		fs.files[name] = d
+	}
+
+	access := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	f := &memFile{
+		name:     name,
+		data:     d,
+		readable: access == os.O_RDONLY || access == os.O_RDWR,
+		writable: access == os.O_WRONLY || access == os.O_RDWR,
+		append:   flag&os.O_APPEND != 0,
+	}
+	if flag&os.O_TRUNC != 0 && f.writable {
+		d.mu.Lock()
+		d.data = nil
+		d.modTime = time.Now()
+		d.mu.Unlock()
+	}
+	return f, nil
+}
+
+func (fs *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.files[name]; ok {
+		delete(fs.files, name)
+		return nil
+	}
+	if fs.dirs[name] {
+		for n := range fs.files {
+			if filepath.Dir(n) == name {
+				return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+			}
+		}
+		for n := range fs.dirs {
+			if n != name && filepath.Dir(n) == name {
+				return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+			}
+		}
+		delete(fs.dirs, name)
+		return nil
+	}
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *MemFS) Rename(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	d, ok := fs.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if !fs.dirs[filepath.Dir(newname)] {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	delete(fs.files, oldname)
+	fs.files[newname] = d
+	return nil
+}
+
+func (fs *MemFS) Truncate(name string, size int64) error {
+	name = filepath.Clean(name)
+
+	fs.mu.Lock()
+	d, ok := fs.files[name]
+	fs.mu.Unlock()
+	if !ok {
+		return &os.PathError{Op: "truncate", Path: name, Err: os.ErrNotExist}
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: name, Err: errors.New("negative size")}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.data = resize(d.data, int(size))
+	d.modTime = time.Now()
+	return nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if d, ok := fs.files[name]; ok {
+		return d.stat(name), nil
+	}
+	if fs.dirs[name] {
+		return &memFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *MemFS) Glob(pattern string) ([]string, error) {
+	// Validate the pattern first, so that a bad pattern is reported even if there are no files.
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	clean := filepath.Clean(pattern)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var ret []string
+	for name := range fs.files {
+		if ok, _ := filepath.Match(clean, name); ok {
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (fs *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	path = filepath.Clean(path)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for p := path; !fs.dirs[p]; p = filepath.Dir(p) {
+		if _, ok := fs.files[p]; ok {
+			return &os.PathError{Op: "mkdir", Path: p, Err: errors.New("not a directory")}
+		}
+		fs.dirs[p] = true
+	}
+	return nil
+}
+
+func (fs *MemFS) Lock(name string) (io.Closer, error) {
+	f, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("lock: fail to open file %s: %w", name, err)
+	}
+	name = filepath.Clean(name)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.locked[name] {
+		_ = f.Close()
+		return nil, ErrLocked
+	}
+	fs.locked[name] = true
+	return &memLock{fs: fs, name: name, f: f}, nil
+}
+
+type memLock struct {
+	fs   *MemFS
+	name string
+	f    File
+}
+
+func (l *memLock) Close() error {
+	l.fs.mu.Lock()
+	delete(l.fs.locked, l.name)
+	l.fs.mu.Unlock()
+	return l.f.Close()
+}
+
+// memFile is an opened handle of a file in MemFS.
+type memFile struct {
+	name     string
+	data     *memData
+	readable bool
+	writable bool
+	append   bool
+
+	mu     sync.Mutex
+	offset int64
+	closed bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.readAt(p, off)
+}
+
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	if err := f.check("read", f.readable); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: errors.New("negative offset")}
+	}
+
+	f.data.mu.RLock()
+	defer f.data.mu.RUnlock()
+
+	if off >= int64(len(f.data.data)) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, f.data.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check("write", f.writable); err != nil {
+		return 0, err
+	}
+
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+
+	if f.append {
+		f.offset = int64(len(f.data.data))
+	}
+	end := int(f.offset) + len(p)
+	if end > len(f.data.data) {
+		f.data.data = resize(f.data.data, end)
+	}
+	copy(f.data.data[f.offset:], p)
+	f.offset = int64(end)
+	f.data.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check("seek", true); err != nil {
+		return 0, err
+	}
+
+	var base int64
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		base = f.offset
+	case io.SeekEnd:
+		f.data.mu.RLock()
+		base = int64(len(f.data.data))
+		f.data.mu.RUnlock()
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: errors.New("invalid whence")}
+	}
+	if base+offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: errors.New("negative offset")}
+	}
+	f.offset = base + offset
+	return f.offset, nil
+}
+
+func (f *memFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.check("sync", true)
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check("stat", true); err != nil {
+		return nil, err
+	}
+	return f.data.stat(f.name), nil
+}
+
+func (f *memFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check("close", true); err != nil {
+		return err
+	}
+	f.closed = true
+	return nil
+}
+
+// check returns an error if the file is closed or the operation is not allowed.
+func (f *memFile) check(op string, allowed bool) error {
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	if !allowed {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (d *memData) stat(name string) os.FileInfo {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return &memFileInfo{name: filepath.Base(name), size: int64(len(d.data)), modTime: d.modTime}
+}
+
+// resize returns bs with length n. Newly added bytes are zero.
+func resize(bs []byte, n int) []byte {
+	if n <= len(bs) {
+		return bs[:n]
+	}
+	return append(bs, make([]byte, n-len(bs))...)
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *memFileInfo) Name() string {
+	return i.name
+}
+
+func (i *memFileInfo) Size() int64 {
+	return i.size
+}
+
+func (i *memFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (i *memFileInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+func (i *memFileInfo) IsDir() bool {
+	return i.dir
+}
+
+func (i *memFileInfo) Sys() any {
+	return nil
+}